@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Export archive layout
+//
+// An archive written by "log_fwd buffer export" is NDJSON, optionally
+// gzipped. The first line is an archiveHeader, followed by one line per
+// record and a final line with "end" set and the number of records, so a
+// truncated archive can be detected:
+//
+//	{"format":"log_fwd-export","version":1,"host":"web-1",...}
+//	{"data":"first log line\n"}
+//	{"base64":"//79Cg=="}
+//	{"end":true,"records":2}
+//
+// Records that aren't valid UTF-8 are stored base64 encoded so they survive
+// the round trip unchanged.
+const (
+	archiveFormat  = "log_fwd-export"
+	archiveVersion = 1
+)
+
+// archiveHeader describes where an archive came from
+type archiveHeader struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Host       string `json:"host,omitempty"`
+	Buffer     string `json:"buffer,omitempty"`
+	BufferType string `json:"buffer_type,omitempty"`
+	ExportedAt string `json:"exported_at"`
+}
+
+// archiveEntry is a record line, or the end line, of an archive
+type archiveEntry struct {
+	Data    string `json:"data,omitempty"`
+	Base64  []byte `json:"base64,omitempty"`
+	End     bool   `json:"end,omitempty"`
+	Records int64  `json:"records,omitempty"`
+}
+
+// errTruncatedArchive is returned when an archive ends without its end line
+var errTruncatedArchive = errors.New("archive is truncated")
+
+// archiveWriter writes an export archive
+type archiveWriter struct {
+	zw      *gzip.Writer // Set when the archive is gzipped
+	enc     *json.Encoder
+	records int64
+}
+
+// newArchiveWriter starts an archive on w, writing the header
+func newArchiveWriter(w io.Writer, compress bool, header archiveHeader) (*archiveWriter, error) {
+	aw := &archiveWriter{}
+	if compress {
+		aw.zw = gzip.NewWriter(w)
+		w = aw.zw
+	}
+	aw.enc = json.NewEncoder(w)
+
+	header.Format = archiveFormat
+	header.Version = archiveVersion
+	if header.ExportedAt == "" {
+		header.ExportedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if err := aw.enc.Encode(header); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return aw, nil
+}
+
+// write adds a record to the archive
+func (aw *archiveWriter) write(data []byte) error {
+	entry := archiveEntry{Data: string(data)}
+	if !utf8.Valid(data) {
+		entry = archiveEntry{Base64: data}
+	}
+	if err := aw.enc.Encode(entry); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	aw.records++
+	return nil
+}
+
+// Close writes the end line and flushes the archive, without closing the
+// underlying writer
+func (aw *archiveWriter) Close() error {
+	if err := aw.enc.Encode(archiveEntry{End: true, Records: aw.records}); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if aw.zw != nil {
+		if err := aw.zw.Close(); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	return nil
+}
+
+// archiveReader reads the records of an export archive
+type archiveReader struct {
+	header  archiveHeader
+	r       *bufio.Reader
+	records int64
+	done    bool
+}
+
+// openArchive reads the header of an archive, which may be gzipped
+func openArchive(r io.Reader) (*archiveReader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		br = bufio.NewReader(zr)
+	}
+
+	ar := &archiveReader{r: br}
+	line, err := ar.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(line, &ar.header); err != nil || ar.header.Format != archiveFormat {
+		return nil, errors.New("not a log_fwd export archive")
+	}
+	if ar.header.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", ar.header.Version)
+	}
+	return ar, nil
+}
+
+// readLine returns the next line of the archive
+func (ar *archiveReader) readLine() ([]byte, error) {
+	line, err := ar.r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return nil, errTruncatedArchive
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return line, nil
+}
+
+// next returns the next record, or io.EOF once the whole archive has been read
+func (ar *archiveReader) next() ([]byte, error) {
+	if ar.done {
+		return nil, io.EOF
+	}
+
+	line, err := ar.readLine()
+	if err != nil {
+		return nil, err
+	}
+	var entry archiveEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("invalid archive record %d: %w", ar.records+1, err)
+	}
+
+	if entry.End {
+		if entry.Records != ar.records {
+			return nil, fmt.Errorf("archive holds %d records but should have %d", ar.records, entry.Records)
+		}
+		ar.done = true
+		return nil, io.EOF
+	}
+
+	ar.records++
+	if entry.Base64 != nil {
+		return entry.Base64, nil
+	}
+	return []byte(entry.Data), nil
+}
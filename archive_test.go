@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	records := [][]byte{
+		[]byte("first line\n"),
+		[]byte("caf\xe9 latin-1\n"), // Not valid UTF-8
+		[]byte(`{"json":"line"}` + "\n"),
+	}
+
+	for _, compress := range []bool{false, true} {
+		var archive bytes.Buffer
+		aw, err := newArchiveWriter(&archive, compress, archiveHeader{Host: "web-1", Buffer: "buffer.log"})
+		if err != nil {
+			t.Fatalf("newArchiveWriter failed: %v", err)
+		}
+		for _, rec := range records {
+			if err := aw.write(rec); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		if gzipped := bytes.HasPrefix(archive.Bytes(), []byte{0x1f, 0x8b}); gzipped != compress {
+			t.Errorf("Archive gzipped = %v, want %v", gzipped, compress)
+		}
+
+		ar, err := openArchive(&archive)
+		if err != nil {
+			t.Fatalf("openArchive failed: %v", err)
+		}
+		if ar.header.Host != "web-1" || ar.header.ExportedAt == "" {
+			t.Errorf("Archive header = %+v", ar.header)
+		}
+		for i, want := range records {
+			got, err := ar.next()
+			if err != nil {
+				t.Fatalf("next failed: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Record %d = %q, want %q", i, got, want)
+			}
+		}
+		if _, err := ar.next(); err != io.EOF {
+			t.Errorf("next after the last record = %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestArchiveErrors(t *testing.T) {
+	header := `{"format":"log_fwd-export","version":1,"exported_at":"2024-05-01T10:00:00Z"}` + "\n"
+	tests := []struct {
+		name    string
+		archive string
+	}{
+		{"empty", ""},
+		{"not an archive", "just some logs\n"},
+		{"future version", `{"format":"log_fwd-export","version":9}` + "\n"},
+		{"truncated", header + `{"data":"line\n"}` + "\n"},
+		{"wrong count", header + `{"data":"line\n"}` + "\n" + `{"end":true,"records":2}` + "\n"},
+		{"invalid record", header + "{not json\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ar, err := openArchive(strings.NewReader(tc.archive))
+			for err == nil {
+				_, err = ar.next()
+			}
+			if err == io.EOF {
+				t.Error("Expected the archive to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import "slices"
+
+// Batched writes
+//
+// WriteBatch stores several records with one lock acquisition, one write call
+// for records that end up next to each other, one state update and one wait
+// for the sync policy, instead of one of each per record. It returns how many
+// records were stored: on error, data[n] is the record that failed and the
+// ones after it weren't attempted. A failure to sync is returned with every
+// record counted as stored, as they are in the buffer. As with Write, empty
+// records are skipped and records taken by the overflow policy count as stored.
+
+// encodeBatch encodes the records of a batch, stopping at the first one that
+// fails to encode. Empty records stay empty, as they are never stored.
+func encodeBatch(codec recordCodec, data [][]byte) ([]record, error) {
+	recs := make([]record, 0, len(data))
+	for _, d := range data {
+		if len(d) == 0 {
+			recs = append(recs, record{})
+			continue
+		}
+		payload, flags, err := codec.encode(d)
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, record{payload: payload, flags: flags})
+	}
+	return recs, nil
+}
+
+// stagedWrite collects encoded records that go next to each other in a file,
+// so that they are written with a single call
+type stagedWrite struct {
+	pos   int64  // Where the staged data goes
+	data  []byte // Framed records not written yet
+	count int    // Number of records staged
+	size  int64  // Bytes of all records added to the file, written or not
+	lost  int    // Records taken back out after failing to be written
+}
+
+// add stages a record that goes at pos, right after the records staged so far
+func (w *stagedWrite) add(pos int64, rec record) {
+	if w.count == 0 {
+		w.pos = pos
+	}
+	w.data = appendRecord(slices.Grow(w.data, int(recordSize(len(rec.payload)))), rec.payload, rec.flags)
+	w.count++
+	w.size += recordSize(len(rec.payload))
+}
+
+// reset empties the staging area once its records are written
+func (w *stagedWrite) reset() {
+	w.data = w.data[:0]
+	w.count = 0
+}
+
+// abandon empties the staging area after its records failed to be written
+func (w *stagedWrite) abandon() {
+	w.size -= int64(len(w.data))
+	w.lost += w.count
+	w.reset()
+}
+
+// writeRuns writes a batch to buffers that split records between them, such
+// as priority lanes, handing consecutive records for the same buffer over in
+// one WriteBatch call
+func writeRuns(data [][]byte, route func(data []byte) BufferInterface) (int, error) {
+	buffers := make([]BufferInterface, len(data))
+	for i, d := range data {
+		buffers[i] = route(d)
+	}
+
+	for start := 0; start < len(data); {
+		end := start + 1
+		for end < len(data) && buffers[end] == buffers[start] {
+			end++
+		}
+		n, err := buffers[start].WriteBatch(data[start:end])
+		if err != nil {
+			return start + n, err
+		}
+		start = end
+	}
+	return len(data), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// readAllRecords reads and commits every pending record of a buffer
+func readAllRecords(t *testing.T, buffer BufferInterface) []string {
+	t.Helper()
+	var lines []string
+	for {
+		records, offset, err := buffer.ReadRecords(100)
+		if err == io.EOF {
+			return lines
+		}
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		for _, record := range records {
+			lines = append(lines, string(record))
+		}
+		if err := buffer.Commit(offset); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+}
+
+// testBatch returns n log lines with an empty record mixed in
+func testBatch(n int) [][]byte {
+	var batch [][]byte
+	for i := 0; i < n; i++ {
+		batch = append(batch, []byte(testLogLine(i)))
+		if i == n/2 {
+			batch = append(batch, nil)
+		}
+	}
+	return batch
+}
+
+func TestWriteBatch(t *testing.T) {
+	tmpdir := t.TempDir()
+	buffers := []struct {
+		name string
+		open func() (BufferInterface, error)
+	}{
+		// Small enough to grow and roll part way through the batch
+		{"circular", func() (BufferInterface, error) {
+			return NewBufferWithOptions(filepath.Join(tmpdir, "buffer.log"), 1<<20, BufferOptions{})
+		}},
+		{"segment", func() (BufferInterface, error) {
+			return NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1<<20, BufferOptions{SegmentSize: 16 * 1024})
+		}},
+		{"memory", func() (BufferInterface, error) {
+			return NewMemoryBuffer(1<<20, BufferOptions{})
+		}},
+	}
+
+	batch := testBatch(500)
+	for _, tc := range buffers {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer, err := tc.open()
+			if err != nil {
+				t.Fatalf("Failed to create buffer: %v", err)
+			}
+			n, err := buffer.WriteBatch(batch)
+			if err != nil || n != len(batch) {
+				t.Fatalf("WriteBatch = %d, %v, want %d", n, err, len(batch))
+			}
+
+			// The batch survives a restart, except in memory
+			if tc.name != "memory" {
+				if err := buffer.Close(); err != nil {
+					t.Fatalf("Close failed: %v", err)
+				}
+				if buffer, err = tc.open(); err != nil {
+					t.Fatalf("Reopening failed: %v", err)
+				}
+			}
+			defer buffer.Close()
+
+			lines := readAllRecords(t, buffer)
+			if len(lines) != 500 {
+				t.Fatalf("Read %d records, want 500", len(lines))
+			}
+			for i, line := range lines {
+				if line != testLogLine(i) {
+					t.Fatalf("Record %d = %q, want %q", i, line, testLogLine(i))
+				}
+			}
+		})
+	}
+}
+
+func TestWriteBatchWrapsAround(t *testing.T) {
+	buffer, err := NewBuffer(filepath.Join(t.TempDir(), "buffer.log"), InitialBufferSize)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	// Move the write position close to the end of the file
+	for i := 0; i < 100; i++ {
+		buffer.Write([]byte(testLogLine(i)))
+	}
+	readAllRecords(t, buffer)
+
+	// The batch wraps around, and then overwrites its own oldest records
+	batch := testBatch(200)
+	if n, err := buffer.WriteBatch(batch); err != nil || n != len(batch) {
+		t.Fatalf("WriteBatch = %d, %v, want %d", n, err, len(batch))
+	}
+	lines := readAllRecords(t, buffer)
+	if len(lines) == 0 || len(lines) == 200 {
+		t.Fatalf("Read %d records, want the newest that fit", len(lines))
+	}
+	first := 200 - len(lines)
+	for i, line := range lines {
+		if line != testLogLine(first+i) {
+			t.Fatalf("Record %d = %q, want %q", i, line, testLogLine(first+i))
+		}
+	}
+
+	drops := buffer.TakeDrops()
+	if len(drops) != 1 || drops[0].Lines != int64(first) {
+		t.Errorf("TakeDrops returned %+v, want %d overwritten lines", drops, first)
+	}
+}
+
+func TestWriteBatchStopsWhenFull(t *testing.T) {
+	buffer, err := NewBufferWithOptions(filepath.Join(t.TempDir(), "buffer.log"), InitialBufferSize,
+		BufferOptions{Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	batch := testBatch(200)
+	n, err := buffer.WriteBatch(batch)
+	if !errors.Is(err, ErrBufferFull) || n == 0 || n >= len(batch) {
+		t.Fatalf("WriteBatch = %d, %v, want the records that fit and ErrBufferFull", n, err)
+	}
+
+	// Exactly the records before the one that failed were stored
+	if lines := readAllRecords(t, buffer); len(lines) != n-1 {
+		t.Errorf("Read %d records after storing %d, one of them empty", len(lines), n)
+	}
+}
+
+func TestWriteBatchSplitsByLane(t *testing.T) {
+	lb := newTestLanes(t, 1<<20, 1<<20)
+
+	var batch [][]byte
+	for i := 0; i < 10; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("level=info msg=%d\n", i)))
+		if i%3 == 0 {
+			batch = append(batch, []byte(fmt.Sprintf("level=error msg=%d\n", i)))
+		}
+	}
+	if n, err := lb.WriteBatch(batch); err != nil || n != len(batch) {
+		t.Fatalf("WriteBatch = %d, %v, want %d", n, err, len(batch))
+	}
+
+	lines := readAllRecords(t, lb)
+	want := []string{"level=error msg=0\n", "level=error msg=3\n", "level=error msg=6\n", "level=error msg=9\n"}
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("level=info msg=%d\n", i))
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("Read %q, want %q", lines, want)
+	}
+}
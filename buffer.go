@@ -1,37 +1,163 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 // BufferInterface defines the interface for buffer types
 type BufferInterface interface {
 	Write(data []byte) (int, error)
+	WriteBatch(data [][]byte) (int, error) // Stores several records at once, returning how many were stored
 	Read(maxBytes int64) ([]byte, error)
+	ReadRecords(maxRecords int) ([][]byte, int64, error)
+	Commit(offset int64) error
 	HasData() bool
 	GetSize() int64
 	Close() error
 }
 
-// CircularBuffer implements a simple circular buffer using a file
+// bufferFile is the storage of a CircularBuffer and its state: an *os.File,
+// or a memory mapping of one for the mmap buffer
+type bufferFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// BufferOptions holds the optional settings shared by the buffer implementations
+type BufferOptions struct {
+	Overflow    string        // Overflow policy (see the Overflow* constants)
+	SpillPath   string        // Spill file for OverflowSpill, defaults to <buffer>.spill
+	SegmentSize int64         // Segment buffer only: size at which a new segment is started
+	SegmentAge  time.Duration // Segment buffer only: age at which a new segment is started
+	ShrinkAfter time.Duration // File buffer only: how long the file must stay mostly empty before it is shrunk (0 to never shrink)
+
+	Sync         string        // Sync policy (see the Sync* constants)
+	SyncInterval time.Duration // Flush interval for SyncInterval
+	SyncBytes    int64         // Flush threshold for SyncBytes
+
+	Compression string        // Compression of new records (see the Compression* constants)
+	Keys        *keyRing      // Encryption keys; records are stored unencrypted if nil
+	MinFree     diskReserve   // Free space to keep on the buffer's filesystem
+	MaxAge      time.Duration // Records buffered for longer are dropped instead of sent (0 to disable)
+}
+
+// openBuffer creates the buffer implementation selected in the config
+func openBuffer(cfg *Config) (BufferInterface, error) {
+	opts := cfg.bufferOptions()
+	keys, err := loadKeyRing(cfg.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	opts.Keys = keys
+
+	if len(cfg.PriorityLanes) > 0 {
+		return openLanes(cfg, opts)
+	}
+	if cfg.FairKey.isSet() {
+		return openFairQueue(cfg, opts)
+	}
+	return openBufferAt(cfg.BufferType, cfg.BufferPath, cfg.MaxSize, opts)
+}
+
+// openBufferAt creates a buffer of the given type at path
+func openBufferAt(bufferType, path string, maxSize int64, opts BufferOptions) (BufferInterface, error) {
+	switch bufferType {
+	case BufferTypeSegment:
+		buffer, err := NewSegmentBuffer(path, maxSize, opts)
+		if err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	case BufferTypeMemory:
+		buffer, err := NewMemoryBuffer(maxSize, opts)
+		if err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	case "", BufferTypeFile:
+		buffer, err := NewBufferWithOptions(path, maxSize, opts)
+		if err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	case BufferTypeMmap:
+		buffer, err := NewMmapBuffer(path, maxSize, opts)
+		if err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	}
+	return nil, fmt.Errorf("%w: unknown buffer type %q", ErrInvalidConfig, bufferType)
+}
+
+// CircularBuffer implements a simple circular buffer of records using a file
 type CircularBuffer struct {
-	file     *os.File
-	mutex    sync.Mutex
-	readPos  int64
-	writePos int64
-	size     int64
-	fileSize int64
-	maxSize  int64
+	file      bufferFile
+	stateFile bufferFile // Sidecar file holding the persisted cursors
+	stateSeq  uint64     // Sequence number of the last persisted state
+	mutex     sync.Mutex
+	readPos   int64
+	writePos  int64
+	size      int64
+	fileSize  int64
+	maxSize   int64
+	head      int64            // Logical offset of readPos, counting every byte ever consumed or dropped
+	overflow  *overflowHandler // Decides what happens to records that don't fit
+	drops     dropCounter      // Records lost to overflow, reported as gap markers
+	skipped   skippedRecords   // Records the last read skipped, dropped once committed
+	syncer    *syncer          // Flushes writes to disk according to the sync policy
+	codec     recordCodec      // Encodes log data into record payloads
+	lock      *fileLock        // Keeps other processes from using the buffer
+	disk      *diskGuard       // Limits growth to keep free disk space in reserve
+
+	shrinkAfter time.Duration // How long the file must stay mostly empty before it is shrunk
+	lowSince    time.Time     // When the file last became mostly empty, zero if it isn't
+	shrinkStop  chan struct{} // Closed to stop watchShrink
+	shrinkDone  chan struct{} // Closed when watchShrink has returned
+	stopShrink  sync.Once
 }
 
+// shrinkCheckInterval is how often an idle buffer checks whether its file
+// should shrink; writes and commits check as well
+var shrinkCheckInterval = 10 * time.Second
+
 // NewBuffer creates a new circular buffer with dynamic growth
 func NewBuffer(path string, maxSize int64) (*CircularBuffer, error) {
+	return NewBufferWithOptions(path, maxSize, BufferOptions{})
+}
+
+// NewBufferWithOptions creates a new circular buffer with the given options
+func NewBufferWithOptions(path string, maxSize int64, opts BufferOptions) (*CircularBuffer, error) {
+	return newCircularBuffer(path, maxSize, opts, false)
+}
+
+// NewMmapBuffer creates a circular buffer that accesses its files through
+// shared memory mappings, so writing and reading records takes no system
+// calls. The files are the same as those of NewBufferWithOptions. Only
+// supported on Linux.
+func NewMmapBuffer(path string, maxSize int64, opts BufferOptions) (*CircularBuffer, error) {
+	return newCircularBuffer(path, maxSize, opts, true)
+}
+
+// newCircularBuffer opens a circular buffer, mapping its files if mapped is set
+func newCircularBuffer(path string, maxSize int64, opts BufferOptions, mapped bool) (*CircularBuffer, error) {
 	debugf("Creating buffer with path: %s, maxSize: %d bytes", path, maxSize)
 
+	cb := &CircularBuffer{maxSize: maxSize, shrinkAfter: opts.ShrinkAfter, disk: newDiskGuard(filepath.Dir(path), opts.MinFree)}
+	overflow, err := newOverflowHandler(opts, path, &cb.drops)
+	if err != nil {
+		return nil, err
+	}
+	cb.overflow = overflow
 	// Create buffer directory if it doesn't exist
 	dir := filepath.Dir(path)
 	debugf("Ensuring buffer directory exists: %s", dir)
@@ -40,11 +166,19 @@ func NewBuffer(path string, maxSize int64) (*CircularBuffer, error) {
 		return nil, fmt.Errorf("failed to create buffer directory: %w", err)
 	}
 
+	// Make sure no other forwarder is using the buffer
+	lock, err := acquireLock(lockPath(path))
+	if err != nil {
+		return nil, err
+	}
+	cb.lock = lock
+
 	// Open or create the buffer file
 	debugf("Opening buffer file: %s", path)
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		debugf("Failed to open buffer file: %v", err)
+		lock.release()
 		return nil, fmt.Errorf("failed to open buffer file: %w", err)
 	}
 	debugf("Buffer file opened successfully")
@@ -54,6 +188,7 @@ func NewBuffer(path string, maxSize int64) (*CircularBuffer, error) {
 	if err != nil {
 		debugf("Failed to stat buffer file: %v", err)
 		file.Close()
+		lock.release()
 		return nil, fmt.Errorf("failed to stat buffer file: %w", err)
 	}
 
@@ -66,113 +201,671 @@ func NewBuffer(path string, maxSize int64) (*CircularBuffer, error) {
 		if err := file.Truncate(InitialBufferSize); err != nil {
 			debugf("Failed to initialize buffer file: %v", err)
 			file.Close()
+			lock.release()
 			return nil, fmt.Errorf("failed to initialize buffer file: %w", err)
 		}
 		fileSize = InitialBufferSize
 	}
 
-	return &CircularBuffer{
-		file:     file,
-		maxSize:  maxSize,
-		fileSize: fileSize,
-		size:     0, // Start assuming buffer is empty
-		readPos:  0,
-		writePos: 0,
-	}, nil
+	// Open the state file holding the cursors from a previous run
+	debugf("Opening buffer state file: %s", statePath(path))
+	stateFile, err := os.OpenFile(statePath(path), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		debugf("Failed to open buffer state file: %v", err)
+		file.Close()
+		lock.release()
+		return nil, fmt.Errorf("failed to open buffer state file: %w", err)
+	}
+
+	cb.file = file
+	cb.stateFile = stateFile
+	cb.fileSize = fileSize
+	if mapped {
+		debugf("Mapping buffer files into memory")
+		cb.file, cb.stateFile, err = mapBufferFiles(file, stateFile)
+		if err != nil {
+			file.Close()
+			stateFile.Close()
+			lock.release()
+			return nil, err
+		}
+	}
+
+	cb.syncer, err = newSyncer(opts, func() error {
+		// Data first, so the persisted cursors never point at unsynced records
+		return syncFiles(cb.file, cb.stateFile)
+	})
+	if err != nil {
+		cb.file.Close()
+		cb.stateFile.Close()
+		lock.release()
+		return nil, err
+	}
+
+	if err := cb.restoreState(); err != nil {
+		cb.syncer.Close()
+		cb.file.Close()
+		cb.stateFile.Close()
+		lock.release()
+		return nil, err
+	}
+
+	cb.codec, err = newRecordCodec(opts, path+".dict", cb.size == 0)
+	if err != nil {
+		cb.syncer.Close()
+		cb.file.Close()
+		cb.stateFile.Close()
+		lock.release()
+		return nil, err
+	}
+
+	cb.shrinkStop = make(chan struct{})
+	cb.shrinkDone = make(chan struct{})
+	if cb.shrinkAfter > 0 {
+		go cb.watchShrink()
+	} else {
+		close(cb.shrinkDone)
+	}
+
+	return cb, nil
+}
+
+// restoreState resumes from the persisted cursors, falling back to an empty
+// buffer when the state is missing or disagrees with the buffer file
+func (cb *CircularBuffer) restoreState() error {
+	state, err := readState(cb.stateFile)
+	if err == errNoState {
+		debugf("No saved buffer state found, starting with an empty buffer")
+		return cb.persistState()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load buffer state: %w", err)
+	}
+
+	cb.stateSeq = state.seq
+	if err := state.validate(cb.fileSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: discarding inconsistent buffer state: %v\n", err)
+		return cb.persistState()
+	}
+
+	// The file may have been grown right before a crash without the new
+	// size being recorded; nothing was written past the old size, so shrink back
+	if cb.fileSize > state.fileSize {
+		debugf("Buffer file is larger than recorded (%d > %d), truncating", cb.fileSize, state.fileSize)
+		if err := cb.file.Truncate(state.fileSize); err != nil {
+			return fmt.Errorf("failed to restore buffer file size: %w", err)
+		}
+	}
+
+	cb.readPos = state.readPos
+	cb.writePos = state.writePos
+	cb.size = state.size
+	cb.fileSize = state.fileSize
+	debugf("Restored buffer state: %d bytes pending (read %d, write %d, file %d)",
+		cb.size, cb.readPos, cb.writePos, cb.fileSize)
+
+	return cb.checkRecords()
 }
 
-// Write writes data to the buffer
+// checkRecords verifies the checksum of every pending record and reports
+// corrupt data, which is skipped when the records are read
+func (cb *CircularBuffer) checkRecords() error {
+	var records, corrupt, consumed int64
+	pos := cb.readPos
+	for consumed < cb.size {
+		_, skipped, recLen, err := cb.nextRecord(pos, cb.size-consumed)
+		if err != nil {
+			return fmt.Errorf("failed to verify buffer records: %w", err)
+		}
+		if recLen > 0 {
+			records++
+		}
+		corrupt += skipped
+		consumed += skipped + recLen
+		pos = (pos + skipped + recLen) % cb.fileSize
+	}
+
+	if corrupt > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: buffer contains %d bytes of corrupt data, which will be skipped\n", corrupt)
+	}
+	debugf("Verified %d pending records in buffer", records)
+
+	return nil
+}
+
+// persistState records the current cursors in the state file
+func (cb *CircularBuffer) persistState() error {
+	cb.stateSeq++
+	return writeState(cb.stateFile, bufferState{
+		seq:      cb.stateSeq,
+		readPos:  cb.readPos,
+		writePos: cb.writePos,
+		size:     cb.size,
+		fileSize: cb.fileSize,
+	})
+}
+
+// Write appends data to the buffer as a single record. Depending on the sync
+// policy it returns only once the record is on disk.
 func (cb *CircularBuffer) Write(data []byte) (int, error) {
+	// Empty records are never stored
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	payload, flags, err := cb.codec.encode(data)
+	if err != nil {
+		return 0, err
+	}
+
+	n, seq, err := cb.write(data, record{payload: payload, flags: flags})
+	if err != nil || seq == 0 {
+		return n, err
+	}
+	if err := cb.syncer.wait(seq); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// write stores rec, the encoded form of data, and returns the sync sequence
+// number of the write, which is zero if nothing was written to the buffer
+func (cb *CircularBuffer) write(data []byte, rec record) (int, uint64, error) {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 
-	dataLen := int64(len(data))
+	cb.maybeShrink()
+
+	var w stagedWrite
+	n, err := cb.add(&w, data, rec)
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := cb.finishWrite(&w)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, seq, nil
+}
+
+// WriteBatch appends several records to the buffer under a single lock, with
+// a single write for records that don't wrap or need room made for them
+func (cb *CircularBuffer) WriteBatch(data [][]byte) (int, error) {
+	recs, encodeErr := encodeBatch(cb.codec, data)
+
+	cb.mutex.Lock()
+	cb.maybeShrink()
+
+	var w stagedWrite
+	n := 0
+	var err error
+	for ; n < len(recs); n++ {
+		if len(data[n]) == 0 {
+			continue
+		}
+		if _, err = cb.add(&w, data[n], recs[n]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = encodeErr
+	}
+	seq, finishErr := cb.finishWrite(&w)
+	if finishErr != nil {
+		err = finishErr
+	}
+	// Records that failed to be written were the last ones added
+	n -= w.lost
+	cb.mutex.Unlock()
 
-	// Check if data is larger than max buffer
-	if dataLen > cb.maxSize {
+	if seq != 0 {
+		if err := cb.syncer.wait(seq); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// add makes room for rec, the encoded form of data, and stages it in w. It
+// returns the bytes of data stored, which includes records taken by the
+// overflow policy. Anything that moves records around in the file writes the
+// staged records first. The caller must hold the mutex.
+func (cb *CircularBuffer) add(w *stagedWrite, data []byte, rec record) (int, error) {
+	recLen := recordSize(len(rec.payload))
+
+	// Check if the record is larger than max buffer
+	if recLen > cb.maxSize || len(rec.payload) > maxRecordPayload {
 		return 0, fmt.Errorf("data exceeds maximum buffer size")
 	}
 
 	// Check if buffer needs to grow
-	requiredSpace := cb.size + dataLen
-	if requiredSpace > cb.fileSize {
-		// Need to grow the file (if possible)
-		newSize := cb.fileSize * 2
-		if newSize > cb.maxSize {
-			newSize = cb.maxSize
-		}
-
-		if newSize < requiredSpace && cb.size < cb.maxSize {
-			// Overwrite oldest data in circular fashion
-			cb.readPos = (cb.writePos + dataLen) % cb.fileSize
-			cb.size = cb.fileSize
-		} else if newSize >= requiredSpace {
-			// Grow the file
-			if err := cb.file.Truncate(newSize); err != nil {
-				return 0, fmt.Errorf("failed to grow buffer: %w", err)
-			}
-			cb.fileSize = newSize
+	requiredSpace := cb.size + recLen
+	if requiredSpace > cb.fileSize && cb.fileSize < cb.maxSize {
+		if err := cb.flushStaged(w); err != nil {
+			return 0, err
+		}
+		if err := cb.grow(requiredSpace); err != nil {
+			return 0, err
 		}
 	}
 
-	// Write the data, handling wrapping if needed
-	if cb.writePos+dataLen <= cb.fileSize {
-		// Simple case: write in one chunk
-		if _, err := cb.file.WriteAt(data, cb.writePos); err != nil {
+	// Without room, let the overflow policy decide what to do with the record
+	if cb.size+recLen > cb.fileSize && !cb.overflow.dropsOldest() {
+		if err := cb.flushStaged(w); err != nil {
 			return 0, err
 		}
-	} else {
-		// Write in two chunks (wrap around)
-		firstChunkSize := cb.fileSize - cb.writePos
-		if _, err := cb.file.WriteAt(data[:firstChunkSize], cb.writePos); err != nil {
+		return cb.overflow.handle(data)
+	}
+
+	// Low disk space can keep the file too small for the record altogether
+	if recLen > cb.fileSize {
+		return cb.overflow.refuse(data)
+	}
+
+	// Overwrite the oldest records in circular fashion until the new one fits
+	if cb.size+recLen > cb.fileSize {
+		if err := cb.flushStaged(w); err != nil {
 			return 0, err
 		}
-		if _, err := cb.file.WriteAt(data[firstChunkSize:], 0); err != nil {
-			return 0, err
+		for cb.size+recLen > cb.fileSize {
+			if err := cb.dropOldest(); err != nil {
+				return 0, err
+			}
 		}
 	}
 
+	w.add(cb.writePos, rec)
+
 	// Update write position and size
-	cb.writePos = (cb.writePos + dataLen) % cb.fileSize
+	cb.writePos = (cb.writePos + recLen) % cb.fileSize
+	cb.size += recLen
+	return len(data), nil
+}
 
-	// Update size, capped at fileSize
-	if cb.size < cb.fileSize {
-		cb.size += dataLen
-		if cb.size > cb.fileSize {
-			cb.size = cb.fileSize
+// flushStaged writes the staged records to the file, handling wrapping. If
+// that fails, they are taken back out of the buffer. The caller must hold the
+// mutex.
+func (cb *CircularBuffer) flushStaged(w *stagedWrite) error {
+	if w.count == 0 {
+		return nil
+	}
+	if err := cb.writeRing(w.pos, w.data); err != nil {
+		cb.writePos = w.pos
+		cb.size -= int64(len(w.data))
+		w.abandon()
+		return err
+	}
+	w.reset()
+	return nil
+}
+
+// finishWrite writes the staged records and persists the state once for all
+// records added, returning the sync sequence number of the write, or zero if
+// nothing was added to the buffer; the caller must hold the mutex
+func (cb *CircularBuffer) finishWrite(w *stagedWrite) (uint64, error) {
+	flushErr := cb.flushStaged(w)
+	if w.size == 0 {
+		return 0, flushErr
+	}
+	if err := cb.persistState(); err != nil {
+		return 0, err
+	}
+	return cb.syncer.wrote(w.size), flushErr
+}
+
+// grow enlarges the file towards requiredSpace (capped at maxSize and by the
+// free disk space reserve) while keeping the buffered records contiguous; the
+// caller must hold the mutex
+func (cb *CircularBuffer) grow(requiredSpace int64) error {
+	oldSize := cb.fileSize
+	newSize := oldSize * 2
+	for newSize < requiredSpace && newSize < cb.maxSize {
+		newSize *= 2
+	}
+
+	// If the data wraps around, prefer moving the wrapped part past the old
+	// end of the file; that only writes to new space, so a crash part way
+	// through leaves the old layout intact
+	wrapped := cb.size > 0 && cb.writePos <= cb.readPos
+	if wrapped && newSize < oldSize+cb.writePos {
+		newSize = oldSize + cb.writePos
+	}
+	if newSize > cb.maxSize {
+		newSize = cb.maxSize
+	}
+	if room := cb.disk.available(); newSize-oldSize > room {
+		cb.disk.refused()
+		newSize = oldSize + room
+		if newSize <= oldSize {
+			return nil
 		}
 	}
 
-	return len(data), nil
+	debugf("Growing buffer file from %d to %d bytes", oldSize, newSize)
+	if err := cb.file.Truncate(newSize); err != nil {
+		return fmt.Errorf("failed to grow buffer: %w", err)
+	}
+	cb.fileSize = newSize
+	cb.disk.wrote(newSize - oldSize)
+
+	if !wrapped {
+		return nil
+	}
+
+	if oldSize+cb.writePos <= newSize {
+		// Move [0, writePos) to the new space after the old end
+		if err := cb.copyRange(0, oldSize, cb.writePos); err != nil {
+			return fmt.Errorf("failed to relocate buffer data: %w", err)
+		}
+		cb.writePos = (oldSize + cb.writePos) % newSize
+	} else {
+		// Not enough room for that, so move [readPos, oldSize) to the end instead
+		delta := newSize - oldSize
+		if err := cb.copyRange(cb.readPos, cb.readPos+delta, oldSize-cb.readPos); err != nil {
+			return fmt.Errorf("failed to relocate buffer data: %w", err)
+		}
+		cb.readPos += delta
+	}
+
+	return nil
+}
+
+// copyRange copies n bytes within the file from src to dst, where dst >= src
+func (cb *CircularBuffer) copyRange(src, dst, n int64) error {
+	// Copy from the end backwards so overlapping ranges are handled
+	chunk := make([]byte, ReadChunkSize*16)
+	for n > 0 {
+		size := int64(len(chunk))
+		if size > n {
+			size = n
+		}
+		n -= size
+		if _, err := cb.file.ReadAt(chunk[:size], src+n); err != nil {
+			return err
+		}
+		if _, err := cb.file.WriteAt(chunk[:size], dst+n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shrinkTarget returns the file size to shrink to with size bytes pending:
+// the smallest size, doubling from InitialBufferSize, that the pending data
+// fills at most a quarter of. That leaves room for new logs, and for moving
+// the pending data without overwriting it.
+func shrinkTarget(size int64) int64 {
+	target := int64(InitialBufferSize)
+	for target < 4*size {
+		target *= 2
+	}
+	return target
+}
+
+// maybeShrink shrinks the file once it has been mostly empty, that is at
+// least twice as large as shrinkTarget, for shrinkAfter. Failing to shrink is
+// only reported, since the buffer works fine without it. The caller must hold
+// the mutex.
+func (cb *CircularBuffer) maybeShrink() {
+	if cb.shrinkAfter <= 0 {
+		return
+	}
+
+	target := shrinkTarget(cb.size)
+	if target > cb.fileSize/2 {
+		cb.lowSince = time.Time{}
+		return
+	}
+	now := time.Now()
+	if cb.lowSince.IsZero() {
+		cb.lowSince = now
+	}
+	if now.Sub(cb.lowSince) < cb.shrinkAfter {
+		return
+	}
+
+	cb.lowSince = time.Time{}
+	if err := cb.shrink(target); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to shrink buffer file: %v\n", err)
+	}
+}
+
+// watchShrink checks periodically whether the file should shrink until the
+// buffer is closed, so that a buffer that drains and then goes idle shrinks
+// too
+func (cb *CircularBuffer) watchShrink() {
+	defer close(cb.shrinkDone)
+	ticker := time.NewTicker(shrinkCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cb.shrinkStop:
+			return
+		case <-ticker.C:
+		}
+		cb.mutex.Lock()
+		cb.maybeShrink()
+		cb.mutex.Unlock()
+	}
+}
+
+// shrink truncates the file to newSize, first moving the pending records to
+// where they fit. Records are copied rather than moved in place, and the file
+// is only truncated once the new cursors are on disk, so a crash at any point
+// leaves either the old or the new layout intact. The caller must hold the mutex.
+func (cb *CircularBuffer) shrink(newSize int64) error {
+	dst, ok := cb.relocation(newSize)
+	if !ok {
+		debugf("No room to move %d bytes of pending data, not shrinking buffer", cb.size)
+		return nil
+	}
+	debugf("Shrinking buffer file from %d to %d bytes", cb.fileSize, newSize)
+	oldSize := cb.fileSize
+
+	if dst != cb.readPos {
+		first := cb.size
+		if cb.readPos+cb.size > cb.fileSize {
+			first = cb.fileSize - cb.readPos
+		}
+		if err := cb.copyRange(cb.readPos, dst, first); err != nil {
+			return fmt.Errorf("failed to relocate buffer data: %w", err)
+		}
+		if err := cb.copyRange(0, dst+first, cb.size-first); err != nil {
+			return fmt.Errorf("failed to relocate buffer data: %w", err)
+		}
+		if err := syncFiles(cb.file); err != nil {
+			return err
+		}
+	}
+
+	cb.readPos = dst % newSize
+	cb.writePos = (dst + cb.size) % newSize
+	cb.fileSize = newSize
+	if err := cb.persistState(); err != nil {
+		return err
+	}
+	if err := syncFiles(cb.stateFile); err != nil {
+		return err
+	}
+	if err := cb.file.Truncate(newSize); err != nil {
+		return err
+	}
+	cb.disk.freed(oldSize - newSize)
+	return nil
+}
+
+// relocation returns where the pending data can be placed in a file of
+// newSize bytes without overlapping where it is now; the caller must hold the mutex
+func (cb *CircularBuffer) relocation(newSize int64) (int64, bool) {
+	if cb.size == 0 {
+		return 0, true
+	}
+	if cb.readPos+cb.size <= newSize {
+		return cb.readPos, true // Already in place
+	}
+	for dst := int64(0); dst+cb.size <= newSize; dst += cb.size {
+		if !cb.overlapsPending(dst, dst+cb.size) {
+			return dst, true
+		}
+	}
+	return 0, false
 }
 
-// Read reads data from the buffer
+// overlapsPending reports whether the file range [start, end) holds pending
+// data; the caller must hold the mutex
+func (cb *CircularBuffer) overlapsPending(start, end int64) bool {
+	if cb.readPos+cb.size <= cb.fileSize {
+		return start < cb.readPos+cb.size && cb.readPos < end
+	}
+	// Wrapped: [readPos, fileSize) and [0, writePos)
+	return cb.readPos < end || start < cb.writePos
+}
+
+// dropOldest discards the record at the read position; the caller must hold the mutex
+func (cb *CircularBuffer) dropOldest() error {
+	header, err := cb.readRing(cb.readPos, recordHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	// Trust a plausible length here rather than reading the whole payload;
+	// anything else is resynchronized by checksum
+	dropped := int64(0)
+	if length, _, _ := parseRecordHeader(header); length > 0 && recordSize(int(length)) <= cb.size {
+		dropped = recordSize(int(length))
+		cb.drops.add(DropReasonOverflow, 1, length)
+	} else {
+		_, skipped, recLen, err := cb.nextRecord(cb.readPos, cb.size)
+		if err != nil {
+			return err
+		}
+		dropped = skipped + recLen
+		if recLen > 0 {
+			cb.drops.add(DropReasonOverflow, 1, recLen-recordHeaderSize)
+		}
+	}
+
+	debugf("Buffer full, overwriting oldest record (%d bytes)", dropped)
+	cb.readPos = (cb.readPos + dropped) % cb.fileSize
+	cb.size -= dropped
+	cb.head += dropped
+
+	return nil
+}
+
+// Read reads and consumes whole records from the buffer, returning their
+// concatenated payloads. At least one record is returned even if it is larger
+// than maxBytes, so a record is never split.
 func (cb *CircularBuffer) Read(maxBytes int64) ([]byte, error) {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 
+	records, offset, err := cb.readRecords(-1, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := cb.commit(offset); err != nil {
+		return nil, err
+	}
+
+	return bytes.Join(records, nil), nil
+}
+
+// ReadRecords returns up to maxRecords records without consuming them. The
+// returned offset must be passed to Commit once the records have been delivered.
+func (cb *CircularBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.readRecords(maxRecords, -1)
+}
+
+// Commit consumes all records up to an offset returned by ReadRecords
+func (cb *CircularBuffer) Commit(offset int64) error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.commit(offset)
+}
+
+// readRecords reads records from the read position until maxRecords records or
+// maxBytes of payload have been collected (negative means no limit). Corrupt
+// data is skipped and included in the returned offset, while a record whose
+// encryption key isn't loaded ends the read, or fails it if it comes first.
+// The caller must hold the mutex.
+func (cb *CircularBuffer) readRecords(maxRecords int, maxBytes int64) ([][]byte, int64, error) {
 	if cb.size == 0 {
-		return nil, io.EOF
+		return nil, 0, io.EOF
 	}
 
-	// Calculate how much to read
-	toRead := cb.size
-	if toRead > maxBytes {
-		toRead = maxBytes
+	var records [][]byte
+	var skippedRecs skippedRecords
+	var payloadBytes, consumed int64
+	pos := cb.readPos
+
+	for consumed < cb.size && (maxRecords < 0 || len(records) < maxRecords) {
+		rec, skipped, recLen, err := cb.nextRecord(pos, cb.size-consumed)
+		if err != nil {
+			return nil, 0, err
+		}
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: skipped %d bytes of corrupt buffer data\n", skipped)
+		}
+
+		var payload []byte
+		var dropped string
+		if recLen > 0 {
+			payload, dropped, err = cb.codec.readable(rec)
+			if err != nil && consumed > 0 {
+				// Deliver what comes before the record first
+				break
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		// Stop before exceeding maxBytes, but always return at least one record
+		if recLen > 0 && maxBytes >= 0 && len(records) > 0 && payloadBytes+int64(len(payload)) > maxBytes {
+			break
+		}
+
+		consumed += skipped + recLen
+		pos = (pos + skipped + recLen) % cb.fileSize
+		switch {
+		case dropped != "":
+			skippedRecs = append(skippedRecs, skippedRecord{cb.head + consumed, dropped, int64(len(rec.payload))})
+		case recLen > 0:
+			records = append(records, payload)
+			payloadBytes += int64(len(payload))
+		}
 	}
 
-	data := make([]byte, toRead)
+	cb.skipped = skippedRecs
+	return records, cb.head + consumed, nil
+}
+
+// nextRecord reads the first valid record at or after the ring position pos
+// within avail bytes; see findRecord
+func (cb *CircularBuffer) nextRecord(pos, avail int64) (record, int64, int64, error) {
+	return findRecord(func(p, n int64) ([]byte, error) {
+		return cb.readRing(p%cb.fileSize, n)
+	}, pos, avail)
+}
+
+// readRing reads n bytes starting at pos, wrapping around the end of the file
+func (cb *CircularBuffer) readRing(pos, n int64) ([]byte, error) {
+	data := make([]byte, n)
 
 	// Handle reading with potential wrap-around
-	if cb.readPos+toRead <= cb.fileSize {
+	if pos+n <= cb.fileSize {
 		// Read in one chunk
-		if _, err := cb.file.ReadAt(data, cb.readPos); err != nil {
+		if _, err := cb.file.ReadAt(data, pos); err != nil {
 			return nil, err
 		}
 	} else {
 		// Read in two chunks
-		firstChunkSize := cb.fileSize - cb.readPos
-		if _, err := cb.file.ReadAt(data[:firstChunkSize], cb.readPos); err != nil {
+		firstChunkSize := cb.fileSize - pos
+		if _, err := cb.file.ReadAt(data[:firstChunkSize], pos); err != nil {
 			return nil, err
 		}
 		if _, err := cb.file.ReadAt(data[firstChunkSize:], 0); err != nil {
@@ -180,11 +873,72 @@ func (cb *CircularBuffer) Read(maxBytes int64) ([]byte, error) {
 		}
 	}
 
+	return data, nil
+}
+
+// writeRing writes data starting at pos, wrapping around the end of the file
+func (cb *CircularBuffer) writeRing(pos int64, data []byte) error {
+	dataLen := int64(len(data))
+
+	if pos+dataLen <= cb.fileSize {
+		// Simple case: write in one chunk
+		if _, err := cb.file.WriteAt(data, pos); err != nil {
+			return err
+		}
+	} else {
+		// Write in two chunks (wrap around)
+		firstChunkSize := cb.fileSize - pos
+		if _, err := cb.file.WriteAt(data[:firstChunkSize], pos); err != nil {
+			return err
+		}
+		if _, err := cb.file.WriteAt(data[firstChunkSize:], 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commit advances the read position to offset; the caller must hold the mutex
+func (cb *CircularBuffer) commit(offset int64) error {
+	// Data before the head was already consumed or overwritten
+	if offset <= cb.head {
+		return nil
+	}
+
+	n := offset - cb.head
+	if n > cb.size {
+		return fmt.Errorf("commit offset %d is beyond buffered data", offset)
+	}
+
 	// Update read position and size
-	cb.readPos = (cb.readPos + toRead) % cb.fileSize
-	cb.size -= toRead
+	cb.readPos = (cb.readPos + n) % cb.fileSize
+	cb.size -= n
+	cb.skipped = cb.skipped.commit(cb.head, offset, &cb.drops)
+	cb.head = offset
 
-	return data, nil
+	if err := cb.persistState(); err != nil {
+		return err
+	}
+	cb.syncer.wrote(0)
+	cb.maybeShrink()
+	return nil
+}
+
+// Sync flushes everything written so far to disk, whatever the sync policy
+func (cb *CircularBuffer) Sync() error {
+	cb.mutex.Lock()
+	spillErr := cb.overflow.sync()
+	cb.mutex.Unlock()
+	if err := cb.syncer.flush(); err != nil {
+		return err
+	}
+	return spillErr
+}
+
+// TakeDrops returns the records lost to overflow since the last call
+func (cb *CircularBuffer) TakeDrops() []DropReport {
+	return cb.drops.take()
 }
 
 // HasData returns true if buffer contains data
@@ -194,15 +948,21 @@ func (cb *CircularBuffer) HasData() bool {
 	return cb.size > 0
 }
 
-// GetSize returns the current size of data in the buffer
+// GetSize returns the number of bytes the pending records occupy in the
+// buffer, which is what counts towards maxSize; compressed records count
+// with their compressed size
 func (cb *CircularBuffer) GetSize() int64 {
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 	return cb.size
 }
 
-// Close closes the buffer file
+// Close flushes and closes the buffer file
 func (cb *CircularBuffer) Close() error {
+	cb.stopShrink.Do(func() { close(cb.shrinkStop) })
+	<-cb.shrinkDone
+	syncErr := cb.syncer.Close()
+
 	cb.mutex.Lock()
 	defer cb.mutex.Unlock()
 	debugf("Closing buffer file")
@@ -212,5 +972,26 @@ func (cb *CircularBuffer) Close() error {
 	} else {
 		debugf("Buffer file closed successfully")
 	}
+	if stateErr := cb.stateFile.Close(); stateErr != nil {
+		debugf("Error closing buffer state file: %v", stateErr)
+		if err == nil {
+			err = stateErr
+		}
+	}
+	if spillErr := cb.overflow.Close(); spillErr != nil {
+		debugf("Error closing spill file: %v", spillErr)
+		if err == nil {
+			err = spillErr
+		}
+	}
+	if syncErr != nil {
+		debugf("Error syncing buffer on close: %v", syncErr)
+		if err == nil {
+			err = syncErr
+		}
+	}
+	if lockErr := cb.lock.release(); lockErr != nil && err == nil {
+		err = lockErr
+	}
 	return err
 }
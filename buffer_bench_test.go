@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkBuffers lists the buffers compared by the benchmarks
+var benchmarkBuffers = []struct {
+	name string
+	open func(path string) (*CircularBuffer, error)
+}{
+	{"file", func(path string) (*CircularBuffer, error) { return NewBuffer(path, 64<<20) }},
+	{"mmap", func(path string) (*CircularBuffer, error) { return NewMmapBuffer(path, 64<<20, BufferOptions{}) }},
+}
+
+// benchmarkLine is a typical log line of about 200 bytes
+var benchmarkLine = []byte(`2024-05-01T10:00:00Z web-1 inventory-api[1234]: {"level":"info","msg":"request handled","method":"GET","path":"/api/v1/items/42","status":200,"duration_ms":12}` + "\n")
+
+func BenchmarkBufferWrite(b *testing.B) {
+	for _, bb := range benchmarkBuffers {
+		b.Run(bb.name, func(b *testing.B) {
+			if bb.name == "mmap" {
+				skipWithoutMmap(b)
+			}
+			buf, err := bb.open(filepath.Join(b.TempDir(), "buffer.log"))
+			if err != nil {
+				b.Fatalf("Failed to create buffer: %v", err)
+			}
+			defer buf.Close()
+
+			b.SetBytes(int64(len(benchmarkLine)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := buf.Write(benchmarkLine); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBufferWriteBatch(b *testing.B) {
+	const batchSize = 100
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = benchmarkLine
+	}
+
+	for _, bb := range benchmarkBuffers {
+		b.Run(bb.name, func(b *testing.B) {
+			if bb.name == "mmap" {
+				skipWithoutMmap(b)
+			}
+			buf, err := bb.open(filepath.Join(b.TempDir(), "buffer.log"))
+			if err != nil {
+				b.Fatalf("Failed to create buffer: %v", err)
+			}
+			defer buf.Close()
+
+			// Each iteration writes a line, in batches as ProcessInput does
+			b.SetBytes(int64(len(benchmarkLine)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i += batchSize {
+				if _, err := buf.WriteBatch(batch[:min(batchSize, b.N-i)]); err != nil {
+					b.Fatalf("WriteBatch failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBufferWriteReadCommit(b *testing.B) {
+	const batch = 100
+	for _, bb := range benchmarkBuffers {
+		b.Run(bb.name, func(b *testing.B) {
+			if bb.name == "mmap" {
+				skipWithoutMmap(b)
+			}
+			buf, err := bb.open(filepath.Join(b.TempDir(), "buffer.log"))
+			if err != nil {
+				b.Fatalf("Failed to create buffer: %v", err)
+			}
+			defer buf.Close()
+
+			// Each iteration writes a line, and every batch lines they are
+			// read and committed as SendLogs does
+			b.SetBytes(int64(len(benchmarkLine)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := buf.Write(benchmarkLine); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+				if i%batch == batch-1 {
+					_, offset, err := buf.ReadRecords(batch)
+					if err != nil {
+						b.Fatalf("ReadRecords failed: %v", err)
+					}
+					if err := buf.Commit(offset); err != nil {
+						b.Fatalf("Commit failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
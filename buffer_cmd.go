@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// bufferCommandUsage lists the buffer subcommands
+const bufferCommandUsage = `Usage: log_fwd buffer <command> [options] <arguments>
+
+Commands:
+  inspect    Show statistics about a buffer and dump its pending records
+  export     Write the pending records of a buffer to a portable archive
+  import     Load an exported archive into a buffer
+  ship       Send an exported archive to the log service
+
+Run "log_fwd buffer <command> -h" for the options of a command.
+`
+
+// runBufferCommand runs a "log_fwd buffer" subcommand and returns the exit code
+func runBufferCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, bufferCommandUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "inspect":
+		return runInspect(args[1:], stdout, stderr)
+	case "export":
+		return runExport(args[1:], stdout, stderr)
+	case "import":
+		return runImport(args[1:], stdout, stderr)
+	case "ship":
+		return runShip(args[1:], stdout, stderr)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, bufferCommandUsage)
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "Unknown buffer command %q\n\n%s", args[0], bufferCommandUsage)
+	return 2
+}
+
+// newCommandFlags creates the flag set of a buffer subcommand
+func newCommandFlags(name, usage string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("buffer "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "%s\nOptions:\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseCommandFlags parses the flags of a buffer subcommand, returning the
+// exit code to use if the command shouldn't run
+func parseCommandFlags(fs *flag.FlagSet, args []string, nargs int) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	if fs.NArg() != nargs {
+		fs.Usage()
+		return 2, false
+	}
+	return 0, true
+}
+
+// detectBufferType returns the type of the buffer at path: segment buffers
+// are directories, file buffers are files
+func detectBufferType(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open buffer: %w", err)
+	}
+	if info.IsDir() {
+		return BufferTypeSegment, nil
+	}
+	return BufferTypeFile, nil
+}
+
+// dictPath returns where a buffer keeps its compression dictionary
+func dictPath(path, bufferType string) string {
+	if bufferType == BufferTypeSegment {
+		return filepath.Join(path, segmentDictFile)
+	}
+	return path + ".dict"
+}
+
+// readOnlyCodec returns a codec that decodes the records of an existing
+// buffer without changing any of its files. An empty bufferType is set to the
+// detected type.
+func readOnlyCodec(path string, bufferType *string, keyFile string) (recordCodec, error) {
+	if *bufferType == "" {
+		detected, err := detectBufferType(path)
+		if err != nil {
+			return recordCodec{}, err
+		}
+		*bufferType = detected
+	}
+
+	keys, err := loadKeyRing(keyFile)
+	if err != nil {
+		return recordCodec{}, err
+	}
+	// Without compression enabled the dictionary is only loaded, never replaced
+	comp, err := newCompressor(CompressionNone, dictPath(path, *bufferType), keys, false)
+	if err != nil {
+		return recordCodec{}, err
+	}
+	return recordCodec{compressor: comp, keys: keys}, nil
+}
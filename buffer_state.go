@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// State file layout
+//
+// The cursors of a CircularBuffer are persisted in a sidecar file next to the
+// buffer file (<buffer>.state). The file holds two fixed-size slots that are
+// written alternately, so a torn write can only ever damage the slot that is
+// being replaced. Each slot is:
+//
+//	magic(4) version(4) seq(8) readPos(8) writePos(8) size(8) fileSize(8) crc32(4)
+//
+// On load the valid slot with the highest sequence number wins.
+const (
+	stateMagic    = "LFWS"
+	stateVersion  = 2 // Version 1 buffers held raw bytes rather than records
+	stateSlotSize = 64
+	stateDataSize = 52 // Bytes of a slot covered by the layout above
+)
+
+// errNoState is returned when no valid state slot could be found
+var errNoState = errors.New("no valid buffer state")
+
+// bufferState is a durable snapshot of a CircularBuffer's cursors
+type bufferState struct {
+	seq      uint64
+	readPos  int64
+	writePos int64
+	size     int64
+	fileSize int64
+}
+
+// statePath returns the path of the state file for a buffer file
+func statePath(bufferPath string) string {
+	return bufferPath + ".state"
+}
+
+// encode serializes the state into a single slot
+func (s bufferState) encode() []byte {
+	slot := make([]byte, stateSlotSize)
+	copy(slot[0:4], stateMagic)
+	binary.LittleEndian.PutUint32(slot[4:8], stateVersion)
+	binary.LittleEndian.PutUint64(slot[8:16], s.seq)
+	binary.LittleEndian.PutUint64(slot[16:24], uint64(s.readPos))
+	binary.LittleEndian.PutUint64(slot[24:32], uint64(s.writePos))
+	binary.LittleEndian.PutUint64(slot[32:40], uint64(s.size))
+	binary.LittleEndian.PutUint64(slot[40:48], uint64(s.fileSize))
+	binary.LittleEndian.PutUint32(slot[48:52], crc32.ChecksumIEEE(slot[:48]))
+	return slot
+}
+
+// decodeState parses a single slot, returning false if it is not valid
+func decodeState(slot []byte) (bufferState, bool) {
+	if len(slot) < stateDataSize || string(slot[0:4]) != stateMagic {
+		return bufferState{}, false
+	}
+	if binary.LittleEndian.Uint32(slot[4:8]) != stateVersion {
+		return bufferState{}, false
+	}
+	if crc32.ChecksumIEEE(slot[:48]) != binary.LittleEndian.Uint32(slot[48:52]) {
+		return bufferState{}, false
+	}
+	return bufferState{
+		seq:      binary.LittleEndian.Uint64(slot[8:16]),
+		readPos:  int64(binary.LittleEndian.Uint64(slot[16:24])),
+		writePos: int64(binary.LittleEndian.Uint64(slot[24:32])),
+		size:     int64(binary.LittleEndian.Uint64(slot[32:40])),
+		fileSize: int64(binary.LittleEndian.Uint64(slot[40:48])),
+	}, true
+}
+
+// readState loads the most recent valid state from a state file
+func readState(r io.ReaderAt) (bufferState, error) {
+	var best bufferState
+	found := false
+
+	for i := int64(0); i < 2; i++ {
+		slot := make([]byte, stateSlotSize)
+		n, err := r.ReadAt(slot, i*stateSlotSize)
+		if err != nil && err != io.EOF {
+			return bufferState{}, fmt.Errorf("failed to read state slot %d: %w", i, err)
+		}
+		state, ok := decodeState(slot[:n])
+		if !ok {
+			debugf("State slot %d is empty or invalid", i)
+			continue
+		}
+		if !found || state.seq > best.seq {
+			best = state
+			found = true
+		}
+	}
+
+	if !found {
+		return bufferState{}, errNoState
+	}
+	return best, nil
+}
+
+// writeState writes the state into the slot selected by its sequence number
+func writeState(f io.WriterAt, s bufferState) error {
+	offset := int64(s.seq%2) * stateSlotSize
+	if _, err := f.WriteAt(s.encode(), offset); err != nil {
+		return fmt.Errorf("failed to write buffer state: %w", err)
+	}
+	return nil
+}
+
+// validate checks that the cursors describe a consistent ring of the given size
+func (s bufferState) validate(actualFileSize int64) error {
+	if s.fileSize <= 0 {
+		return fmt.Errorf("invalid file size %d", s.fileSize)
+	}
+	if actualFileSize < s.fileSize {
+		return fmt.Errorf("buffer file is %d bytes but state expects %d", actualFileSize, s.fileSize)
+	}
+	if s.readPos < 0 || s.readPos >= s.fileSize || s.writePos < 0 || s.writePos >= s.fileSize {
+		return fmt.Errorf("cursor out of range (read %d, write %d, file %d)", s.readPos, s.writePos, s.fileSize)
+	}
+	if s.size < 0 || s.size > s.fileSize {
+		return fmt.Errorf("invalid data size %d for file size %d", s.size, s.fileSize)
+	}
+	if (s.readPos+s.size)%s.fileSize != s.writePos {
+		return fmt.Errorf("cursors disagree with data size (read %d, write %d, size %d)", s.readPos, s.writePos, s.size)
+	}
+	return nil
+}
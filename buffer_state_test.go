@@ -0,0 +1,217 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBufferStateEncodeDecode(t *testing.T) {
+	state := bufferState{seq: 7, readPos: 10, writePos: 30, size: 20, fileSize: 64}
+
+	decoded, ok := decodeState(state.encode())
+	if !ok {
+		t.Fatal("Failed to decode encoded state")
+	}
+	if decoded != state {
+		t.Errorf("Decoded state = %+v, want %+v", decoded, state)
+	}
+
+	// Flip a byte to break the checksum
+	slot := state.encode()
+	slot[20] ^= 0xff
+	if _, ok := decodeState(slot); ok {
+		t.Error("Expected corrupted slot to be rejected")
+	}
+}
+
+func TestBufferStateValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   bufferState
+		actual  int64
+		wantErr bool
+	}{
+		{"empty", bufferState{fileSize: 100}, 100, false},
+		{"wrapped", bufferState{readPos: 90, writePos: 10, size: 20, fileSize: 100}, 100, false},
+		{"full", bufferState{readPos: 40, writePos: 40, size: 100, fileSize: 100}, 100, false},
+		{"file grown", bufferState{readPos: 0, writePos: 10, size: 10, fileSize: 100}, 200, false},
+		{"file shrunk", bufferState{fileSize: 100}, 50, true},
+		{"cursor out of range", bufferState{readPos: 100, writePos: 100, fileSize: 100}, 100, true},
+		{"size mismatch", bufferState{readPos: 0, writePos: 10, size: 20, fileSize: 100}, 100, true},
+		{"zero file size", bufferState{}, 100, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.state.validate(tc.actual)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCircularBufferResumesAfterReopen(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-state-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	buf.Write([]byte("first line\n"))
+	buf.Write([]byte("second line\n"))
+	if _, err := buf.Read(int64(len("first line\n"))); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	// Simulate a crash by closing the files without any extra bookkeeping;
+	// the OS releases the lock of a crashed process
+	buf.file.Close()
+	buf.stateFile.Close()
+	buf.lock.release()
+
+	buf, err = NewBuffer(bufferPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+
+	if got := buf.GetSize(); got != recordSize(len("second line\n")) {
+		t.Errorf("GetSize() after reopen = %d, want %d", got, recordSize(len("second line\n")))
+	}
+
+	data, err := buf.Read(1024)
+	if err != nil {
+		t.Fatalf("Read after reopen failed: %v", err)
+	}
+	if string(data) != "second line\n" {
+		t.Errorf("Read after reopen = %q, want %q", data, "second line\n")
+	}
+}
+
+func TestCircularBufferTornStateSlot(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-state-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buf.Write([]byte("kept\n"))
+	buf.Write([]byte("lost\n"))
+	latest := buf.stateSeq
+	buf.Close()
+
+	// Corrupt the slot holding the latest state; the previous one must be used
+	f, err := os.OpenFile(statePath(bufferPath), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open state file: %v", err)
+	}
+	f.WriteAt([]byte("garbage"), int64(latest%2)*stateSlotSize)
+	f.Close()
+
+	buf, err = NewBuffer(bufferPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+
+	data, err := buf.Read(1024)
+	if err != nil {
+		t.Fatalf("Read after reopen failed: %v", err)
+	}
+	if string(data) != "kept\n" {
+		t.Errorf("Read after reopen = %q, want %q", data, "kept\n")
+	}
+}
+
+func TestCircularBufferInconsistentState(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-state-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buf.Write([]byte("some data\n"))
+	buf.Close()
+
+	// Shrinking the data file behind the buffer's back invalidates the state
+	if err := os.Truncate(bufferPath, 16); err != nil {
+		t.Fatalf("Failed to truncate buffer file: %v", err)
+	}
+
+	buf, err = NewBuffer(bufferPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+
+	if buf.HasData() {
+		t.Error("Buffer with inconsistent state should start empty")
+	}
+	if _, err := buf.Write([]byte("new data\n")); err != nil {
+		t.Errorf("Write after reset failed: %v", err)
+	}
+}
+
+func TestCircularBufferGrownFileRestored(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-state-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buf.Write([]byte("pending\n"))
+	buf.Close()
+
+	// Simulate a crash between growing the file and recording the new size
+	if err := os.Truncate(bufferPath, InitialBufferSize*2); err != nil {
+		t.Fatalf("Failed to grow buffer file: %v", err)
+	}
+
+	buf, err = NewBuffer(bufferPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+
+	if buf.fileSize != InitialBufferSize {
+		t.Errorf("fileSize = %d, want %d", buf.fileSize, InitialBufferSize)
+	}
+	info, err := os.Stat(bufferPath)
+	if err != nil {
+		t.Fatalf("Failed to stat buffer file: %v", err)
+	}
+	if info.Size() != InitialBufferSize {
+		t.Errorf("Buffer file size = %d, want %d", info.Size(), InitialBufferSize)
+	}
+
+	data, err := buf.Read(1024)
+	if err != nil {
+		t.Fatalf("Read after reopen failed: %v", err)
+	}
+	if string(data) != "pending\n" {
+		t.Errorf("Read after reopen = %q, want %q", data, "pending\n")
+	}
+}
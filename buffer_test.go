@@ -243,8 +243,8 @@ func TestCircularBufferMaxSizeLimit(t *testing.T) {
 		t.Error("Write should fail when data exceeds max size")
 	}
 
-	// Try writing data just at max size
-	justRightData := make([]byte, int(maxSize))
+	// Try writing the largest record that fits in max size
+	justRightData := make([]byte, int(maxSize)-recordHeaderSize)
 
 	// Write should succeed
 	_, err = buf.Write(justRightData)
@@ -681,3 +681,408 @@ func TestCircularBufferCloseOperations(t *testing.T) {
 		t.Log("Double close succeeded (this is acceptable)")
 	}
 }
+
+// TestCircularBufferReadRecordsCommit tests that read records stay buffered until committed
+func TestCircularBufferReadRecordsCommit(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, 1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buf.Close()
+
+	buf.Write([]byte("line one\n"))
+	buf.Write([]byte("line two\n"))
+	total := recordSize(len("line one\n")) + recordSize(len("line two\n"))
+
+	records, offset, err := buf.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 1 || string(records[0]) != "line one\n" {
+		t.Errorf("ReadRecords returned %q, expected [%q]", records, "line one\n")
+	}
+
+	// Reading again returns the same record
+	again, againOffset, err := buf.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("Second ReadRecords failed: %v", err)
+	}
+	if len(again) != 1 || string(again[0]) != "line one\n" || againOffset != offset {
+		t.Errorf("Second ReadRecords returned %q@%d, expected [%q]@%d", again, againOffset, "line one\n", offset)
+	}
+	if buf.GetSize() != total {
+		t.Errorf("GetSize() after ReadRecords = %d, expected %d", buf.GetSize(), total)
+	}
+
+	if err := buf.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if buf.GetSize() != recordSize(len("line two\n")) {
+		t.Errorf("GetSize() after commit = %d, expected %d", buf.GetSize(), recordSize(len("line two\n")))
+	}
+
+	// Committing an old offset again is a no-op
+	if err := buf.Commit(offset); err != nil {
+		t.Errorf("Repeated commit failed: %v", err)
+	}
+	if buf.GetSize() != recordSize(len("line two\n")) {
+		t.Errorf("GetSize() after repeated commit = %d, expected %d", buf.GetSize(), recordSize(len("line two\n")))
+	}
+
+	// Committing past the end is an error
+	if err := buf.Commit(offset + 100); err == nil {
+		t.Error("Expected error committing beyond buffered data")
+	}
+
+	data, err := buf.Read(1024)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data) != "line two\n" {
+		t.Errorf("Read returned %q, expected %q", data, "line two\n")
+	}
+}
+
+// TestCircularBufferCommitAfterOverwrite tests committing records that were overwritten meanwhile
+func TestCircularBufferCommitAfterOverwrite(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, InitialBufferSize)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buf.Close()
+
+	chunk := make([]byte, InitialBufferSize/4-recordHeaderSize)
+	for i := 0; i < 4; i++ {
+		chunk[0] = byte(i)
+		buf.Write(chunk)
+	}
+
+	_, offset, err := buf.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+
+	// Overwrite the record that was read and the one after it
+	buf.Write(make([]byte, len(chunk)+len(chunk)/2))
+
+	// The commit refers to a record that is already gone, so nothing more is consumed
+	if err := buf.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	records, _, err := buf.ReadRecords(10)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 3 || records[0][0] != 2 || records[1][0] != 3 {
+		t.Errorf("Expected the two newest chunks and the new record to remain, got %d records", len(records))
+	}
+}
+
+// TestCircularBufferWholeRecords tests that records are never split when reading or overwriting
+func TestCircularBufferWholeRecords(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, InitialBufferSize)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buf.Close()
+
+	// Write far more than fits so the buffer wraps several times
+	for i := 0; i < 5000; i++ {
+		if _, err := buf.Write([]byte(fmt.Sprintf("log line number %d\n", i))); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+
+	records, _, err := buf.ReadRecords(100000)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) == 0 {
+		t.Fatal("Expected records after wrapping")
+	}
+
+	// The surviving records must be the newest ones, complete and in order
+	first := 5000 - len(records)
+	for i, record := range records {
+		expected := fmt.Sprintf("log line number %d\n", first+i)
+		if string(record) != expected {
+			t.Fatalf("Record %d = %q, expected %q", i, record, expected)
+		}
+	}
+
+	// A small Read returns a whole record rather than part of one
+	data, err := buf.Read(3)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data) != fmt.Sprintf("log line number %d\n", first) {
+		t.Errorf("Read returned %q, expected a whole record", data)
+	}
+}
+
+// TestCircularBufferGrowWrapped tests that growing a wrapped buffer keeps records in order
+func TestCircularBufferGrowWrapped(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, maxSize := range []int64{InitialBufferSize * 4, InitialBufferSize + InitialBufferSize/8} {
+		bufferPath := filepath.Join(tmpdir, fmt.Sprintf("test-buffer-%d.log", maxSize))
+		buf, err := NewBuffer(bufferPath, maxSize)
+		if err != nil {
+			t.Fatalf("Failed to create buffer: %v", err)
+		}
+
+		// Fill most of the file, consume the start, then wrap around
+		record := make([]byte, 1000)
+		next, expected := 0, 0
+		write := func() {
+			copy(record, fmt.Sprintf("%08d", next))
+			if _, err := buf.Write(record); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			next++
+		}
+		for buf.size+recordSize(len(record)) <= InitialBufferSize {
+			write()
+		}
+		for i := 0; i < 20; i++ {
+			buf.Read(1)
+			expected++
+		}
+		for buf.writePos >= buf.readPos || buf.writePos < InitialBufferSize/8 {
+			write()
+		}
+
+		// This write needs more space and has to grow the wrapped file
+		for buf.fileSize == InitialBufferSize {
+			write()
+		}
+
+		// Reading back must yield an unbroken sequence
+		for buf.HasData() {
+			data, err := buf.Read(1)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if got := string(data[:8]); got != fmt.Sprintf("%08d", expected) {
+				t.Fatalf("maxSize %d: read record %s, expected %08d", maxSize, got, expected)
+			}
+			expected++
+		}
+		if expected != next {
+			t.Errorf("maxSize %d: read %d records, expected %d", maxSize, expected, next)
+		}
+		buf.Close()
+	}
+}
+
+// TestCircularBufferSkipsCorruptRecords tests that corrupt records are skipped after reopening
+func TestCircularBufferSkipsCorruptRecords(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "buffer-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	bufferPath := filepath.Join(tmpdir, "test-buffer.log")
+	buf, err := NewBuffer(bufferPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buf.Write([]byte("first\n"))
+	buf.Write([]byte("second\n"))
+	buf.Write([]byte("third\n"))
+	buf.Close()
+
+	// Damage the payload of the second record
+	f, err := os.OpenFile(bufferPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open buffer file: %v", err)
+	}
+	f.WriteAt([]byte("X"), recordSize(len("first\n"))+recordHeaderSize)
+	f.Close()
+
+	buf, err = NewBuffer(bufferPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer buf.Close()
+
+	records, offset, err := buf.ReadRecords(10)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 2 || string(records[0]) != "first\n" || string(records[1]) != "third\n" {
+		t.Errorf("ReadRecords returned %q, expected first and third", records)
+	}
+
+	// Committing consumes the corrupt bytes as well
+	buf.Commit(offset)
+	if buf.HasData() {
+		t.Error("Buffer should be empty after committing all records")
+	}
+}
+
+func TestCircularBufferShrinks(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	for _, wrap := range []bool{false, true} {
+		bufferPath := filepath.Join(tmpdir, fmt.Sprintf("test-buffer-%v.log", wrap))
+		opts := BufferOptions{ShrinkAfter: time.Nanosecond}
+		buf, err := NewBufferWithOptions(bufferPath, InitialBufferSize*16, opts)
+		if err != nil {
+			t.Fatalf("Failed to create buffer: %v", err)
+		}
+
+		record := make([]byte, 1000)
+		next, expected := 0, 0
+		write := func() {
+			copy(record, fmt.Sprintf("%08d", next))
+			if _, err := buf.Write(record); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			next++
+		}
+
+		// A backlog grows the file to its maximum, then drains
+		for buf.fileSize < buf.maxSize {
+			write()
+		}
+		if wrap {
+			// Leave a few records straddling the end of the file
+			for buf.size+recordSize(len(record)) <= buf.fileSize {
+				write()
+			}
+			for buf.size > 5*recordSize(len(record)) {
+				buf.Read(1)
+				expected++
+			}
+			for buf.writePos > buf.readPos {
+				write()
+			}
+		} else {
+			for buf.size > 5*recordSize(len(record)) {
+				buf.Read(1)
+				expected++
+			}
+		}
+		if wrapped := buf.readPos+buf.size > buf.fileSize; wrapped != wrap {
+			t.Fatalf("Pending data wrapped = %v, want %v", wrapped, wrap)
+		}
+
+		// The first write notices the file is mostly empty, the next one shrinks it
+		write()
+		write()
+		if buf.fileSize != InitialBufferSize {
+			t.Errorf("wrap %v: file size after draining = %d, want %d", wrap, buf.fileSize, InitialBufferSize)
+		}
+		if info, err := os.Stat(bufferPath); err != nil || info.Size() != InitialBufferSize {
+			t.Errorf("wrap %v: buffer file size = %v, %v", wrap, info.Size(), err)
+		}
+
+		// The pending records survive the move and a restart
+		buf.Close()
+		buf, err = NewBufferWithOptions(bufferPath, InitialBufferSize*16, opts)
+		if err != nil {
+			t.Fatalf("Failed to reopen buffer: %v", err)
+		}
+		for buf.HasData() {
+			data, err := buf.Read(1)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if got := string(data[:8]); got != fmt.Sprintf("%08d", expected) {
+				t.Fatalf("wrap %v: read record %s, expected %08d", wrap, got, expected)
+			}
+			expected++
+		}
+		if expected != next {
+			t.Errorf("wrap %v: read %d records, expected %d", wrap, expected, next)
+		}
+		buf.Close()
+	}
+}
+
+func TestCircularBufferShrinkDelay(t *testing.T) {
+	bufferPath := filepath.Join(t.TempDir(), "test-buffer.log")
+	buf, err := NewBufferWithOptions(bufferPath, InitialBufferSize*4, BufferOptions{ShrinkAfter: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buf.Close()
+
+	record := make([]byte, 1000)
+	for buf.fileSize < buf.maxSize {
+		buf.Write(record)
+	}
+	for buf.HasData() {
+		buf.Read(1 << 20)
+	}
+	buf.Write(record)
+	buf.Write(record)
+
+	// The file is only shrunk once it has stayed mostly empty for a while
+	if buf.fileSize != buf.maxSize {
+		t.Errorf("File size = %d, want %d until the shrink delay has passed", buf.fileSize, buf.maxSize)
+	}
+}
+
+func TestCircularBufferShrinkWhenIdle(t *testing.T) {
+	defer func(interval time.Duration) { shrinkCheckInterval = interval }(shrinkCheckInterval)
+	shrinkCheckInterval = 10 * time.Millisecond
+
+	bufferPath := filepath.Join(t.TempDir(), "test-buffer.log")
+	buf, err := NewBufferWithOptions(bufferPath, InitialBufferSize*4, BufferOptions{ShrinkAfter: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buf.Close()
+
+	record := make([]byte, 1000)
+	for buf.GetSize() < InitialBufferSize*3 {
+		buf.Write(record)
+	}
+	for buf.HasData() {
+		buf.Read(1 << 20)
+	}
+
+	// The drained buffer shrinks without any further writes or commits
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf.mutex.Lock()
+		fileSize := buf.fileSize
+		buf.mutex.Unlock()
+		if fileSize == InitialBufferSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("File size = %d, want %d once the buffer has been idle", fileSize, InitialBufferSize)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
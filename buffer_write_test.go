@@ -80,28 +80,32 @@ func TestCircularBufferComplexWrite(t *testing.T) {
 		t.Errorf("writePos didn't wrap: %d", buf.writePos)
 	}
 	
-	// Test case 4: Writing to a nearly full buffer
-	buf, err = NewBuffer(bufferPath+".2", 200)
+	// Test case 4: Writing to a full buffer overwrites whole records
+	buf, err = NewBuffer(bufferPath+".2", InitialBufferSize)
 	if err != nil {
 		t.Fatalf("Failed to create second buffer: %v", err)
 	}
 	defer buf.Close()
-	
-	// Make buffer almost full
-	buf.size = buf.fileSize - 1
-	buf.writePos = 0
-	buf.readPos = 1
-	
-	// Write a small amount that should still fit
-	_, err = buf.Write([]byte("x"))
-	if err != nil {
-		t.Fatalf("Small write to nearly full buffer failed: %v", err)
+
+	// Fill the buffer exactly
+	record := make([]byte, InitialBufferSize/4-recordHeaderSize)
+	for i := 0; i < 4; i++ {
+		if _, err := buf.Write(record); err != nil {
+			t.Fatalf("Fill write %d failed: %v", i, err)
+		}
 	}
-	
-	// Now buffer should be completely full
 	if buf.size != buf.fileSize {
 		t.Errorf("Buffer should be full: size=%d, fileSize=%d", buf.size, buf.fileSize)
 	}
+
+	// A small write drops the whole oldest record, not just enough bytes for it
+	_, err = buf.Write([]byte("x"))
+	if err != nil {
+		t.Fatalf("Small write to full buffer failed: %v", err)
+	}
+	if expected := 3*recordSize(len(record)) + recordSize(1); buf.size != expected {
+		t.Errorf("Buffer size after overwrite = %d, expected %d", buf.size, expected)
+	}
 }
 
 // TestCircularBufferWriteEdgeCases tests additional edge cases for Write
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// checkpointSaveInterval is how often the checkpoint file is saved while
+// offsets change
+const checkpointSaveInterval = 1 * time.Second
+
+// fileID identifies a file across renames and restarts
+type fileID struct {
+	Device uint64
+	Inode  uint64
+}
+
+// checkpointEntry is the saved read offset of one followed file
+type checkpointEntry struct {
+	Path   string `json:"path"` // Path the file was followed at
+	Device uint64 `json:"device,omitempty"`
+	Inode  uint64 `json:"inode,omitempty"`
+	Offset int64  `json:"offset"` // End of the last line written to the buffer
+}
+
+// id returns the identity of the entry's file, if it was known
+func (e checkpointEntry) id() (fileID, bool) {
+	return fileID{Device: e.Device, Inode: e.Inode}, e.Inode != 0
+}
+
+// checkpointKey returns the key of a file in the checkpoint: its identity, or
+// where there is none, its path
+func checkpointKey(path string, id fileID, ok bool) string {
+	if ok {
+		return fmt.Sprintf("%d:%d", id.Device, id.Inode)
+	}
+	return "path:" + path
+}
+
+// fileKey returns the checkpoint key of a file followed at path
+func fileKey(path string, info os.FileInfo) string {
+	id, ok := fileIDOf(info)
+	return checkpointKey(path, id, ok)
+}
+
+// checkpointState is the content of a checkpoint file
+type checkpointState struct {
+	Files []checkpointEntry `json:"files"`
+}
+
+// checkpoint persists the read offset of every followed file, so that after
+// a restart they are read from where they were left off. Files are matched by
+// device and inode, so a file that was renamed by rotation still resumes at
+// its offset. The file is replaced atomically at most every
+// checkpointSaveInterval, and only once the buffer has synced the lines
+// before the offsets, so a crash never skips lines but may read those of the
+// last interval again. Without a path, offsets are only kept while log_fwd runs.
+type checkpoint struct {
+	path    string
+	sync    bool            // Whether to sync the file before replacing it
+	buffer  BufferInterface // Holds the lines before the offsets, synced before saving if Syncable
+	mutex   sync.Mutex
+	entries map[string]checkpointEntry // By checkpoint key
+	dirty   bool                       // Whether the entries changed since the last save
+	saved   time.Time                  // When the file was last saved
+}
+
+// loadCheckpoint opens the checkpoint file at path, which doesn't need to
+// exist yet, for the offsets of lines written to buffer. A checkpoint that
+// can't be read is reported and started afresh.
+func loadCheckpoint(path string, buffer BufferInterface, sync bool) *checkpoint {
+	c := &checkpoint{path: path, sync: sync, buffer: buffer, entries: make(map[string]checkpointEntry)}
+	if path == "" {
+		return c
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c
+	}
+	var state checkpointState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring checkpoint %s: %v\n", path, err)
+		return c
+	}
+
+	for _, entry := range state.Files {
+		id, ok := entry.id()
+		c.entries[checkpointKey(entry.Path, id, ok)] = entry
+	}
+	debugf("Loaded %d file offsets from %s", len(c.entries), path)
+	return c
+}
+
+// lookup returns the saved offset of a file followed at path
+func (c *checkpoint) lookup(path string, info os.FileInfo) (int64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[fileKey(path, info)]
+	if !ok {
+		return 0, false
+	}
+	if info.Size() < entry.Offset {
+		fmt.Fprintf(os.Stderr, "%s was truncated, reading it from the beginning\n", path)
+		return 0, true
+	}
+	return entry.Offset, true
+}
+
+// followed reports whether a file was followed at path before, which means
+// the file there now replaced it
+func (c *checkpoint) followed(path string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, entry := range c.entries {
+		if entry.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the saved entries
+func (c *checkpoint) list() []checkpointEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Collect(maps.Values(c.entries))
+}
+
+// update records the offset of a file followed at path, saving it if the
+// last save was long enough ago
+func (c *checkpoint) update(path string, info os.FileInfo, offset int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := checkpointEntry{Path: path, Offset: offset}
+	if id, ok := fileIDOf(info); ok {
+		entry.Device, entry.Inode = id.Device, id.Inode
+	}
+	c.entries[fileKey(path, info)] = entry
+	c.dirty = true
+	return c.saveDue()
+}
+
+// retain forgets the files whose keys aren't in keep, and saves the changes
+// that are due
+func (c *checkpoint) retain(keep map[string]bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.entries {
+		if !keep[key] {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+	return c.saveDue()
+}
+
+// flush saves the changes that weren't saved yet, such as on exit
+func (c *checkpoint) flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	return c.save()
+}
+
+// saveDue saves the changes if checkpointSaveInterval has passed since the
+// last save; the caller must hold the mutex
+func (c *checkpoint) saveDue() error {
+	if !c.dirty || time.Since(c.saved) < checkpointSaveInterval {
+		return nil
+	}
+	return c.save()
+}
+
+// save replaces the checkpoint file with the current entries, once the lines
+// before their offsets are on disk; the caller must hold the mutex
+func (c *checkpoint) save() error {
+	if c.path == "" {
+		return nil
+	}
+	if syncable, ok := c.buffer.(Syncable); ok {
+		if err := syncable.Sync(); err != nil {
+			return fmt.Errorf("failed to sync buffer before saving checkpoint: %w", err)
+		}
+	}
+	c.saved = time.Now()
+	state := checkpointState{Files: slices.Collect(maps.Values(c.entries))}
+	slices.SortFunc(state.Files, func(a, b checkpointEntry) int {
+		return cmp.Or(cmp.Compare(a.Path, b.Path), cmp.Compare(a.Inode, b.Inode))
+	})
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if c.sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to sync checkpoint: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// findFile looks for the file with the given identity in dir, where a file
+// rotated while log_fwd was stopped is usually renamed to
+func findFile(dir string, id fileID) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if found, ok := fileIDOf(info); ok && found == id {
+			return path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint")
+	logPath := filepath.Join(dir, "app.log")
+	appendFile(t, logPath, "some lines\n")
+	info := statFile(t, logPath)
+
+	c := loadCheckpoint(path, nil, true)
+	if err := c.update(logPath, info, 5); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	c = loadCheckpoint(path, nil, true)
+	if offset, ok := c.lookup(logPath, info); !ok || offset != 5 {
+		t.Errorf("lookup = %d, %v, want 5", offset, ok)
+	}
+	if !c.followed(logPath) || c.followed(filepath.Join(dir, "other.log")) {
+		t.Error("followed reported the wrong paths")
+	}
+
+	// Files that are no longer kept are forgotten
+	if err := c.retain(nil); err != nil {
+		t.Fatalf("retain failed: %v", err)
+	}
+	if _, ok := loadCheckpoint(path, nil, true).lookup(logPath, info); ok {
+		t.Error("Forgotten file still has an offset")
+	}
+}
+
+func TestCheckpointSyncsBufferFirst(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint")
+	logPath := filepath.Join(dir, "app.log")
+	appendFile(t, logPath, "some lines\n")
+	info := statFile(t, logPath)
+
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+	syncs := 0
+	c := loadCheckpoint(path, syncRecorder{MemoryBuffer: buffer, onSync: func() {
+		syncs++
+		if _, ok := loadCheckpoint(path, nil, false).lookup(logPath, info); ok && syncs == 1 {
+			t.Error("Checkpoint saved before the buffer was synced")
+		}
+	}}, false)
+
+	if err := c.update(logPath, info, 5); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if syncs != 1 {
+		t.Errorf("Buffer synced %d times for the first save, want 1", syncs)
+	}
+
+	// Updates right after a save are only saved later, or on exit
+	if err := c.update(logPath, info, 8); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if offset, _ := loadCheckpoint(path, nil, false).lookup(logPath, info); offset != 5 || syncs != 1 {
+		t.Errorf("Saved offset %d after %d syncs, want 5 until the next save", offset, syncs)
+	}
+	if err := c.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if offset, _ := loadCheckpoint(path, nil, false).lookup(logPath, info); offset != 8 || syncs != 2 {
+		t.Errorf("Saved offset %d after %d syncs, want 8 after 2", offset, syncs)
+	}
+}
+
+func TestCheckpointTruncatedFile(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	appendFile(t, logPath, "short\n")
+
+	c := loadCheckpoint(filepath.Join(dir, "checkpoint"), nil, false)
+	if err := c.update(logPath, statFile(t, logPath), 1000); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if offset, ok := c.lookup(logPath, statFile(t, logPath)); !ok || offset != 0 {
+		t.Errorf("lookup = %d, %v, want the beginning of the truncated file", offset, ok)
+	}
+}
+
+func TestCheckpointUnreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(path, []byte("{not json"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// An unreadable checkpoint is started afresh
+	c := loadCheckpoint(path, nil, false)
+	if len(c.list()) != 0 {
+		t.Errorf("Loaded entries %v from an unreadable checkpoint", c.list())
+	}
+}
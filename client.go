@@ -19,6 +19,10 @@ type HTTPClient struct {
 	url         string
 	authToken   string
 	insecureSSL bool
+
+	drops        dropCounter // Logs given up on, reported as gap markers
+	droppedLines int64       // Lines dropped since startup, for stats
+	droppedBytes int64
 }
 
 // Constants
@@ -57,23 +61,59 @@ func NewClient(cfg *Config) (*HTTPClient, error) {
 
 // Buffer defines the interface for buffer types used with SendLogs
 type Buffer interface {
-	Read(maxBytes int64) ([]byte, error)
+	ReadRecords(maxRecords int) ([][]byte, int64, error)
+	Commit(offset int64) error
 	HasData() bool
 	GetSize() int64
 }
 
+// pendingBatch is a group of log lines peeked from the buffer. The lines stay
+// in the buffer until the destination accepts them and the offset is committed.
+type pendingBatch struct {
+	lines       []string
+	offset      int64 // Buffer offset to commit once the lines are delivered
+	retries     int
+	lastAttempt time.Time
+	gap         bool // A gap marker, which is not backed by buffered data
+}
+
+// next returns the lines to send in the next request: all of them, or only
+// the first one when every line is sent on its own
+func (b *pendingBatch) next(batching bool) []string {
+	if batching {
+		return b.lines
+	}
+	return b.lines[:1]
+}
+
+// advance removes n lines that are done with from the batch, reporting
+// whether the batch is complete
+func (b *pendingBatch) advance(n int) bool {
+	b.lines = b.lines[n:]
+	b.retries, b.lastAttempt = 0, time.Time{}
+	return len(b.lines) == 0
+}
+
+// linesSize returns the total size of lines
+func linesSize(lines []string) int64 {
+	var n int64
+	for _, line := range lines {
+		n += int64(len(line))
+	}
+	return n
+}
+
 // calculateBackoff calculates retry backoff with jitter
 func calculateBackoff(retryCount int) time.Duration {
 	if retryCount <= 0 {
 		return 100 * time.Millisecond
 	}
 
-	// Exponential backoff with jitter
-	backoff := time.Duration(1<<uint(retryCount-1)) * time.Second
-
-	// Maximum backoff of 30 seconds
-	if backoff > 30*time.Second {
-		backoff = 30 * time.Second
+	// Exponential backoff with jitter, with a maximum of 30 seconds.
+	// Cap the exponent too so that long outages can't overflow the shift.
+	backoff := 30 * time.Second
+	if retryCount <= 5 {
+		backoff = time.Duration(1<<uint(retryCount-1)) * time.Second
 	}
 
 	// Add jitter (±20%)
@@ -83,7 +123,99 @@ func calculateBackoff(retryCount int) time.Duration {
 	return backoff
 }
 
-// SendLogs reads from buffer and sends to the HTTP API
+// isPermanentFailure reports whether a status code means the destination
+// rejected the logs themselves, so retrying the same request cannot succeed
+func isPermanentFailure(statusCode int) bool {
+	if statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return statusCode >= 400 && statusCode < 500
+}
+
+// readPendingBatch reads up to maxLines records from the buffer without consuming them
+func readPendingBatch(buffer Buffer, maxLines int) (*pendingBatch, error) {
+	records, offset, err := buffer.ReadRecords(maxLines)
+	if err != nil {
+		return nil, err
+	}
+
+	// A record normally holds one newline-terminated line; split any embedded
+	// newlines so that every line is sent as its own log entry. A tagged line
+	// is kept whole, since its fields belong to all of it.
+	batch := &pendingBatch{offset: offset}
+	for _, record := range records {
+		if isTagged(record) {
+			batch.lines = append(batch.lines, string(record))
+			continue
+		}
+		for _, line := range strings.Split(string(record), "\n") {
+			if line != "" {
+				batch.lines = append(batch.lines, line)
+			}
+		}
+	}
+
+	debugf("Read %d records (%d lines) from buffer", len(records), len(batch.lines))
+	return batch, nil
+}
+
+// collectDrops gathers the drops reported by the buffer and the client itself
+func (c *HTTPClient) collectDrops(buffer Buffer) []DropReport {
+	var reports []DropReport
+	if reporter, ok := buffer.(DropReporter); ok {
+		reports = append(reports, reporter.TakeDrops()...)
+	}
+	reports = append(reports, c.drops.take()...)
+
+	for _, report := range reports {
+		c.droppedLines += report.Lines
+		c.droppedBytes += report.Bytes
+		fmt.Fprintf(os.Stderr, "Warning: %s (%d lines, %d bytes dropped since startup)\n",
+			report.Message(), c.droppedLines, c.droppedBytes)
+	}
+	return reports
+}
+
+// deliver sends a batch of lines to the HTTP API and returns the status code
+func (c *HTTPClient) deliver(ctx context.Context, lines []string) (int, error) {
+	if c.config.EnableBatching {
+		// Create a batch of log entries
+		batch := make(LogBatch, 0, len(lines))
+		for _, line := range lines {
+			batch = append(batch, newLogEntry(line))
+		}
+		return sendBatchedLogs(c.client, ctx, c.url, c.authToken, batch, c.config)
+	}
+
+	// Single message processing
+	line := lines[0]
+
+	// Log the actual content being sent
+	logData([]byte(line))
+
+	// Create JSON payload
+	logEntry := newLogEntry(line)
+
+	jsonData, err := json.Marshal(logEntry)
+	if err != nil {
+		return 0, fmt.Errorf("error creating JSON payload: %w", err)
+	}
+
+	return sendHTTPRequest(c.client, ctx, c.url, c.authToken, jsonData, c.config)
+}
+
+// commit removes a delivered batch from the buffer
+func (c *HTTPClient) commit(buffer Buffer, batch *pendingBatch) {
+	if batch.gap {
+		return
+	}
+	if err := buffer.Commit(batch.offset); err != nil {
+		fmt.Fprintf(os.Stderr, "Error committing buffer offset: %v\n", err)
+	}
+}
+
+// SendLogs reads from buffer and sends to the HTTP API. Lines are only
+// committed (removed from the buffer) once the destination has accepted them.
 func (c *HTTPClient) SendLogs(ctx context.Context, buffer Buffer, signal chan struct{}) {
 	debugf("SendLogs started for HTTP API endpoint %s", c.url)
 
@@ -96,9 +228,15 @@ func (c *HTTPClient) SendLogs(ctx context.Context, buffer Buffer, signal chan st
 		fmt.Fprintf(os.Stderr, "Warning: TLS certificate verification is disabled\n")
 	}
 
-	// Log batching status
+	// Log batching status and pick how many lines go into one request
+	maxLines := 1
 	if c.config.EnableBatching {
 		fmt.Fprintf(os.Stderr, "Log batching enabled (batch size: %d)\n", c.config.BatchSize)
+		// Use either MaxBatchLines or the configured batch size, whichever is larger
+		maxLines = MaxBatchLines
+		if c.config.BatchSize > MaxBatchLines {
+			maxLines = c.config.BatchSize
+		}
 	} else {
 		fmt.Fprintf(os.Stderr, "Log batching disabled (sending one log at a time)\n")
 	}
@@ -108,15 +246,11 @@ func (c *HTTPClient) SendLogs(ctx context.Context, buffer Buffer, signal chan st
 	lastStatusReport := time.Now()
 	reportInterval := 1 * time.Minute
 
-	// Create a request queue so we can process messages
-	// and only mark them as processed after success
-	type queuedMessage struct {
-		message     string
-		retries     int
-		lastAttempt time.Time
-	}
+	// The batch currently being delivered, if any
+	var pending *pendingBatch
 
-	requestQueue := make([]queuedMessage, 0, 1000)
+	// Drops waiting to be sent as gap markers
+	var gaps []DropReport
 
 	for {
 		// Check if we should exit
@@ -139,22 +273,19 @@ func (c *HTTPClient) SendLogs(ctx context.Context, buffer Buffer, signal chan st
 			lastStatusReport = time.Now()
 		}
 
-		// If the queue is empty, check for more data in the buffer
-		if len(requestQueue) == 0 && buffer.HasData() {
-			// Calculate how much to read based on the buffer size
-			// Try to read enough to get MaxBatchLines lines in one go
-			// Estimate 100 bytes per line on average as a heuristic
-			bufferSize := buffer.GetSize()
-			readSize := int64(MaxBatchLines * 100) // Estimate to read enough for MaxBatchLines
-			if readSize > bufferSize {
-				readSize = bufferSize // Don't try to read more than what's available
-			}
-			if readSize < ReadChunkSize {
-				readSize = ReadChunkSize // Read at least ReadChunkSize
+		// Report dropped logs before any newer ones, so the gap shows up in place
+		gaps = append(gaps, c.collectDrops(buffer)...)
+		if pending == nil && len(gaps) > 0 {
+			pending = &pendingBatch{gap: true}
+			for len(gaps) > 0 && len(pending.lines) < maxLines {
+				pending.lines = append(pending.lines, gaps[0].Message())
+				gaps = gaps[1:]
 			}
+		}
 
-			debugf("Reading more logs from buffer (size: %d bytes, reading up to %d bytes)", bufferSize, readSize)
-			data, err := buffer.Read(readSize)
+		// If nothing is in flight, check for more data in the buffer
+		if pending == nil && buffer.HasData() {
+			batch, err := readPendingBatch(buffer, maxLines)
 			if err != nil && err != io.EOF {
 				fmt.Fprintf(os.Stderr, "Error reading from buffer: %v\n", err)
 				debugf("Error reading from buffer: %v", err)
@@ -171,37 +302,19 @@ func (c *HTTPClient) SendLogs(ctx context.Context, buffer Buffer, signal chan st
 				continue
 			}
 
-			if len(data) > 0 {
-				debugf("Processing %d bytes of log data", len(data))
-
-				// Split data into lines and queue them for processing (up to MaxBatchLines)
-				lines := strings.Split(string(data), "\n")
-				linesAdded := 0
-
-				for _, line := range lines {
-					if line != "" {
-						requestQueue = append(requestQueue, queuedMessage{
-							message:     line,
-							retries:     0,
-							lastAttempt: time.Time{}, // Zero time (never attempted)
-						})
-						linesAdded++
-
-						// Cap the number of lines we add in one go
-						if linesAdded >= MaxBatchLines {
-							debugf("Reached max lines limit (%d), will process remaining lines in next batch", MaxBatchLines)
-							break
-						}
-					}
+			if batch != nil && len(batch.lines) == 0 {
+				// Only blank lines were read, there is nothing to deliver
+				if err := buffer.Commit(batch.offset); err != nil {
+					fmt.Fprintf(os.Stderr, "Error committing buffer offset: %v\n", err)
 				}
-
-				debugf("Queued %d messages for processing", linesAdded)
+				continue
 			}
+			pending = batch
 		}
 
 		// If there's nothing to do, wait for signal or timeout
-		if len(requestQueue) == 0 && !buffer.HasData() {
-			debugf("No data in buffer or request queue, waiting for new logs")
+		if pending == nil {
+			debugf("No data in buffer, waiting for new logs")
 			select {
 			case <-signal:
 				debugf("Received signal that new logs are available")
@@ -216,197 +329,69 @@ func (c *HTTPClient) SendLogs(ctx context.Context, buffer Buffer, signal chan st
 			continue
 		}
 
-		// Process messages from the queue (as a batch if enabled)
-		if len(requestQueue) > 0 {
-			// Determine if we should process in batch or single mode
-			if c.config.EnableBatching && len(requestQueue) >= 1 {
-				// Batch processing - use greedier approach with larger batches
-				processBatch := true
-				// Use either MaxBatchLines or the configured batch size, whichever is larger
-				batchSize := MaxBatchLines
-				if c.config.BatchSize > MaxBatchLines {
-					batchSize = c.config.BatchSize
-				}
-				if batchSize > len(requestQueue) {
-					batchSize = len(requestQueue)
-				}
-
-				// Check if all messages in batch are ready for processing
-				for i := 0; i < batchSize; i++ {
-					// If any message is on backoff, skip processing this batch
-					if !requestQueue[i].lastAttempt.IsZero() &&
-						time.Since(requestQueue[i].lastAttempt) < calculateBackoff(requestQueue[i].retries) {
-						processBatch = false
-						break
-					}
-				}
-
-				if processBatch {
-					// Create a batch of log entries
-					batch := make(LogBatch, 0, batchSize)
-
-					// Process each message in the batch
-					for i := 0; i < batchSize; i++ {
-						// Extract message and create log entry
-						message := extractMessage(requestQueue[i].message)
-						logEntry := LogEntry{
-							Timestamp: time.Now().UTC().Format(TimestampFormat),
-							Message:   message,
-						}
-						batch = append(batch, logEntry)
-					}
-
-					// Send the batch
-					statusCode, err := sendBatchedLogs(c.client, ctx, c.url, c.authToken, batch, c.config)
-
-					if err != nil {
-						// If we get an error, increment retry count for all messages in batch
-						fmt.Fprintf(os.Stderr, "Failed to send batch of %d logs: %v\n", batchSize, err)
-						debugf("Failed to send batch: %v", err)
-
-						// Update retry count and last attempt time for each message
-						now := time.Now()
-						for i := 0; i < batchSize; i++ {
-							msg := requestQueue[i]
-							msg.retries++
-							msg.lastAttempt = now
-
-							// If max retries reached, mark as failed
-							if msg.retries > c.config.MaxRetries {
-								failCount++
-								// Mark for removal by setting retry count beyond max
-								msg.retries = c.config.MaxRetries + 1
-							}
-
-							requestQueue[i] = msg
-						}
-
-						// Remove any messages that have exceeded max retries
-						newQueue := make([]queuedMessage, 0, len(requestQueue))
-						for _, msg := range requestQueue {
-							if msg.retries <= c.config.MaxRetries {
-								newQueue = append(newQueue, msg)
-							} else {
-								fmt.Fprintf(os.Stderr, "Giving up on message after %d attempts\n", c.config.MaxRetries)
-							}
-						}
-						requestQueue = newQueue
-
-						// Sleep for a bit before continuing
-						time.Sleep(100 * time.Millisecond)
-						continue
-					}
-
-					// Record success
-					successCount += int64(batchSize)
-					batchCount++
-
-					// Log success with detailed information (only in verbose mode)
-					debugf("------------------------------------------------------")
-					debugf("Successfully sent batch of %d log entries (HTTP %d)",
-						batchSize, statusCode)
-					debugf("All messages delivered successfully to %s", c.url)
-					debugf("------------------------------------------------------")
-					debugf("Successfully sent batch with status code: %d", statusCode)
-
-					// Remove the processed messages from the queue
-					if batchSize == len(requestQueue) {
-						requestQueue = requestQueue[:0] // Clear the queue
-					} else {
-						requestQueue = requestQueue[batchSize:]
-					}
-
-					// Short pause between requests to avoid flooding
-					time.Sleep(50 * time.Millisecond)
-				} else {
-					// Some messages are on backoff, wait a bit and try again
-					time.Sleep(50 * time.Millisecond)
-				}
-			} else {
-				// Single message processing
-				msg := requestQueue[0]
-
-				// Check if this message is on backoff
-				if !msg.lastAttempt.IsZero() {
-					backoff := calculateBackoff(msg.retries)
-					elapsed := time.Since(msg.lastAttempt)
-
-					if elapsed < backoff {
-						// Not ready to retry yet
-						waitTime := backoff - elapsed
-						debugf("Message on backoff, waiting %v before retry", waitTime)
-
-						// Short sleep and continue
-						time.Sleep(50 * time.Millisecond)
-						continue
-					}
+		// Check if the batch is on backoff after a failed attempt
+		if !pending.lastAttempt.IsZero() {
+			waitTime := calculateBackoff(pending.retries) - time.Since(pending.lastAttempt)
+			if waitTime > 0 {
+				debugf("Batch on backoff, waiting %v before retry", waitTime)
+				select {
+				case <-time.After(waitTime):
+				case <-ctx.Done():
+					debugf("Context canceled while waiting to retry")
+					return
 				}
+				continue
+			}
+		}
 
-				// Log the actual content being sent
-				logData([]byte(msg.message))
-
-				// Extract the actual message from the syslog format if present
-				message := extractMessage(msg.message)
-
-				// Create JSON payload
-				timestamp := time.Now().UTC().Format(TimestampFormat)
-				logEntry := LogEntry{
-					Timestamp: timestamp,
-					Message:   message,
+		lines := pending.next(c.config.EnableBatching)
+		count := int64(len(lines))
+		statusCode, err := c.deliver(ctx, lines)
+		if err != nil {
+			pending.retries++
+			pending.lastAttempt = time.Now()
+
+			fmt.Fprintf(os.Stderr, "Failed to send %d logs (attempt %d): %v\n", count, pending.retries, err)
+			debugf("Failed to send logs: %v", err)
+
+			// Transient failures are retried until delivered; only give up on
+			// logs the destination keeps rejecting
+			if isPermanentFailure(statusCode) && pending.retries > c.config.MaxRetries {
+				failCount += count
+				fmt.Fprintf(os.Stderr, "Giving up on %d logs after %d attempts\n", count, pending.retries)
+				if !pending.gap {
+					c.drops.add(DropReasonRejected, count, linesSize(lines))
 				}
-
-				jsonData, err := json.Marshal(logEntry)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error creating JSON payload: %v\n", err)
-					debugf("Error creating JSON payload: %v", err)
-					failCount++
-
-					// Remove this message from the queue since it can't be processed
-					requestQueue = requestQueue[1:]
-					continue
+				if pending.advance(len(lines)) {
+					c.commit(buffer, pending)
+					pending = nil
 				}
+			}
 
-				// Send HTTP request
-				statusCode, err := sendHTTPRequest(c.client, ctx, c.url, c.authToken, jsonData, c.config)
-				if err != nil {
-					// If we get an error, increment retry count
-					msg.retries++
-					msg.lastAttempt = time.Now()
-
-					fmt.Fprintf(os.Stderr, "Failed to send log (attempt %d): %v\n",
-						msg.retries, err)
-					debugf("Failed to send log: %v", err)
-
-					if msg.retries > c.config.MaxRetries {
-						// Give up after max retries and remove from queue
-						failCount++
-						fmt.Fprintf(os.Stderr, "Giving up on message after %d attempts\n", msg.retries)
-						requestQueue = requestQueue[1:]
-					} else {
-						// Put updated retry count back
-						requestQueue[0] = msg
-					}
-
-					// Let the next loop iteration handle backoff
-					continue
-				}
+			// Let the next loop iteration handle backoff
+			continue
+		}
 
-				// Record success
-				successCount++
+		// The destination accepted the logs, so they can leave the buffer once
+		// the rest of their batch is sent too
+		if pending.advance(len(lines)) {
+			c.commit(buffer, pending)
+			pending = nil
+		}
 
-				// Log success with detailed information (only in verbose mode)
-				debugf("------------------------------------------------------")
-				debugf("Successfully sent log entry (HTTP %d)", statusCode)
-				debugf("Message delivered successfully to %s", c.url)
-				debugf("------------------------------------------------------")
-				debugf("Successfully sent log entry with status code: %d", statusCode)
+		// Record success
+		successCount += count
+		if c.config.EnableBatching {
+			batchCount++
+		}
 
-				// Remove the processed message from the queue
-				requestQueue = requestQueue[1:]
+		// Log success with detailed information (only in verbose mode)
+		debugf("------------------------------------------------------")
+		debugf("Successfully sent %d log entries (HTTP %d)", count, statusCode)
+		debugf("All messages delivered successfully to %s", c.url)
+		debugf("------------------------------------------------------")
 
-				// Short pause between requests to avoid flooding
-				time.Sleep(50 * time.Millisecond)
-			}
-		}
+		// Short pause between requests to avoid flooding
+		time.Sleep(50 * time.Millisecond)
 	}
 }
@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -463,3 +467,270 @@ func TestSendLogsSignalChannelFull(t *testing.T) {
 
 	client.SendLogs(ctx, mockBuffer, signal)
 }
+
+// TestSendLogsKeepsDataUntilAccepted tests that logs stay buffered until the server accepts them
+func TestSendLogsKeepsDataUntilAccepted(t *testing.T) {
+	var mu sync.Mutex
+	accept := false
+	server := createMockHTTPServerWithCallback(t, func() (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !accept {
+			return http.StatusServiceUnavailable, "Unavailable"
+		}
+		return http.StatusAccepted, ""
+	})
+	defer server.Close()
+
+	mockBuffer := NewMockBuffer()
+	mockBuffer.Write([]byte("test log message\n"))
+
+	client := &HTTPClient{
+		config: &Config{
+			RequestTimeout: 1 * time.Second,
+			HTTPTimeout:    2 * time.Second,
+			MaxRetries:     0,
+			BatchSize:      10,
+			EnableBatching: true,
+		},
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	signal := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		client.SendLogs(ctx, mockBuffer, signal)
+		close(done)
+	}()
+
+	// Failed deliveries must not consume the log, even past MaxRetries
+	time.Sleep(1500 * time.Millisecond)
+	if !mockBuffer.HasData() {
+		t.Fatal("Log was removed from the buffer before it was delivered")
+	}
+
+	mu.Lock()
+	accept = true
+	mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mockBuffer.HasData() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if mockBuffer.HasData() {
+		t.Error("Log was not removed from the buffer after successful delivery")
+	}
+
+	cancel()
+	<-done
+}
+
+// TestSendLogsUnbatchedRecord tests that every line of a multi-line record is
+// sent when batching is disabled
+func TestSendLogsUnbatchedRecord(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		delivered = append(delivered, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+	buffer.Write([]byte("a\nb\n"))
+
+	client := &HTTPClient{
+		config: &Config{
+			RequestTimeout: 1 * time.Second,
+			HTTPTimeout:    2 * time.Second,
+			MaxRetries:     1,
+			EnableBatching: false,
+		},
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.SendLogs(ctx, buffer, make(chan struct{}, 1))
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for buffer.HasData() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 2 || !strings.Contains(delivered[0], `"message":"a"`) || !strings.Contains(delivered[1], `"message":"b"`) {
+		t.Errorf("Delivered %q, want a and b in their own requests", delivered)
+	}
+	if buffer.HasData() {
+		t.Error("Record was not committed after all of its lines were delivered")
+	}
+}
+
+// TestSendLogsGivesUpOnRejectedLogs tests that permanently rejected logs are dropped after MaxRetries
+func TestSendLogsGivesUpOnRejectedLogs(t *testing.T) {
+	server := createMockHTTPServerWithCallback(t, func() (int, string) {
+		return http.StatusBadRequest, "Bad Request"
+	})
+	defer server.Close()
+
+	mockBuffer := NewMockBuffer()
+	mockBuffer.Write([]byte("malformed log message\n"))
+
+	client := &HTTPClient{
+		config: &Config{
+			RequestTimeout: 1 * time.Second,
+			HTTPTimeout:    2 * time.Second,
+			MaxRetries:     0,
+			BatchSize:      10,
+			EnableBatching: false,
+		},
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	signal := make(chan struct{}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	client.SendLogs(ctx, mockBuffer, signal)
+
+	if mockBuffer.HasData() {
+		t.Error("Rejected log should have been dropped after MaxRetries")
+	}
+}
+
+// TestSendLogsReportsDroppedLogs tests that a gap marker replaces rejected logs
+func TestSendLogsReportsDroppedLogs(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "malformed") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		delivered = append(delivered, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	mockBuffer := NewMockBuffer()
+	mockBuffer.Write([]byte("malformed log message\n"))
+
+	client := &HTTPClient{
+		config: &Config{
+			RequestTimeout: 1 * time.Second,
+			HTTPTimeout:    2 * time.Second,
+			MaxRetries:     0,
+			EnableBatching: false,
+		},
+		client: server.Client(),
+		url:    server.URL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	client.SendLogs(ctx, mockBuffer, make(chan struct{}, 1))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 1 {
+		t.Fatalf("Expected one gap marker to be delivered, got %d requests: %q", len(delivered), delivered)
+	}
+	want := "log_fwd dropped 1 lines (21 bytes)"
+	if !strings.Contains(delivered[0], want) || !strings.Contains(delivered[0], DropReasonRejected) {
+		t.Errorf("Gap marker %q doesn't describe the dropped log", delivered[0])
+	}
+	if client.droppedLines != 1 || client.droppedBytes != 21 {
+		t.Errorf("Dropped counters = %d lines, %d bytes; want 1 line, 21 bytes", client.droppedLines, client.droppedBytes)
+	}
+}
+
+// TestReadPendingBatch tests turning buffer records into lines
+func TestReadPendingBatch(t *testing.T) {
+	mockBuffer := NewMockBuffer()
+	mockBuffer.Write([]byte("one\n\ntwo\nthree\npartial"))
+
+	batch, err := readPendingBatch(mockBuffer, 3)
+	if err != nil {
+		t.Fatalf("readPendingBatch failed: %v", err)
+	}
+	if strings.Join(batch.lines, ",") != "one,two" {
+		t.Errorf("lines = %q, expected [one two]", batch.lines)
+	}
+	if batch.offset != int64(len("one\n\ntwo\n")) {
+		t.Errorf("offset = %d, expected %d", batch.offset, len("one\n\ntwo\n"))
+	}
+
+	mockBuffer.Commit(batch.offset)
+	batch, err = readPendingBatch(mockBuffer, 10)
+	if err != nil {
+		t.Fatalf("readPendingBatch failed: %v", err)
+	}
+	if strings.Join(batch.lines, ",") != "three,partial" {
+		t.Errorf("lines = %q, expected [three partial]", batch.lines)
+	}
+
+	// Records holding several lines are split into one entry per line
+	tmpdir, err := os.MkdirTemp("", "sendlogs-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	buf, err := NewBuffer(filepath.Join(tmpdir, "test-buffer.log"), 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buf.Close()
+
+	buf.Write([]byte("first\nsecond\n"))
+	buf.Write([]byte("third\n"))
+	batch, err = readPendingBatch(buf, 10)
+	if err != nil {
+		t.Fatalf("readPendingBatch failed: %v", err)
+	}
+	if strings.Join(batch.lines, ",") != "first,second,third" {
+		t.Errorf("lines = %q, expected [first second third]", batch.lines)
+	}
+}
+
+// TestIsPermanentFailure tests classification of HTTP status codes
+func TestIsPermanentFailure(t *testing.T) {
+	tests := map[int]bool{
+		0:                              false,
+		http.StatusBadRequest:          true,
+		http.StatusUnauthorized:        true,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	}
+	for code, want := range tests {
+		if got := isPermanentFailure(code); got != want {
+			t.Errorf("isPermanentFailure(%d) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -430,6 +430,12 @@ func TestCalculateBackoff(t *testing.T) {
 			expectMin:  24 * time.Second, // 30s - 20% jitter
 			expectMax:  36 * time.Second, // 30s + 20% jitter
 		},
+		{
+			name:       "very high retry count (should not overflow)",
+			retryCount: 100,
+			expectMin:  24 * time.Second,
+			expectMax:  36 * time.Second,
+		},
 	}
 
 	for _, tt := range tests {
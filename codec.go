@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// recordTimeSize is the size of the write time at the start of timestamped
+// records: nanoseconds since the Unix epoch. It is stored outside any
+// encryption or compression, so records can be expired without decoding them.
+const recordTimeSize = 8
+
+// errEncryptedRecord is returned when reading an encrypted record without keys
+var errEncryptedRecord = errors.New("record is encrypted but no encryption key is configured")
+
+// recordCodec turns log data into stored record payloads and back. The zero
+// value stores data as is.
+type recordCodec struct {
+	compressor *compressor   // Compresses new records when set
+	keys       *keyRing      // Encrypts new records when set
+	maxAge     time.Duration // Timestamps new records and expires older ones when set
+}
+
+// newRecordCodec creates the codec for a buffer. dictPath is where the
+// compression dictionary is kept, and empty tells whether the buffer holds
+// no records, so a new dictionary may be learned.
+func newRecordCodec(opts BufferOptions, dictPath string, empty bool) (recordCodec, error) {
+	comp, err := newCompressor(opts.Compression, dictPath, opts.Keys, empty)
+	if err != nil {
+		return recordCodec{}, err
+	}
+	return recordCodec{compressor: comp, keys: opts.Keys, maxAge: opts.MaxAge}, nil
+}
+
+// encode prepares data for storage, returning the payload and its record
+// flags. Data is compressed before it is encrypted, since ciphertext doesn't
+// compress.
+func (c recordCodec) encode(data []byte) ([]byte, uint8, error) {
+	payload := data
+	var flags uint8
+
+	if c.compressor != nil {
+		compressed, ok, err := c.compressor.compress(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			payload = compressed
+			flags |= recordCompressed
+		}
+	}
+
+	if c.keys != nil {
+		sealed, err := c.keys.seal(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		payload = sealed
+		flags |= recordEncrypted
+	}
+
+	if c.maxAge > 0 {
+		stamped := make([]byte, recordTimeSize+len(payload))
+		binary.LittleEndian.PutUint64(stamped, uint64(time.Now().UnixNano()))
+		copy(stamped[recordTimeSize:], payload)
+		payload = stamped
+		flags |= recordTimestamped
+	}
+
+	return payload, flags, nil
+}
+
+// decode recovers the data stored in a record. Records are decoded according
+// to their own flags, so records written with other settings can still be read.
+func (c recordCodec) decode(rec record) ([]byte, error) {
+	if rec.flags&^(recordEncrypted|recordCompressed|recordTimestamped) != 0 {
+		return nil, fmt.Errorf("unsupported record flags %#x", rec.flags)
+	}
+
+	payload := rec.payload
+	if rec.flags&recordTimestamped != 0 {
+		if len(payload) < recordTimeSize {
+			return nil, errors.New("timestamped record is too short")
+		}
+		payload = payload[recordTimeSize:]
+	}
+	if rec.flags&recordEncrypted != 0 {
+		if c.keys == nil {
+			return nil, errEncryptedRecord
+		}
+		opened, err := c.keys.open(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = opened
+	}
+
+	if rec.flags&recordCompressed != 0 {
+		return c.compressor.decompress(payload)
+	}
+	return payload, nil
+}
+
+// recordTime returns when a timestamped record was written
+func recordTime(rec record) (time.Time, bool) {
+	if rec.flags&recordTimestamped == 0 || len(rec.payload) < recordTimeSize {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(rec.payload))), true
+}
+
+// expired reports whether a record was written longer than maxAge ago.
+// Records written without a timestamp never expire.
+func (c recordCodec) expired(rec record) bool {
+	if c.maxAge <= 0 {
+		return false
+	}
+	written, ok := recordTime(rec)
+	return ok && time.Since(written) > c.maxAge
+}
+
+// readable decodes a record read from a buffer. Corrupt records are skipped,
+// since they would otherwise block delivery, and so are records that have
+// expired; for those it returns the drop reason, which the caller counts once
+// the record is consumed. Records encrypted with a key that isn't loaded are
+// intact, so they are never skipped: the error stops delivery until the key
+// is provided.
+func (c recordCodec) readable(rec record) ([]byte, string, error) {
+	if c.expired(rec) {
+		debugf("Skipping buffer record older than %v", c.maxAge)
+		return nil, DropReasonExpired, nil
+	}
+
+	data, err := c.decode(rec)
+	if errors.Is(err, errUnknownKey) || errors.Is(err, errEncryptedRecord) {
+		return nil, "", fmt.Errorf("%w; provide the key with -encryption-key-file to deliver the remaining logs", err)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: skipping unreadable buffer record: %v\n", err)
+		return nil, DropReasonUnreadable, nil
+	}
+	return data, "", nil
+}
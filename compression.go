@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Buffer compression modes, selectable with -buffer-compression
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip" // Each record is gzipped on its own
+	CompressionDict = "dict" // Records are deflated with a dictionary learned from earlier logs
+)
+
+// Compressed payload layout
+//
+//	method(1) data              gzip
+//	method(1) dictID(4) data    deflate with the dictionary dictID
+//
+// A single log line shares little with itself, so gzip alone gains little on
+// short lines. A dictionary of typical log lines lets deflate refer back to
+// them, which compresses short, similar lines several-fold.
+const (
+	compressMethodGzip = 1
+	compressMethodDict = 2
+)
+
+const (
+	minCompressSize = 64        // Smaller payloads aren't worth compressing
+	dictSize        = 32 * 1024 // Deflate can't refer back further than this
+)
+
+// validCompression reports whether name is a known buffer compression mode
+func validCompression(name string) bool {
+	switch name {
+	case "", CompressionNone, CompressionGzip, CompressionDict:
+		return true
+	}
+	return false
+}
+
+// gzipWriters reuses compressors, which are expensive to allocate per record
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// compressionDict is a deflate dictionary shared by the records of a buffer
+type compressionDict struct {
+	id      uint32 // Checksum of data, stored in every record using the dictionary
+	data    []byte
+	writers sync.Pool // *flate.Writer set up with data
+}
+
+// newCompressionDict creates a dictionary from sample log data
+func newCompressionDict(data []byte) *compressionDict {
+	if len(data) > dictSize {
+		data = data[len(data)-dictSize:]
+	}
+	return &compressionDict{id: crc32.ChecksumIEEE(data), data: data}
+}
+
+// compressor compresses record payloads for one buffer. In dict mode it
+// learns a dictionary from the first dictSize bytes written to an empty
+// buffer and keeps it in a file next to the buffer, so records stay readable
+// across restarts (buffers without a dictPath keep it in memory only).
+// Records written while learning are gzipped instead.
+type compressor struct {
+	mode     string
+	dictPath string
+	keys     *keyRing // Encrypts the dictionary file, which holds log data
+
+	mutex  sync.Mutex
+	dict   *compressionDict
+	sample []byte // Data collected for the dictionary
+}
+
+// newCompressor sets up compression for a buffer. An existing dictionary is
+// always loaded so that records compressed with it can be read; with relearn
+// (the buffer holds no records) it is replaced by a new one learned from
+// upcoming logs instead.
+func newCompressor(mode, dictPath string, keys *keyRing, relearn bool) (*compressor, error) {
+	c := &compressor{mode: mode, dictPath: dictPath, keys: keys}
+	if c.mode == "" {
+		c.mode = CompressionNone
+	}
+
+	if dictPath == "" {
+		return c, nil
+	}
+	if relearn && c.mode == CompressionDict {
+		if err := os.Remove(dictPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove compression dictionary: %w", err)
+		}
+		return c, nil
+	}
+
+	dict, err := loadCompressionDict(dictPath, keys)
+	if err != nil {
+		return nil, err
+	}
+	c.dict = dict
+	return c, nil
+}
+
+// loadCompressionDict reads a dictionary file, returning nil if there is none
+func loadCompressionDict(path string, keys *keyRing) (*compressionDict, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression dictionary: %w", err)
+	}
+
+	// The dictionary is stored as a single record, encrypted like the logs
+	rec, err := readRecordAt(func(pos, n int64) ([]byte, error) {
+		return data[pos : pos+n], nil
+	}, 0, int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression dictionary %s: %w", path, err)
+	}
+	content, err := recordCodec{keys: keys}.decode(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression dictionary %s: %w", path, err)
+	}
+
+	debugf("Loaded %d byte compression dictionary from %s", len(content), path)
+	return newCompressionDict(content), nil
+}
+
+// saveCompressionDict writes a dictionary file, replacing it atomically
+func saveCompressionDict(path string, dict *compressionDict, keys *keyRing) error {
+	payload, flags, err := recordCodec{keys: keys}.encode(dict.data)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create compression dictionary: %w", err)
+	}
+	if _, err := file.Write(encodeRecord(payload, flags)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write compression dictionary: %w", err)
+	}
+	// Records will depend on the dictionary, so it must be on disk first
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync compression dictionary: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write compression dictionary: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// compress compresses data, returning false if it is stored uncompressed
+func (c *compressor) compress(data []byte) ([]byte, bool, error) {
+	if c == nil || c.mode == CompressionNone || len(data) < minCompressSize {
+		return data, false, nil
+	}
+
+	var dict *compressionDict
+	if c.mode == CompressionDict {
+		var err error
+		if dict, err = c.learn(data); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var out bytes.Buffer
+	if dict != nil {
+		out.WriteByte(compressMethodDict)
+		binary.Write(&out, binary.LittleEndian, dict.id)
+		if err := deflateWithDict(&out, data, dict); err != nil {
+			return nil, false, err
+		}
+	} else {
+		out.WriteByte(compressMethodGzip)
+		if err := gzipTo(&out, data); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if out.Len() >= len(data) {
+		return data, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// learn returns the dictionary, collecting data for it until it is complete
+func (c *compressor) learn(data []byte) (*compressionDict, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.dict != nil {
+		return c.dict, nil
+	}
+
+	c.sample = append(c.sample, data...)
+	if len(c.sample) < dictSize {
+		return nil, nil
+	}
+
+	dict := newCompressionDict(c.sample)
+	if c.dictPath != "" {
+		if err := saveCompressionDict(c.dictPath, dict, c.keys); err != nil {
+			return nil, err
+		}
+	}
+	debugf("Learned %d byte compression dictionary", len(dict.data))
+	c.dict = dict
+	c.sample = nil
+	return dict, nil
+}
+
+// decompress reverses compress for a payload stored with the compressed flag
+func (c *compressor) decompress(payload []byte) ([]byte, error) {
+	if len(payload) < 1 {
+		return nil, errCorruptRecord
+	}
+
+	var zr io.ReadCloser
+	switch payload[0] {
+	case compressMethodGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress record: %w", err)
+		}
+		zr = r
+	case compressMethodDict:
+		if len(payload) < 5 {
+			return nil, errCorruptRecord
+		}
+		id := binary.LittleEndian.Uint32(payload[1:5])
+		var dict *compressionDict
+		if c != nil {
+			c.mutex.Lock()
+			dict = c.dict
+			c.mutex.Unlock()
+		}
+		if dict == nil || dict.id != id {
+			return nil, fmt.Errorf("record compressed with unknown dictionary %08x", id)
+		}
+		zr = flate.NewReaderDict(bytes.NewReader(payload[5:]), dict.data)
+	default:
+		return nil, fmt.Errorf("unknown compression method %d", payload[0])
+	}
+	defer zr.Close()
+
+	// A record never holds more than maxRecordPayload bytes of data
+	data, err := io.ReadAll(io.LimitReader(zr, maxRecordPayload+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress record: %w", err)
+	}
+	if len(data) > maxRecordPayload {
+		return nil, fmt.Errorf("decompressed record exceeds %d bytes", maxRecordPayload)
+	}
+	return data, nil
+}
+
+// gzipTo writes data to w as a gzip stream
+func gzipTo(w io.Writer, data []byte) error {
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(w)
+
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("failed to compress record: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress record: %w", err)
+	}
+	return nil
+}
+
+// deflateWithDict writes data to w as a deflate stream using the dictionary
+func deflateWithDict(w io.Writer, data []byte, dict *compressionDict) error {
+	var zw *flate.Writer
+	if pooled := dict.writers.Get(); pooled != nil {
+		zw = pooled.(*flate.Writer)
+		zw.Reset(w)
+	} else {
+		var err error
+		if zw, err = flate.NewWriterDict(w, flate.DefaultCompression, dict.data); err != nil {
+			return fmt.Errorf("failed to compress record: %w", err)
+		}
+	}
+	defer dict.writers.Put(zw)
+
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("failed to compress record: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress record: %w", err)
+	}
+	return nil
+}
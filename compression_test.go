@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLogLine returns a typical structured log line
+func testLogLine(i int) string {
+	return fmt.Sprintf(`{"time":"2024-05-01T10:00:%02dZ","level":"info","msg":"request handled",`+
+		`"http":{"method":"GET","path":"/api/v1/items/%d","status":200,"duration_ms":%d},`+
+		`"client":{"ip":"10.0.0.%d","user_agent":"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)"},`+
+		`"service":{"name":"inventory-api","version":"1.4.2","environment":"production","region":"eu-central-1"},`+
+		`"trace":{"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"00f067aa0ba902b7"}}`+"\n",
+		i%60, i, i%500, i%256)
+}
+
+func TestCompressorGzip(t *testing.T) {
+	c, err := newCompressor(CompressionGzip, "", nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create compressor: %v", err)
+	}
+	line := bytes.Repeat([]byte(testLogLine(1)), 4)
+
+	compressed, ok, err := c.compress(line)
+	if err != nil || !ok {
+		t.Fatalf("compress() = %v, %v; want compressed data", ok, err)
+	}
+	if len(compressed) >= len(line) {
+		t.Errorf("Compressed size %d is not smaller than %d", len(compressed), len(line))
+	}
+	data, err := c.decompress(compressed)
+	if err != nil {
+		t.Fatalf("decompress failed: %v", err)
+	}
+	if !bytes.Equal(data, line) {
+		t.Errorf("decompress() = %q, want %q", data, line)
+	}
+
+	// Short and incompressible payloads are stored as they are
+	if _, ok, _ := c.compress([]byte("short line\n")); ok {
+		t.Error("Expected a short payload not to be compressed")
+	}
+	random := make([]byte, 1024)
+	rand.Read(random)
+	if _, ok, _ := c.compress(random); ok {
+		t.Error("Expected random data not to be compressed")
+	}
+
+	if _, err := c.decompress([]byte{compressMethodGzip, 'x'}); err == nil {
+		t.Error("Expected an error for invalid compressed data")
+	}
+	if _, err := c.decompress([]byte{9, 'x'}); err == nil {
+		t.Error("Expected an error for an unknown compression method")
+	}
+}
+
+func TestCompressorDictionary(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "compression-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dictPath := filepath.Join(tmpdir, "buffer.log.dict")
+	keys, _ := parseKeyRing("k1:" + testKeyHex)
+	c, err := newCompressor(CompressionDict, dictPath, keys, true)
+	if err != nil {
+		t.Fatalf("Failed to create compressor: %v", err)
+	}
+
+	// Until enough data has been seen, records are gzipped
+	var i int
+	var compressed []byte
+	for i = 0; c.dict == nil; i++ {
+		if compressed, _, err = c.compress([]byte(testLogLine(i))); err != nil {
+			t.Fatalf("compress failed: %v", err)
+		}
+		if c.dict == nil && compressed[0] != compressMethodGzip {
+			t.Fatalf("Record %d compressed with method %d before the dictionary was learned", i, compressed[0])
+		}
+	}
+
+	line := []byte(testLogLine(i))
+	compressed, ok, err := c.compress(line)
+	if err != nil || !ok || compressed[0] != compressMethodDict {
+		t.Fatalf("compress() with dictionary = %v, %v, method %d", ok, err, compressed[0])
+	}
+	if len(compressed)*4 > len(line) {
+		t.Errorf("Dictionary compression only shrank %d bytes to %d", len(line), len(compressed))
+	}
+
+	// The dictionary survives a restart, and holds no plain text log data
+	if stored, _ := os.ReadFile(dictPath); bytes.Contains(stored, []byte("inventory-api")) {
+		t.Error("Dictionary file contains plain text logs")
+	}
+	reopened, err := newCompressor(CompressionDict, dictPath, keys, false)
+	if err != nil {
+		t.Fatalf("Failed to reopen compressor: %v", err)
+	}
+	data, err := reopened.decompress(compressed)
+	if err != nil {
+		t.Fatalf("decompress after reopen failed: %v", err)
+	}
+	if !bytes.Equal(data, line) {
+		t.Errorf("decompress() = %q, want %q", data, line)
+	}
+
+	// An empty buffer learns a new dictionary, so old records can't be read
+	relearned, err := newCompressor(CompressionDict, dictPath, keys, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen compressor: %v", err)
+	}
+	if _, err := relearned.decompress(compressed); err == nil {
+		t.Error("Expected an error for a record using a discarded dictionary")
+	}
+}
+
+func TestRecordCodecFlags(t *testing.T) {
+	keys, _ := parseKeyRing("k1:" + testKeyHex)
+	gzipCompressor, _ := newCompressor(CompressionGzip, "", nil, true)
+	data := bytes.Repeat([]byte("compressible log line\n"), 10)
+
+	tests := []struct {
+		name      string
+		codec     recordCodec
+		wantFlags uint8
+	}{
+		{"plain", recordCodec{}, 0},
+		{"compressed", recordCodec{compressor: gzipCompressor}, recordCompressed},
+		{"encrypted", recordCodec{keys: keys}, recordEncrypted},
+		{"compressed and encrypted", recordCodec{compressor: gzipCompressor, keys: keys}, recordCompressed | recordEncrypted},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, flags, err := tc.codec.encode(data)
+			if err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			if flags != tc.wantFlags {
+				t.Errorf("flags = %#x, want %#x", flags, tc.wantFlags)
+			}
+
+			// Any codec with the keys can read the record, whatever its own settings
+			decoded, err := recordCodec{keys: keys}.decode(record{payload: payload, flags: flags})
+			if err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("decode() = %q, want %q", decoded, data)
+			}
+		})
+	}
+
+	if _, err := (recordCodec{}).decode(record{payload: data, flags: 1 << 3}); err == nil {
+		t.Error("Expected an error for unknown record flags")
+	}
+}
+
+func TestCompressedBufferCapacity(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "compression-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Count how many typical log lines fit before the buffer starts dropping
+	capacity := func(opts BufferOptions, name string) int {
+		buf, err := NewBufferWithOptions(filepath.Join(tmpdir, name), InitialBufferSize, opts)
+		if err != nil {
+			t.Fatalf("Failed to create buffer: %v", err)
+		}
+		defer buf.Close()
+
+		for i := 0; ; i++ {
+			line := testLogLine(i)
+			if _, err := buf.Write([]byte(line)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if len(buf.TakeDrops()) > 0 {
+				return i
+			}
+		}
+	}
+
+	plain := capacity(BufferOptions{}, "plain.log")
+	gzipped := capacity(BufferOptions{Compression: CompressionGzip}, "gzip.log")
+	dict := capacity(BufferOptions{Compression: CompressionDict}, "dict.log")
+	if gzipped <= plain {
+		t.Errorf("Gzip buffer held %d lines, no more than the %d of the plain buffer", gzipped, plain)
+	}
+	if dict < 3*plain {
+		t.Errorf("Dictionary buffer held %d lines, less than three times the %d of the plain buffer", dict, plain)
+	}
+	t.Logf("Buffer capacity: %d plain, %d gzip, %d dict lines", plain, gzipped, dict)
+}
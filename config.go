@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,6 +19,19 @@ const (
 	DefaultMaxRetries     = 3                // Default number of retries
 	DefaultHTTPTimeout    = 30 * time.Second // Default HTTP client timeout
 	DefaultRequestTimeout = 10 * time.Second // Default per-request timeout
+	DefaultSegmentSize    = 8 * 1024 * 1024  // Default segment size for the segment buffer
+	DefaultSegmentAge     = 1 * time.Hour    // Default maximum segment age for the segment buffer
+	DefaultSyncInterval   = 1 * time.Second  // Default flush interval for the interval sync policy
+	DefaultSyncBytes      = 1024 * 1024      // Default flush threshold for the bytes sync policy
+	DefaultShrinkAfter    = 5 * time.Minute  // Default time the buffer file must stay mostly empty before it is shrunk
+)
+
+// Buffer types selectable with -buffer-type
+const (
+	BufferTypeFile    = "file"    // Single circular buffer file
+	BufferTypeSegment = "segment" // Directory of append-only segment files
+	BufferTypeMemory  = "memory"  // Records kept in memory only
+	BufferTypeMmap    = "mmap"    // Single circular buffer file, memory mapped (Linux only)
 )
 
 // ErrInvalidConfig is returned when required configuration is missing
@@ -24,23 +39,53 @@ var ErrInvalidConfig = errors.New("invalid configuration")
 
 // Config holds all program configuration
 type Config struct {
-	CertFile       string
-	Host           string
-	Port           int
-	ProgramName    string
-	BufferPath     string
-	MaxSize        int64
-	ShowVersion    bool
-	Verbose        bool
-	Quiet          bool // Suppress echoing logs to stdout
-	AuthToken      string
-	InsecureSSL    bool
-	BatchSize      int           // Number of log entries to batch in a single HTTP request
-	MaxRetries     int           // Maximum number of retries for failed requests
-	HTTPTimeout    time.Duration // Overall HTTP client timeout
-	RequestTimeout time.Duration // Per-request timeout
-	EnableBatching bool          // Whether to enable log batching
-	CompressLogs   bool          // Whether to compress logs (gzip) before sending
+	CertFile          string
+	Host              string
+	Port              int
+	ProgramName       string
+	BufferPath        string
+	BufferPerProgram  bool // Derive a separate buffer path for each -program
+	MaxSize           int64
+	ShowVersion       bool
+	Verbose           bool
+	Quiet             bool // Suppress echoing logs to stdout
+	AuthToken         string
+	InsecureSSL       bool
+	BatchSize         int           // Number of log entries to batch in a single HTTP request
+	MaxRetries        int           // Retries for logs rejected by the service (4xx); transient failures are retried until delivered
+	HTTPTimeout       time.Duration // Overall HTTP client timeout
+	RequestTimeout    time.Duration // Per-request timeout
+	EnableBatching    bool          // Whether to enable log batching
+	CompressLogs      bool          // Whether to compress logs (gzip) before sending
+	BufferType        string        // Buffer implementation (file, segment or memory)
+	SegmentSize       int64         // Size at which the segment buffer starts a new segment
+	SegmentAge        time.Duration // Age at which the segment buffer starts a new segment
+	OverflowPolicy    string        // What to do with new records when the buffer is full
+	SpillPath         string        // Spill file for the spill overflow policy
+	SyncPolicy        string        // When buffer writes are flushed to disk
+	SyncInterval      time.Duration // Flush interval for the interval sync policy
+	SyncBytes         int64         // Flush threshold for the bytes sync policy
+	EncryptionKeyFile string        // File holding the buffer encryption keys
+	BufferCompression string        // Compression of records stored in the buffer
+	PriorityLanes     laneFlags     // Priority lanes, highest priority first
+	MaxAge            time.Duration // Age after which buffered logs are dropped instead of sent
+	ShrinkAfter       time.Duration // Time the buffer file must stay mostly empty before it is shrunk
+	MinFree           diskReserve   // Free space to keep on the buffer's filesystem
+	FairKey           sourceKey     // What fair queuing partitions logs by, if set
+	FairPartitions    int           // Number of fair queuing partitions
+	FairPartitionSize int64         // Size cap of each partition, 0 to split -maxsize between them
+	FairWeights       weightFlags   // Batches delivered per turn for some source keys
+	WriteWindow       time.Duration // How long to wait for more input lines to write to the buffer together
+	Files             fileFlags     // Files or glob patterns to follow instead of reading stdin
+	FileStart         string        // Where to start reading files that exist at startup
+	Checkpoint        string        // File saving the read offsets of followed files
+	SyslogUDP         string        // Address to receive syslog messages on over UDP
+	SyslogTCP         string        // Address to receive syslog messages on over TCP
+	UnixSocket        string        // Unix stream socket to receive log lines on
+	UnixDatagram      string        // Unix datagram socket to receive log lines on
+	UnixSocketMode    socketMode    // Permissions of the Unix sockets
+	IngestAddr        string        // Address to accept logs posted over HTTP on
+	IngestToken       string        // Bearer token required by the HTTP ingest endpoint
 }
 
 // Validate checks if the config has all required fields
@@ -55,9 +100,110 @@ func (c *Config) Validate() error {
 	if c.AuthToken == "" {
 		return fmt.Errorf("%w: authorization token is required", ErrInvalidConfig)
 	}
+	switch c.BufferType {
+	case "", BufferTypeFile, BufferTypeSegment, BufferTypeMemory, BufferTypeMmap:
+	default:
+		return fmt.Errorf("%w: unknown buffer type %q", ErrInvalidConfig, c.BufferType)
+	}
+	if !validOverflowPolicy(c.OverflowPolicy) {
+		return fmt.Errorf("%w: unknown overflow policy %q", ErrInvalidConfig, c.OverflowPolicy)
+	}
+	if c.BufferType == BufferTypeMemory && c.OverflowPolicy == OverflowSpill && c.SpillPath == "" {
+		return fmt.Errorf("%w: -overflow spill with the memory buffer requires -spill", ErrInvalidConfig)
+	}
+	if !validSyncPolicy(c.SyncPolicy) {
+		return fmt.Errorf("%w: unknown sync policy %q", ErrInvalidConfig, c.SyncPolicy)
+	}
+	if !validCompression(c.BufferCompression) {
+		return fmt.Errorf("%w: unknown buffer compression %q", ErrInvalidConfig, c.BufferCompression)
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("%w: -max-age can't be negative", ErrInvalidConfig)
+	}
+	switch c.FileStart {
+	case "", FileStartEnd, FileStartBeginning:
+	default:
+		return fmt.Errorf("%w: -file-start must be %s or %s", ErrInvalidConfig, FileStartEnd, FileStartBeginning)
+	}
+	if c.WriteWindow < 0 {
+		return fmt.Errorf("%w: -write-window can't be negative", ErrInvalidConfig)
+	}
+	if c.ShrinkAfter < 0 {
+		return fmt.Errorf("%w: -shrink-after can't be negative", ErrInvalidConfig)
+	}
+	if len(c.PriorityLanes) >= maxLanes {
+		return fmt.Errorf("%w: at most %d priority lanes are supported", ErrInvalidConfig, maxLanes-1)
+	}
+	if c.FairKey.isSet() {
+		if c.FairPartitions < 1 || c.FairPartitions > maxPartitions {
+			return fmt.Errorf("%w: -fair-partitions must be between 1 and %d", ErrInvalidConfig, maxPartitions)
+		}
+		if c.FairPartitionSize < 0 {
+			return fmt.Errorf("%w: -fair-partition-size can't be negative", ErrInvalidConfig)
+		}
+		if len(c.PriorityLanes) > 0 {
+			return fmt.Errorf("%w: -fair-key can't be combined with -priority", ErrInvalidConfig)
+		}
+	} else if len(c.FairWeights) > 0 {
+		return fmt.Errorf("%w: -fair-weight requires -fair-key", ErrInvalidConfig)
+	}
+	for i, lane := range c.PriorityLanes {
+		for _, other := range c.PriorityLanes[:i] {
+			if lane.Name == other.Name {
+				return fmt.Errorf("%w: duplicate priority lane %q", ErrInvalidConfig, lane.Name)
+			}
+		}
+	}
 	return nil
 }
 
+// bufferOptions returns the buffer settings from the config
+func (c *Config) bufferOptions() BufferOptions {
+	return BufferOptions{
+		Overflow:     c.OverflowPolicy,
+		SpillPath:    c.SpillPath,
+		SegmentSize:  c.SegmentSize,
+		SegmentAge:   c.SegmentAge,
+		Sync:         c.SyncPolicy,
+		SyncInterval: c.SyncInterval,
+		SyncBytes:    c.SyncBytes,
+		Compression:  c.BufferCompression,
+		MaxAge:       c.MaxAge,
+		ShrinkAfter:  c.ShrinkAfter,
+		MinFree:      c.MinFree,
+	}
+}
+
+// readsStdin reports whether logs are read from stdin, rather than from
+// files or network inputs
+func (c *Config) readsStdin() bool {
+	return len(c.Files) == 0 && c.SyslogUDP == "" && c.SyslogTCP == "" && c.UnixSocket == "" && c.UnixDatagram == "" && c.IngestAddr == ""
+}
+
+// checkpointPath returns the checkpoint file of -file inputs, or "" if their
+// offsets aren't saved
+func (c *Config) checkpointPath() string {
+	if c.Checkpoint != "" || c.BufferPath == "" {
+		return c.Checkpoint
+	}
+	return c.BufferPath + ".checkpoint"
+}
+
+// programBufferPath adds a program name to a buffer path, before its extension:
+// log_fwd_buffer.log becomes log_fwd_buffer-<program>.log
+func programBufferPath(path, program string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, program)
+
+	path = filepath.Clean(path)
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
 // LogFatalFunc defines the signature for a fatal logging function
 type LogFatalFunc func(v ...interface{})
 
@@ -75,11 +221,42 @@ func ParseFlags() *Config {
 	flag.StringVar(&config.Host, "host", "", "Log destination host (e.g., s86746456.eu-nbg-2.betterstackdata.com)")
 	flag.IntVar(&config.Port, "port", 443, "Port for log destination (defaults to 443 for HTTPS)")
 	flag.StringVar(&config.ProgramName, "program", "custom-logger", "Program name for log identification")
+	flag.Var(&config.Files, "file", "Follow this log file, or the files matching this glob pattern, across rotation instead of reading stdin (repeatable)")
+	flag.StringVar(&config.FileStart, "file-start", FileStartEnd, "Where to start reading -file files that already exist and have no checkpoint: end or beginning")
+	flag.StringVar(&config.Checkpoint, "checkpoint", "", "File saving the read offsets of -file files across restarts (defaults to <buffer>.checkpoint)")
+	flag.StringVar(&config.SyslogUDP, "syslog-udp", "", "Receive syslog messages over UDP on this address (e.g. :514) instead of reading stdin")
+	flag.StringVar(&config.SyslogTCP, "syslog-tcp", "", "Receive syslog messages over TCP on this address (e.g. :514) instead of reading stdin")
+	flag.StringVar(&config.UnixSocket, "unix-socket", "", "Receive log lines on a Unix stream socket at this path instead of reading stdin")
+	flag.StringVar(&config.UnixDatagram, "unix-datagram", "", "Receive log lines on a Unix datagram socket at this path instead of reading stdin")
+	config.UnixSocketMode = DefaultSocketMode
+	flag.Var(&config.UnixSocketMode, "unix-socket-mode", "Permissions of the -unix-socket and -unix-datagram sockets, in octal")
+	flag.StringVar(&config.IngestAddr, "ingest", "", "Accept logs POSTed as JSON or NDJSON over HTTP on this address (e.g. 127.0.0.1:8080) instead of reading stdin")
+	flag.StringVar(&config.IngestToken, "ingest-token", "", "Bearer token that -ingest requests must carry")
 	flag.StringVar(&config.BufferPath, "buffer", "log_fwd_buffer.log", "Path to buffer file")
+	flag.BoolVar(&config.BufferPerProgram, "buffer-per-program", false, "Add the -program name to the buffer path, so each program gets its own buffer")
 	flag.StringVar(&config.AuthToken, "token", "", "Authorization token (required for HTTP API)")
+	flag.StringVar(&config.BufferType, "buffer-type", BufferTypeFile, "Buffer type: file (single circular file), mmap (the same file, memory mapped; Linux only), segment (directory of segment files) or memory (no files)")
+	flag.Var(&config.MinFree, "min-free", "Free space to keep on the buffer's filesystem, as a size (e.g. 2GB) or a percentage (e.g. 10%); the overflow policy applies once it is reached")
+	flag.DurationVar(&config.ShrinkAfter, "shrink-after", DefaultShrinkAfter, "Shrink the buffer file once it has been mostly empty for this long (0 to never shrink)")
+	flag.Int64Var(&config.SegmentSize, "segment-size", DefaultSegmentSize, "Segment size in bytes for the segment buffer")
+	flag.DurationVar(&config.SegmentAge, "segment-age", DefaultSegmentAge, "Maximum segment age for the segment buffer (0 to disable)")
+	flag.StringVar(&config.OverflowPolicy, "overflow", OverflowDropOldest, "Policy when the buffer is full: drop-oldest, drop-newest, block or spill")
+	flag.StringVar(&config.SpillPath, "spill", "", "Spill file for -overflow=spill (defaults to <buffer>.spill)")
+	flag.StringVar(&config.SyncPolicy, "sync", SyncNever, "When to flush buffer writes to disk: never, always, interval or bytes")
+	flag.DurationVar(&config.SyncInterval, "sync-interval", DefaultSyncInterval, "Flush interval for -sync=interval")
+	flag.Int64Var(&config.SyncBytes, "sync-bytes", DefaultSyncBytes, "Flush after this many bytes for -sync=bytes")
+	flag.StringVar(&config.EncryptionKeyFile, "encryption-key-file", "", "File with keys for encrypting the buffer (or set "+EncryptionKeyEnv+")")
+	flag.StringVar(&config.BufferCompression, "buffer-compression", CompressionNone, "Compression of logs stored in the buffer: none, gzip or dict")
+	flag.DurationVar(&config.WriteWindow, "write-window", DefaultWriteWindow, "Write input lines arriving within this long of each other to the buffer together (0 to only batch lines already waiting)")
+	flag.DurationVar(&config.MaxAge, "max-age", 0, "Drop buffered logs older than this instead of sending them (0 to disable)")
+	flag.Var(&config.PriorityLanes, "priority", "Priority lane NAME:SIZE:RULE, where RULE is level>=LEVEL or re:REGEX (repeatable, highest priority first)")
+	flag.Var(&config.FairKey, "fair-key", "Share delivery fairly between log sources, keyed by program, path or field:NAME")
+	flag.IntVar(&config.FairPartitions, "fair-partitions", DefaultFairPartitions, "Number of buffers that -fair-key sources are hashed into")
+	flag.Int64Var(&config.FairPartitionSize, "fair-partition-size", 0, "Maximum size in bytes of each -fair-key buffer (defaults to -maxsize divided by -fair-partitions)")
+	flag.Var(&config.FairWeights, "fair-weight", "Deliver KEY=WEIGHT batches of a -fair-key source per turn instead of one (repeatable)")
 	maxSize := flag.Int64("maxsize", DefaultMaxSize, "Maximum buffer size in bytes")
 	batchSize := flag.Int("batch", DefaultBatchSize, "Number of log entries to batch in a single request")
-	maxRetries := flag.Int("retries", DefaultMaxRetries, "Maximum number of retries for failed requests")
+	maxRetries := flag.Int("retries", DefaultMaxRetries, "Maximum number of retries for logs rejected by the service (4xx); transient failures are retried until delivered")
 	httpTimeout := flag.Duration("timeout", DefaultHTTPTimeout, "Overall HTTP client timeout")
 	requestTimeout := flag.Duration("req-timeout", DefaultRequestTimeout, "Per-request timeout")
 	enableBatching := flag.Bool("enable-batch", true, "Enable log batching")
@@ -103,6 +280,9 @@ func ParseFlags() *Config {
 	// Set quiet mode if either -q or --quiet is specified
 	config.Quiet = *quiet || *quietLong
 	config.InsecureSSL = *insecureSSL
+	if config.BufferPerProgram {
+		config.BufferPath = programBufferPath(config.BufferPath, config.ProgramName)
+	}
 
 	// If version flag is set, we'll handle this separately in main() so skip validation
 	if !config.ShowVersion {
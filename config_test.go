@@ -69,6 +69,132 @@ func TestConfigValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "segment buffer",
+			config: Config{
+				Host:       "example.com",
+				Port:       443,
+				AuthToken:  "test-token",
+				BufferType: BufferTypeSegment,
+			},
+			wantErr: false,
+		},
+		{
+			name: "unknown buffer type",
+			config: Config{
+				Host:       "example.com",
+				Port:       443,
+				AuthToken:  "test-token",
+				BufferType: "tape",
+			},
+			wantErr: true,
+		},
+		{
+			name: "spill overflow policy",
+			config: Config{
+				Host:           "example.com",
+				Port:           443,
+				AuthToken:      "test-token",
+				OverflowPolicy: OverflowSpill,
+			},
+			wantErr: false,
+		},
+		{
+			name: "unknown overflow policy",
+			config: Config{
+				Host:           "example.com",
+				Port:           443,
+				AuthToken:      "test-token",
+				OverflowPolicy: "explode",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown sync policy",
+			config: Config{
+				Host:       "example.com",
+				Port:       443,
+				AuthToken:  "test-token",
+				SyncPolicy: "sometimes",
+			},
+			wantErr: true,
+		},
+		{
+			name: "memory buffer spilling without a spill file",
+			config: Config{
+				Host:           "example.com",
+				Port:           443,
+				AuthToken:      "test-token",
+				BufferType:     BufferTypeMemory,
+				OverflowPolicy: OverflowSpill,
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown buffer compression",
+			config: Config{
+				Host:              "example.com",
+				Port:              443,
+				AuthToken:         "test-token",
+				BufferCompression: "zip",
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate priority lanes",
+			config: Config{
+				Host:          "example.com",
+				Port:          443,
+				AuthToken:     "test-token",
+				PriorityLanes: laneFlags{{Name: "errors", Size: 1024, MinLevel: LevelError}, {Name: "errors", Size: 1024, MinLevel: LevelWarn}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown file start",
+			config: Config{
+				Host:      "example.com",
+				Port:      443,
+				AuthToken: "test-token",
+				Files:     fileFlags{"/var/log/app.log"},
+				FileStart: "middle",
+			},
+			wantErr: true,
+		},
+		{
+			name: "fair queuing",
+			config: Config{
+				Host:           "example.com",
+				Port:           443,
+				AuthToken:      "test-token",
+				FairKey:        sourceKey{spec: SourceKeyProgram},
+				FairPartitions: DefaultFairPartitions,
+				FairWeights:    weightFlags{"web": 2},
+			},
+			wantErr: false,
+		},
+		{
+			name: "fair queuing with priority lanes",
+			config: Config{
+				Host:           "example.com",
+				Port:           443,
+				AuthToken:      "test-token",
+				FairKey:        sourceKey{spec: SourceKeyProgram},
+				FairPartitions: DefaultFairPartitions,
+				PriorityLanes:  laneFlags{{Name: "errors", Size: 1024, MinLevel: LevelError}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "fair queuing weights without a source key",
+			config: Config{
+				Host:        "example.com",
+				Port:        443,
+				AuthToken:   "test-token",
+				FairWeights: weightFlags{"web": 2},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -163,6 +289,25 @@ func TestParseFlags(t *testing.T) {
 				InsecureSSL: true,
 			},
 		},
+		{
+			name: "buffer per program",
+			args: []string{
+				"cmd",
+				"-host", "example.com",
+				"-token", "mytoken",
+				"-program", "web api",
+				"-buffer", "/var/log/buffer.log",
+				"-buffer-per-program",
+			},
+			expected: &Config{
+				Host:        "example.com",
+				Port:        443,
+				ProgramName: "web api",
+				BufferPath:  "/var/log/buffer-web_api.log",
+				MaxSize:     DefaultMaxSize,
+				AuthToken:   "mytoken",
+			},
+		},
 		{
 			name: "version flag",
 			args: []string{
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diskCheckInterval is how long a free space reading is trusted; writes in
+// between are deducted from it
+const diskCheckInterval = 1 * time.Second
+
+// errDiskSpaceUnsupported is returned where free disk space can't be determined
+var errDiskSpaceUnsupported = errors.New("free disk space can't be determined on this platform")
+
+// diskSpace returns the space available to log_fwd and the total size of the
+// filesystem holding dir; replaced in tests
+var diskSpace = statDiskSpace
+
+// diskReserve is the free space to keep on a buffer's filesystem, either in
+// bytes or as a percentage of the filesystem size. It implements flag.Value
+// for -min-free.
+type diskReserve struct {
+	bytes   int64
+	percent float64
+}
+
+// isSet reports whether a reserve was configured
+func (r diskReserve) isSet() bool {
+	return r.bytes > 0 || r.percent > 0
+}
+
+// of returns the reserve in bytes on a filesystem of the given size
+func (r diskReserve) of(total int64) int64 {
+	if r.percent > 0 {
+		return int64(float64(total) * r.percent / 100)
+	}
+	return r.bytes
+}
+
+// String implements flag.Value
+func (r *diskReserve) String() string {
+	switch {
+	case r.percent > 0:
+		return strconv.FormatFloat(r.percent, 'f', -1, 64) + "%"
+	case r.bytes > 0:
+		return strconv.FormatInt(r.bytes, 10)
+	}
+	return ""
+}
+
+// Set implements flag.Value, accepting sizes like 2GB or percentages like 10%
+func (r *diskReserve) Set(s string) error {
+	if number, ok := strings.CutSuffix(strings.TrimSpace(s), "%"); ok {
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return fmt.Errorf("invalid percentage %q", s)
+		}
+		*r = diskReserve{percent: percent}
+		return nil
+	}
+
+	size, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*r = diskReserve{bytes: size}
+	return nil
+}
+
+// diskGuard keeps a buffer from using up the free space its filesystem needs
+// to keep in reserve. A nil guard allows everything. The caller serializes
+// access, normally under the buffer's mutex.
+type diskGuard struct {
+	dir     string
+	reserve diskReserve
+	checked time.Time // When free space was last read
+	room    int64     // Bytes that may still be written
+	limited bool      // Whether writes are being refused, to warn only once
+	failed  bool      // Free space can't be determined, so the guard is off
+}
+
+// newDiskGuard creates a guard for the filesystem holding dir, or nil if no
+// reserve is configured
+func newDiskGuard(dir string, reserve diskReserve) *diskGuard {
+	if !reserve.isSet() {
+		return nil
+	}
+	return &diskGuard{dir: dir, reserve: reserve}
+}
+
+// available returns how many bytes may still be written without eating into
+// the reserve
+func (g *diskGuard) available() int64 {
+	if g == nil || g.failed {
+		return math.MaxInt64
+	}
+
+	if time.Since(g.checked) >= diskCheckInterval {
+		free, total, err := diskSpace(g.dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: can't check free disk space, ignoring -min-free: %v\n", err)
+			g.failed = true
+			return math.MaxInt64
+		}
+		g.room = free - g.reserve.of(total)
+		g.checked = time.Now()
+	}
+
+	if g.room <= 0 {
+		return 0
+	}
+	return g.room
+}
+
+// allow reports whether n more bytes may be written, counting them as written if so
+func (g *diskGuard) allow(n int64) bool {
+	if g.available() < n {
+		g.refused()
+		return false
+	}
+	g.wrote(n)
+	return true
+}
+
+// refused records that the reserve held a buffer back, warning the first time
+func (g *diskGuard) refused() {
+	if g == nil || g.limited {
+		return
+	}
+	g.limited = true
+	fmt.Fprintf(os.Stderr, "Warning: keeping %s free on the filesystem of %s, buffer growth is limited\n", g.reserve.String(), g.dir)
+}
+
+// wrote deducts n bytes written since free space was last read
+func (g *diskGuard) wrote(n int64) {
+	if g == nil || g.failed {
+		return
+	}
+	g.room -= n
+	if g.room > 0 {
+		g.limited = false
+	}
+}
+
+// freed credits n bytes released by deleting buffer files
+func (g *diskGuard) freed(n int64) {
+	g.wrote(-n)
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// statDiskSpace isn't available here, so -min-free has no effect
+func statDiskSpace(dir string) (int64, int64, error) {
+	return 0, 0, errDiskSpaceUnsupported
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDisk makes dir look like it is on a filesystem of the given capacity,
+// with the files in dir as the only ones using space
+func fakeDisk(t *testing.T, dir string, capacity int64) {
+	t.Helper()
+	diskSpace = func(string) (int64, int64, error) {
+		var used int64
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				used += info.Size()
+			}
+			return nil
+		})
+		return capacity - used, capacity, nil
+	}
+	t.Cleanup(func() { diskSpace = statDiskSpace })
+}
+
+func TestDiskReserveSet(t *testing.T) {
+	tests := map[string]diskReserve{
+		"2GB":   {bytes: 2 << 30},
+		"512MB": {bytes: 512 << 20},
+		"10%":   {percent: 10},
+		"12.5%": {percent: 12.5},
+	}
+	for s, want := range tests {
+		var r diskReserve
+		if err := r.Set(s); err != nil || r != want {
+			t.Errorf("Set(%q) = %+v, %v, want %+v", s, r, err, want)
+		}
+		if got := r.String(); s != "2GB" && s != "512MB" && got != s {
+			t.Errorf("String() = %q, want %q", got, s)
+		}
+	}
+	for _, s := range []string{"", "0%", "100%", "ten%", "lots"} {
+		var r diskReserve
+		if err := r.Set(s); err == nil {
+			t.Errorf("Set(%q) should fail", s)
+		}
+	}
+
+	if got := (diskReserve{percent: 10}).of(1000); got != 100 {
+		t.Errorf("10%% of 1000 = %d, want 100", got)
+	}
+}
+
+func TestDiskGuard(t *testing.T) {
+	var guard *diskGuard
+	if !guard.allow(1<<40) || newDiskGuard(t.TempDir(), diskReserve{}) != nil {
+		t.Error("Without a reserve everything should be allowed")
+	}
+
+	free := int64(1000)
+	diskSpace = func(string) (int64, int64, error) { return free, 10000, nil }
+	defer func() { diskSpace = statDiskSpace }()
+
+	guard = newDiskGuard(t.TempDir(), diskReserve{percent: 5})
+	if got := guard.available(); got != 500 {
+		t.Errorf("available() = %d, want 500", got)
+	}
+	if !guard.allow(300) || guard.allow(300) {
+		t.Error("Writes should be allowed until the reserve is reached")
+	}
+
+	// Deleted files give room back until free space is read again
+	guard.freed(100)
+	if got := guard.available(); got != 300 {
+		t.Errorf("available() after freeing = %d, want 300", got)
+	}
+	free = 0
+	guard.checked = guard.checked.Add(-diskCheckInterval)
+	if got := guard.available(); got != 0 {
+		t.Errorf("available() with a full disk = %d, want 0", got)
+	}
+
+	// Without free space information the guard gives up
+	diskSpace = func(string) (int64, int64, error) { return 0, 0, errDiskSpaceUnsupported }
+	guard = newDiskGuard(t.TempDir(), diskReserve{bytes: 1})
+	if !guard.allow(1 << 40) {
+		t.Error("The guard should be off where free space can't be read")
+	}
+}
+
+func TestBuffersKeepFreeDiskSpace(t *testing.T) {
+	// Each buffer is on a 1MB filesystem with 200KB above the reserve
+	const capacity, room = 1 << 20, 200 << 10
+	opts := BufferOptions{MinFree: diskReserve{bytes: capacity - room}, SegmentSize: 16 << 10}
+	record := make([]byte, 1000)
+
+	t.Run("circular", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDisk(t, dir, capacity)
+		buf, err := NewBufferWithOptions(filepath.Join(dir, "buffer.log"), capacity, opts)
+		if err != nil {
+			t.Fatalf("Failed to create buffer: %v", err)
+		}
+		defer buf.Close()
+
+		// The file grows into the free space, then overwrites its oldest records
+		for i := 0; i < 500; i++ {
+			if _, err := buf.Write(record); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if buf.fileSize <= InitialBufferSize || buf.fileSize > room {
+			t.Errorf("File size = %d, want it grown but within the %d bytes free", buf.fileSize, room)
+		}
+		if drops := buf.TakeDrops(); len(drops) != 1 || drops[0].Reason != DropReasonOverflow {
+			t.Errorf("Drop reports = %+v, want overflow drops", drops)
+		}
+	})
+
+	t.Run("segment", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDisk(t, dir, capacity)
+		buf, err := NewSegmentBuffer(filepath.Join(dir, "wal"), capacity, opts)
+		if err != nil {
+			t.Fatalf("Failed to create segment buffer: %v", err)
+		}
+		defer buf.Close()
+
+		for i := 0; i < 500; i++ {
+			if _, err := buf.Write(record); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if size := buf.diskSize(); size == 0 || size > room {
+			t.Errorf("Segments take %d bytes, want at most the %d bytes free", size, room)
+		}
+		if drops := buf.TakeDrops(); len(drops) != 1 || drops[0].Reason != DropReasonOverflow {
+			t.Errorf("Drop reports = %+v, want overflow drops", drops)
+		}
+	})
+
+	t.Run("drop-newest", func(t *testing.T) {
+		dir := t.TempDir()
+		fakeDisk(t, dir, capacity)
+		newestOpts := opts
+		newestOpts.Overflow = OverflowDropNewest
+		buf, err := NewSegmentBuffer(filepath.Join(dir, "wal"), capacity, newestOpts)
+		if err != nil {
+			t.Fatalf("Failed to create segment buffer: %v", err)
+		}
+		defer buf.Close()
+
+		// New records are refused once the reserve is reached
+		for i := 0; i < 500 && err == nil; i++ {
+			_, err = buf.Write(record)
+		}
+		if !errors.Is(err, ErrBufferFull) {
+			t.Fatalf("Write on a full disk error = %v, want ErrBufferFull", err)
+		}
+		if size := buf.diskSize(); size > room {
+			t.Errorf("Segments take %d bytes, want at most the %d bytes free", size, room)
+		}
+	})
+}
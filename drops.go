@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Reasons for which logs can be dropped
+const (
+	DropReasonOverflow   = "buffer overflow"                       // Overwritten or rejected by a full buffer
+	DropReasonRejected   = "repeated rejection by the log service" // Given up on after MaxRetries
+	DropReasonUnreadable = "unreadable buffer records"             // Could not be decrypted or decoded
+	DropReasonExpired    = "exceeding the maximum buffer age"      // Buffered for longer than MaxAge
+	DropReasonDiskFull   = "low disk space"                        // No room left within the -min-free reserve
+)
+
+// DropReport describes logs that were dropped for one reason during a period
+type DropReport struct {
+	Reason string
+	Lines  int64
+	Bytes  int64
+	First  time.Time // When the first of these logs was dropped
+	Last   time.Time // When the last of these logs was dropped
+}
+
+// Message returns the text of the gap marker sent in place of the dropped logs
+func (r DropReport) Message() string {
+	return fmt.Sprintf("log_fwd dropped %d lines (%d bytes) between %s and %s due to %s",
+		r.Lines, r.Bytes, r.First.UTC().Format(time.RFC3339), r.Last.UTC().Format(time.RFC3339), r.Reason)
+}
+
+// DropReporter is implemented by buffers that can lose data on their own,
+// such as when a full buffer overwrites unread records
+type DropReporter interface {
+	// TakeDrops returns the drops since the last call and resets them
+	TakeDrops() []DropReport
+}
+
+// dropCounter accumulates dropped logs until they are reported. The zero
+// value is ready to use.
+type dropCounter struct {
+	mutex   sync.Mutex
+	pending []DropReport // Not yet reported, one per reason
+}
+
+// add counts dropped logs
+func (d *dropCounter) add(reason string, lines, bytes int64) {
+	if lines == 0 && bytes == 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for i := range d.pending {
+		if d.pending[i].Reason == reason {
+			d.pending[i].Lines += lines
+			d.pending[i].Bytes += bytes
+			d.pending[i].Last = now
+			return
+		}
+	}
+	d.pending = append(d.pending, DropReport{Reason: reason, Lines: lines, Bytes: bytes, First: now, Last: now})
+}
+
+// take returns the drops that have not been reported yet and resets them
+func (d *dropCounter) take() []DropReport {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	reports := d.pending
+	d.pending = nil
+	return reports
+}
+
+// skippedRecord is a record a read skipped instead of returning
+type skippedRecord struct {
+	end    int64 // Offset just past the record
+	reason string
+	bytes  int64
+}
+
+// skippedRecords holds the records skipped by the last read. They are only
+// counted as dropped once a commit consumes them, so reading the same records
+// again before the commit doesn't count them twice.
+type skippedRecords []skippedRecord
+
+// commit counts the records that a commit from offset from up to offset to
+// consumes as dropped, and returns those still pending. Records before from
+// were consumed some other way, such as by overflow, and are forgotten.
+func (s skippedRecords) commit(from, to int64, drops *dropCounter) skippedRecords {
+	var pending skippedRecords
+	for _, rec := range s {
+		switch {
+		case rec.end > to:
+			pending = append(pending, rec)
+		case rec.end > from:
+			drops.add(rec.reason, 1, rec.bytes)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropCounter(t *testing.T) {
+	var drops dropCounter
+	if reports := drops.take(); len(reports) != 0 {
+		t.Fatalf("New counter reported %d drops", len(reports))
+	}
+
+	drops.add(DropReasonOverflow, 1, 10)
+	drops.add(DropReasonRejected, 2, 30)
+	drops.add(DropReasonOverflow, 3, 20)
+	drops.add(DropReasonOverflow, 0, 0)
+
+	reports := drops.take()
+	if len(reports) != 2 {
+		t.Fatalf("Expected one report per reason, got %d", len(reports))
+	}
+	if r := reports[0]; r.Reason != DropReasonOverflow || r.Lines != 4 || r.Bytes != 30 {
+		t.Errorf("Overflow report = %+v, want 4 lines and 30 bytes", r)
+	}
+	if r := reports[1]; r.Reason != DropReasonRejected || r.Lines != 2 || r.Bytes != 30 {
+		t.Errorf("Rejected report = %+v, want 2 lines and 30 bytes", r)
+	}
+	if reports := drops.take(); len(reports) != 0 {
+		t.Errorf("Counter still holds %d drops after take", len(reports))
+	}
+}
+
+func TestDropReportMessage(t *testing.T) {
+	report := DropReport{
+		Reason: DropReasonOverflow,
+		Lines:  1234,
+		Bytes:  56789,
+		First:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Last:   time.Date(2024, 5, 1, 10, 5, 0, 0, time.UTC),
+	}
+	want := "log_fwd dropped 1234 lines (56789 bytes) between 2024-05-01T10:00:00Z and 2024-05-01T10:05:00Z due to buffer overflow"
+	if got := report.Message(); got != want {
+		t.Errorf("Message() = %q, want %q", got, want)
+	}
+}
+
+func TestBuffersReportOverflowDrops(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "drops-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	circular, err := NewBuffer(filepath.Join(tmpdir, "buffer.log"), InitialBufferSize)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer circular.Close()
+
+	segments, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 400, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer segments.Close()
+
+	newest, err := NewBufferWithOptions(filepath.Join(tmpdir, "newest.log"), InitialBufferSize,
+		BufferOptions{Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer newest.Close()
+
+	tests := []struct {
+		name   string
+		buffer interface {
+			BufferInterface
+			DropReporter
+		}
+		record []byte
+	}{
+		{"circular", circular, []byte(strings.Repeat("a", InitialBufferSize/4-recordHeaderSize))},
+		{"segment", segments, []byte(strings.Repeat("a", 100-recordHeaderSize))},
+		{"drop-newest", newest, []byte(strings.Repeat("a", InitialBufferSize/4-recordHeaderSize))},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// The buffers hold four records, so the fifth and sixth cause drops
+			for i := 0; i < 6; i++ {
+				tc.buffer.Write(tc.record)
+			}
+
+			reports := tc.buffer.TakeDrops()
+			if len(reports) != 1 {
+				t.Fatalf("Expected one drop report, got %d", len(reports))
+			}
+			if r := reports[0]; r.Reason != DropReasonOverflow || r.Lines != 2 || r.Bytes != int64(2*len(tc.record)) {
+				t.Errorf("Drop report = %+v, want 2 lines and %d bytes", r, 2*len(tc.record))
+			}
+		})
+	}
+}
+
+func TestBuffersExpireOldRecords(t *testing.T) {
+	tmpdir := t.TempDir()
+	opts := BufferOptions{MaxAge: 50 * time.Millisecond}
+
+	circular, err := NewBufferWithOptions(filepath.Join(tmpdir, "buffer.log"), InitialBufferSize, opts)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer circular.Close()
+
+	segments, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1<<20, opts)
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer segments.Close()
+
+	memory, err := NewMemoryBuffer(1<<20, opts)
+	if err != nil {
+		t.Fatalf("Failed to create memory buffer: %v", err)
+	}
+	defer memory.Close()
+
+	buffers := []struct {
+		name   string
+		buffer interface {
+			BufferInterface
+			DropReporter
+		}
+	}{
+		{"circular", circular},
+		{"segment", segments},
+		{"memory", memory},
+	}
+
+	for _, tc := range buffers {
+		tc.buffer.Write([]byte("stale line one\n"))
+		tc.buffer.Write([]byte("stale line two\n"))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, tc := range buffers {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.buffer.Write([]byte("fresh line\n"))
+
+			// Reading again before the commit, as after a failed delivery,
+			// doesn't count the expired records twice
+			var offset int64
+			for range 2 {
+				var records [][]byte
+				var err error
+				records, offset, err = tc.buffer.ReadRecords(10)
+				if err != nil {
+					t.Fatalf("ReadRecords failed: %v", err)
+				}
+				if len(records) != 1 || string(records[0]) != "fresh line\n" {
+					t.Errorf("ReadRecords returned %q, want only the fresh line", records)
+				}
+			}
+			if reports := tc.buffer.TakeDrops(); len(reports) != 0 {
+				t.Errorf("Drop reports = %+v before the commit, want none", reports)
+			}
+			if err := tc.buffer.Commit(offset); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			if tc.buffer.HasData() {
+				t.Error("Expired records should be consumed along with the fresh one")
+			}
+
+			reports := tc.buffer.TakeDrops()
+			if len(reports) != 1 || reports[0].Reason != DropReasonExpired || reports[0].Lines != 2 {
+				t.Errorf("Drop reports = %+v, want 2 expired lines", reports)
+			}
+		})
+	}
+}
+
+func TestRecordsWithoutTimestampsNeverExpire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.log")
+
+	buffer, err := NewBuffer(path, InitialBufferSize)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buffer.Write([]byte("written before -max-age was set\n"))
+	buffer.Close()
+
+	buffer, err = NewBufferWithOptions(path, InitialBufferSize, BufferOptions{MaxAge: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	data, err := buffer.Read(1024)
+	if err != nil || string(data) != "written before -max-age was set\n" {
+		t.Errorf("Read returned %q, %v", data, err)
+	}
+}
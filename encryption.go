@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptionKeyEnv names the environment variable holding the buffer
+// encryption keys when no key file is given
+const EncryptionKeyEnv = "LOG_FWD_ENCRYPTION_KEY"
+
+// defaultKeyID is the ID of a key given without one
+const defaultKeyID = "default"
+
+// Encrypted payload layout
+//
+//	keyIDLen(1) keyID(keyIDLen) nonce(12) ciphertext+tag
+//
+// The key ID is also passed to AES-GCM as additional data, so a record can't
+// be relabelled to another key without failing authentication.
+const maxKeyIDLen = 255
+
+// errUnknownKey is returned when a record was encrypted with a key that isn't loaded
+var errUnknownKey = errors.New("record encrypted with unknown key")
+
+// keyRing holds the keys used to encrypt buffer records. New records are
+// encrypted with the active key; the others are kept so that records written
+// before a key rotation can still be read.
+type keyRing struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// loadKeyRing loads the encryption keys from path, or from EncryptionKeyEnv
+// if path is empty. It returns nil if neither is set.
+func loadKeyRing(path string) (*keyRing, error) {
+	var spec string
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		spec = string(data)
+	} else if env := os.Getenv(EncryptionKeyEnv); env != "" {
+		spec = env
+	} else {
+		return nil, nil
+	}
+
+	keys, err := parseKeyRing(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption keys: %w", err)
+	}
+	debugf("Loaded %d encryption keys, active key: %s", len(keys.keys), keys.active)
+	return keys, nil
+}
+
+// parseKeyRing parses keys given one per line (or separated by commas) as
+// "id:key" or just "key", where the key is 16, 24 or 32 bytes in hex or
+// base64. The first key is the active one. Blank lines and lines starting
+// with # are ignored.
+func parseKeyRing(spec string) (*keyRing, error) {
+	ring := &keyRing{keys: make(map[string]cipher.AEAD)}
+
+	entries := strings.FieldsFunc(spec, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded := defaultKeyID, entry
+		if i := strings.Index(entry, ":"); i >= 0 {
+			id, encoded = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		if id == "" || len(id) > maxKeyIDLen {
+			return nil, fmt.Errorf("key ID must be 1 to %d bytes", maxKeyIDLen)
+		}
+		if _, ok := ring.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+
+		ring.keys[id] = aead
+		if ring.active == "" {
+			ring.active = id
+		}
+	}
+
+	if ring.active == "" {
+		return nil, errors.New("no keys found")
+	}
+	return ring, nil
+}
+
+// decodeKey decodes a hex or base64 AES key
+func decodeKey(encoded string) ([]byte, error) {
+	if key, err := hex.DecodeString(encoded); err == nil && validKeyLen(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && validKeyLen(len(key)) {
+		return key, nil
+	}
+	return nil, errors.New("key must be 16, 24 or 32 bytes encoded as hex or base64")
+}
+
+// validKeyLen reports whether n is a valid AES key length
+func validKeyLen(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// seal encrypts a payload with the active key
+func (k *keyRing) seal(plaintext []byte) ([]byte, error) {
+	aead := k.keys[k.active]
+	nonceSize := aead.NonceSize()
+
+	sealed := make([]byte, 1+len(k.active)+nonceSize, 1+len(k.active)+nonceSize+len(plaintext)+aead.Overhead())
+	sealed[0] = byte(len(k.active))
+	copy(sealed[1:], k.active)
+	nonce := sealed[1+len(k.active):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return aead.Seal(sealed, nonce, plaintext, []byte(k.active)), nil
+}
+
+// open decrypts a payload sealed by seal with any key in the ring
+func (k *keyRing) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 1 || len(sealed) < 1+int(sealed[0]) {
+		return nil, errCorruptRecord
+	}
+	id := string(sealed[1 : 1+int(sealed[0])])
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownKey, id)
+	}
+
+	rest := sealed[1+len(id):]
+	if len(rest) < aead.NonceSize() {
+		return nil, errCorruptRecord
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record with key %q: %w", id, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyHex    = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKeyBase64 = "ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8="
+)
+
+func TestParseKeyRing(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       string
+		wantActive string
+		wantKeys   int
+		wantErr    bool
+	}{
+		{"bare hex key", testKeyHex, defaultKeyID, 1, false},
+		{"bare base64 key", testKeyBase64 + "\n", defaultKeyID, 1, false},
+		{"rotated keys", "# newest first\nk2:" + testKeyBase64 + "\n\nk1:" + testKeyHex + "\n", "k2", 2, false},
+		{"comma separated", "k2:" + testKeyBase64 + ",k1:" + testKeyHex, "k2", 2, false},
+		{"AES-128 key", "short:000102030405060708090a0b0c0d0e0f", "short", 1, false},
+		{"duplicate ID", "k1:" + testKeyHex + "\nk1:" + testKeyBase64, "", 0, true},
+		{"bad key length", "k1:0001020304", "", 0, true},
+		{"empty ID", ":" + testKeyHex, "", 0, true},
+		{"no keys", "# nothing here\n", "", 0, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ring, err := parseKeyRing(tc.spec)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseKeyRing() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ring.active != tc.wantActive {
+				t.Errorf("active key = %q, want %q", ring.active, tc.wantActive)
+			}
+			if len(ring.keys) != tc.wantKeys {
+				t.Errorf("got %d keys, want %d", len(ring.keys), tc.wantKeys)
+			}
+		})
+	}
+}
+
+func TestKeyRingSealOpen(t *testing.T) {
+	ring, err := parseKeyRing("k1:" + testKeyHex)
+	if err != nil {
+		t.Fatalf("parseKeyRing failed: %v", err)
+	}
+
+	sealed, err := ring.seal([]byte("secret log line\n"))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Error("Sealed payload contains the plaintext")
+	}
+
+	opened, err := ring.open(sealed)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if string(opened) != "secret log line\n" {
+		t.Errorf("open() = %q, want %q", opened, "secret log line\n")
+	}
+
+	// Tampering with the ciphertext must be detected
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := ring.open(sealed); err == nil {
+		t.Error("Expected tampered payload to fail authentication")
+	}
+
+	// Records sealed with a key that isn't loaded can't be opened
+	other, _ := parseKeyRing("k2:" + testKeyBase64)
+	sealed, _ = other.seal([]byte("data"))
+	if _, err := ring.open(sealed); !errors.Is(err, errUnknownKey) {
+		t.Errorf("open() error = %v, want errUnknownKey", err)
+	}
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "encryption-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	keyFile := filepath.Join(tmpdir, "keys")
+	os.WriteFile(keyFile, []byte("file:"+testKeyHex+"\n"), 0600)
+	t.Setenv(EncryptionKeyEnv, "env:"+testKeyBase64)
+
+	// The key file takes precedence over the environment
+	ring, err := loadKeyRing(keyFile)
+	if err != nil || ring.active != "file" {
+		t.Errorf("loadKeyRing(file) = %v, %v; want key \"file\"", ring, err)
+	}
+	ring, err = loadKeyRing("")
+	if err != nil || ring.active != "env" {
+		t.Errorf("loadKeyRing(\"\") = %v, %v; want key \"env\"", ring, err)
+	}
+
+	t.Setenv(EncryptionKeyEnv, "")
+	if ring, err := loadKeyRing(""); ring != nil || err != nil {
+		t.Errorf("loadKeyRing without keys = %v, %v; want nil, nil", ring, err)
+	}
+	if _, err := loadKeyRing(filepath.Join(tmpdir, "missing")); err == nil {
+		t.Error("Expected an error for a missing key file")
+	}
+}
+
+func TestEncryptedBuffers(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "encryption-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	oldKeys, _ := parseKeyRing("k1:" + testKeyHex)
+	rotatedKeys, _ := parseKeyRing("k2:" + testKeyBase64 + "\nk1:" + testKeyHex)
+
+	openers := map[string]func(BufferOptions) (BufferInterface, error){
+		"circular": func(opts BufferOptions) (BufferInterface, error) {
+			return NewBufferWithOptions(filepath.Join(tmpdir, "buffer.log"), 1024*1024, opts)
+		},
+		"segment": func(opts BufferOptions) (BufferInterface, error) {
+			return NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1024*1024, opts)
+		},
+	}
+
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			// Plain records from before encryption was enabled stay readable
+			buf, err := open(BufferOptions{})
+			if err != nil {
+				t.Fatalf("Failed to create buffer: %v", err)
+			}
+			buf.Write([]byte("plain line\n"))
+			buf.Close()
+
+			buf, err = open(BufferOptions{Keys: oldKeys})
+			if err != nil {
+				t.Fatalf("Failed to reopen buffer: %v", err)
+			}
+			buf.Write([]byte("secret one\n"))
+			buf.Close()
+
+			// After rotating keys, records written with the old key still decrypt
+			buf, err = open(BufferOptions{Keys: rotatedKeys})
+			if err != nil {
+				t.Fatalf("Failed to reopen buffer: %v", err)
+			}
+			buf.Write([]byte("secret two\n"))
+
+			records, _, err := buf.ReadRecords(-1)
+			if err != nil {
+				t.Fatalf("ReadRecords failed: %v", err)
+			}
+			got := string(bytes.Join(records, nil))
+			if got != "plain line\nsecret one\nsecret two\n" {
+				t.Errorf("ReadRecords() = %q", got)
+			}
+			buf.Close()
+
+			// Without the keys the encrypted records stay pending instead of
+			// being skipped
+			buf, err = open(BufferOptions{})
+			if err != nil {
+				t.Fatalf("Failed to reopen buffer: %v", err)
+			}
+			defer buf.Close()
+			records, offset, err := buf.ReadRecords(-1)
+			if err != nil {
+				t.Fatalf("ReadRecords failed: %v", err)
+			}
+			if len(records) != 1 || string(records[0]) != "plain line\n" {
+				t.Errorf("ReadRecords() without keys = %q, want only the plain line", records)
+			}
+			if err := buf.Commit(offset); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			if _, _, err := buf.ReadRecords(-1); !errors.Is(err, errEncryptedRecord) {
+				t.Errorf("ReadRecords() without keys error = %v, want errEncryptedRecord", err)
+			}
+			if reports := buf.(DropReporter).TakeDrops(); len(reports) != 0 {
+				t.Errorf("Drop reports = %+v, want none", reports)
+			}
+		})
+	}
+
+	// The secrets must never reach the disk in plain text
+	filepath.Walk(tmpdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, _ := os.ReadFile(path)
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("%s contains plain text secrets", strings.TrimPrefix(path, tmpdir))
+		}
+		return nil
+	})
+}
+
+func TestReadableEncryptedRecords(t *testing.T) {
+	keys, _ := parseKeyRing("k1:" + testKeyHex)
+	codec := recordCodec{keys: keys}
+	payload, flags, err := codec.encode([]byte("secret"))
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	// A record that fails authentication is corrupt and skipped
+	tampered := record{payload: bytes.Clone(payload), flags: flags}
+	tampered.payload[len(tampered.payload)-1] ^= 0xff
+	if _, dropped, err := codec.readable(tampered); dropped != DropReasonUnreadable || err != nil {
+		t.Errorf("readable() of a tampered record = %q, %v, want it skipped as unreadable", dropped, err)
+	}
+
+	// A record whose key isn't loaded is intact and must not be skipped
+	other, _ := parseKeyRing("k2:" + testKeyBase64)
+	for _, c := range []recordCodec{{}, {keys: other}} {
+		_, dropped, err := c.readable(record{payload: payload, flags: flags})
+		if dropped != "" || !(errors.Is(err, errEncryptedRecord) || errors.Is(err, errUnknownKey)) {
+			t.Errorf("readable() without the key = %q, %v, want a missing key error", dropped, err)
+		}
+	}
+}
+
+func TestMissingKeyKeepsRecords(t *testing.T) {
+	tmpdir := t.TempDir()
+	keys, _ := parseKeyRing("k1:" + testKeyHex)
+	otherKeys, _ := parseKeyRing("k2:" + testKeyBase64)
+
+	openers := map[string]func(BufferOptions) (BufferInterface, error){
+		"circular": func(opts BufferOptions) (BufferInterface, error) {
+			return NewBufferWithOptions(filepath.Join(tmpdir, "buffer.log"), 1024*1024, opts)
+		},
+		"segment": func(opts BufferOptions) (BufferInterface, error) {
+			return NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1024*1024, opts)
+		},
+	}
+
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			buf, err := open(BufferOptions{})
+			if err != nil {
+				t.Fatalf("Failed to create buffer: %v", err)
+			}
+			buf.Write([]byte("plain line\n"))
+			buf.Close()
+			if buf, err = open(BufferOptions{Keys: keys}); err != nil {
+				t.Fatalf("Failed to reopen buffer: %v", err)
+			}
+			buf.Write([]byte("secret\n"))
+			buf.Close()
+
+			// Without its key, or with only a newer one, the encrypted
+			// record stops delivery rather than being dropped
+			for i, opts := range []BufferOptions{{}, {Keys: otherKeys}} {
+				if buf, err = open(opts); err != nil {
+					t.Fatalf("Failed to reopen buffer: %v", err)
+				}
+				if i == 0 {
+					if data, err := buf.Read(1 << 20); err != nil || string(data) != "plain line\n" {
+						t.Errorf("Read returned %q, %v, want the plain line", data, err)
+					}
+				}
+				if data, err := buf.Read(1 << 20); err == nil || len(data) != 0 {
+					t.Errorf("Read returned %q, %v, want an error for the missing key", data, err)
+				}
+				if !buf.HasData() {
+					t.Error("The encrypted record should stay pending")
+				}
+				if reports := buf.(DropReporter).TakeDrops(); len(reports) != 0 {
+					t.Errorf("Drop reports = %+v, want none", reports)
+				}
+				buf.Close()
+			}
+
+			// Once the key is provided, the record is delivered
+			if buf, err = open(BufferOptions{Keys: keys}); err != nil {
+				t.Fatalf("Failed to reopen buffer: %v", err)
+			}
+			defer buf.Close()
+			if data, err := buf.Read(1 << 20); err != nil || string(data) != "secret\n" {
+				t.Errorf("Read returned %q, %v, want the secret", data, err)
+			}
+		})
+	}
+}
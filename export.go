@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	shipPollInterval        = 100 * time.Millisecond // How often ship checks whether the archive has been delivered
+	DefaultShipStallTimeout = 5 * time.Minute        // How long ship waits for delivery to make progress
+)
+
+// runExport implements "log_fwd buffer export"
+func runExport(args []string, stdout, stderr io.Writer) int {
+	fs := newCommandFlags("export", `Usage: log_fwd buffer export [options] <buffer path>
+
+Writes the pending records of a buffer to an archive that can be loaded on
+another host with "log_fwd buffer import" or "log_fwd buffer ship". The
+buffer is only read, so its records stay pending.
+`, stderr)
+	bufferType := fs.String("type", "", "Buffer type: file or segment (detected from the path if not set)")
+	keyFile := fs.String("encryption-key-file", "", "File with the buffer encryption keys (or set "+EncryptionKeyEnv+")")
+	output := fs.String("o", "-", "Archive file to write, - for stdout")
+	compress := fs.Bool("gzip", false, "Gzip the archive (the default for -o files ending in .gz)")
+	if code, ok := parseCommandFlags(fs, args, 1); !ok {
+		return code
+	}
+	path := fs.Arg(0)
+
+	stats := bufferStats{Path: path, Type: *bufferType}
+	codec, err := readOnlyCodec(path, &stats.Type, *keyFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	out := stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: failed to create archive: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	hostname, _ := os.Hostname()
+	archive, err := newArchiveWriter(out, *compress || strings.HasSuffix(*output, ".gz"), archiveHeader{
+		Host:       hostname,
+		Buffer:     path,
+		BufferType: stats.Type,
+	})
+	if err == nil {
+		err = walkBuffer(path, &stats, func(offset int64, rec record) error {
+			data, err := codec.decode(rec)
+			if err != nil {
+				fmt.Fprintf(stderr, "Warning: skipping unreadable record at offset %d: %v\n", offset, err)
+				stats.UnreadableRecords++
+				return nil
+			}
+			return archive.write(data)
+		})
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if file, ok := out.(*os.File); ok && err == nil && *output != "-" {
+		err = file.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		if *output != "-" {
+			os.Remove(*output)
+		}
+		return 1
+	}
+
+	fmt.Fprintf(stderr, "Exported %d records from %s", archive.records, path)
+	if stats.UnreadableRecords > 0 {
+		fmt.Fprintf(stderr, " (%d unreadable records skipped)", stats.UnreadableRecords)
+	}
+	fmt.Fprintln(stderr)
+	return 0
+}
+
+// openArchiveInput opens an archive file for reading, or stdin for "-"
+func openArchiveInput(path string) (*archiveReader, io.Closer, error) {
+	if path == "-" {
+		archive, err := openArchive(os.Stdin)
+		return archive, io.NopCloser(nil), err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	archive, err := openArchive(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return archive, file, nil
+}
+
+// runImport implements "log_fwd buffer import"
+func runImport(args []string, stdout, stderr io.Writer) int {
+	fs := newCommandFlags("import", `Usage: log_fwd buffer import [options] <archive> <buffer path>
+
+Appends the records of an archive written by "log_fwd buffer export" to a
+buffer, which log_fwd forwards once it is started with that buffer. Stop any
+log_fwd using the buffer first. Use - to read the archive from stdin.
+`, stderr)
+	bufferType := fs.String("type", BufferTypeFile, "Buffer type: file or segment")
+	maxSize := fs.Int64("maxsize", DefaultMaxSize, "Maximum buffer size in bytes")
+	segmentSize := fs.Int64("segment-size", DefaultSegmentSize, "Segment size in bytes for the segment buffer")
+	keyFile := fs.String("encryption-key-file", "", "File with keys for encrypting the buffer (or set "+EncryptionKeyEnv+")")
+	compression := fs.String("buffer-compression", CompressionNone, "Compression of logs stored in the buffer: none, gzip or dict")
+	if code, ok := parseCommandFlags(fs, args, 2); !ok {
+		return code
+	}
+	if *bufferType == BufferTypeMemory {
+		fmt.Fprintf(stderr, "Error: can't import into a memory buffer\n")
+		return 2
+	}
+
+	archive, closer, err := openArchiveInput(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer closer.Close()
+
+	// Imported records must not push out records already in the buffer
+	cfg := &Config{
+		BufferType:        *bufferType,
+		BufferPath:        fs.Arg(1),
+		MaxSize:           *maxSize,
+		SegmentSize:       *segmentSize,
+		OverflowPolicy:    OverflowDropNewest,
+		SyncPolicy:        SyncBytes,
+		SyncBytes:         DefaultSyncBytes,
+		EncryptionKeyFile: *keyFile,
+		BufferCompression: *compression,
+	}
+	buffer, err := openBuffer(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var imported int64
+	for err == nil {
+		var data []byte
+		if data, err = archive.next(); err == nil {
+			if _, err = buffer.Write(data); err == nil {
+				imported++
+			}
+		}
+	}
+	if errors.Is(err, ErrBufferFull) {
+		err = fmt.Errorf("buffer is full after importing %d records, raise -maxsize", imported)
+	}
+	if closeErr := buffer.Close(); err == io.EOF {
+		err = closeErr
+	}
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stderr, "Imported %d records exported from %s on %s\n", imported, archive.header.Host, archive.header.ExportedAt)
+	return 0
+}
+
+// runShip implements "log_fwd buffer ship"
+func runShip(args []string, stdout, stderr io.Writer) int {
+	fs := newCommandFlags("ship", `Usage: log_fwd buffer ship [options] <archive>
+
+Sends the records of an archive written by "log_fwd buffer export" straight
+to the log service. Use - to read the archive from stdin.
+`, stderr)
+	cfg := &Config{}
+	fs.StringVar(&cfg.Host, "host", "", "Log destination host")
+	fs.IntVar(&cfg.Port, "port", 443, "Port for log destination")
+	fs.StringVar(&cfg.AuthToken, "token", "", "Authorization token")
+	fs.StringVar(&cfg.CertFile, "cert", "", "Path to certificate bundle (optional, uses system certs if not provided)")
+	fs.BoolVar(&cfg.InsecureSSL, "k", false, "Allow insecure SSL connections (skip certificate validation)")
+	fs.IntVar(&cfg.BatchSize, "batch", DefaultBatchSize, "Number of log entries to batch in a single request")
+	fs.BoolVar(&cfg.EnableBatching, "enable-batch", true, "Enable log batching")
+	fs.IntVar(&cfg.MaxRetries, "retries", DefaultMaxRetries, "Maximum number of retries for logs rejected by the service (4xx)")
+	stallTimeout := fs.Duration("stall-timeout", DefaultShipStallTimeout, "Give up once no logs could be delivered for this long (0 to keep retrying)")
+	fs.DurationVar(&cfg.HTTPTimeout, "timeout", DefaultHTTPTimeout, "Overall HTTP client timeout")
+	fs.DurationVar(&cfg.RequestTimeout, "req-timeout", DefaultRequestTimeout, "Per-request timeout")
+	fs.BoolVar(&cfg.CompressLogs, "compress", false, "Compress logs using gzip before sending")
+	if code, ok := parseCommandFlags(fs, args, 1); !ok {
+		return code
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 2
+	}
+
+	archive, closer, err := openArchiveInput(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer closer.Close()
+
+	client, err := NewClient(cfg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	shipped, err := shipArchive(ctx, client, archive, *stallTimeout)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v (%d records shipped)\n", err, shipped)
+		return 1
+	}
+	fmt.Fprintf(stderr, "Shipped %d records exported from %s on %s\n", shipped, archive.header.Host, archive.header.ExportedAt)
+	return 0
+}
+
+// shipArchive sends every record of an archive through the client, returning
+// once all of them have been delivered (or given up on, see SendLogs). Since
+// SendLogs retries transient failures forever, it gives up once no record was
+// delivered for stallTimeout, unless that is 0.
+func shipArchive(ctx context.Context, client *HTTPClient, archive *archiveReader, stallTimeout time.Duration) (int64, error) {
+	buffer := &archiveBuffer{archive: archive}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.SendLogs(ctx, buffer, make(chan struct{}))
+	}()
+
+	ticker := time.NewTicker(shipPollInterval)
+	defer ticker.Stop()
+	var stalled error
+	shipped, progressed := buffer.committed(), time.Now()
+	for buffer.HasData() && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+		if n := buffer.committed(); n != shipped {
+			shipped, progressed = n, time.Now()
+		} else if stallTimeout > 0 && time.Since(progressed) >= stallTimeout {
+			stalled = fmt.Errorf("no logs could be delivered for %v", stallTimeout)
+			break
+		}
+	}
+	interrupted := ctx.Err()
+	cancel()
+	<-done
+
+	switch {
+	case stalled != nil:
+		return buffer.committed(), stalled
+	case interrupted != nil:
+		return buffer.committed(), errors.New("interrupted")
+	}
+	return buffer.committed(), buffer.readErr()
+}
+
+// archiveBuffer feeds the records of an archive to SendLogs. Records are read
+// from the archive as needed and kept until they are committed, so an archive
+// larger than memory can be shipped.
+type archiveBuffer struct {
+	mutex   sync.Mutex
+	archive *archiveReader
+	pending [][]byte // Records read but not committed yet
+	base    int64    // Number of records committed so far
+	eof     bool
+	err     error // Error that ended reading the archive
+}
+
+// fill reads records from the archive until n are pending; the caller must hold the mutex
+func (ab *archiveBuffer) fill(n int) {
+	for len(ab.pending) < n && !ab.eof {
+		data, err := ab.archive.next()
+		if err != nil {
+			ab.eof = true
+			if err != io.EOF {
+				ab.err = err
+			}
+			return
+		}
+		ab.pending = append(ab.pending, data)
+	}
+}
+
+// ReadRecords returns up to maxRecords records; offsets count records
+func (ab *archiveBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	ab.fill(maxRecords)
+	if len(ab.pending) == 0 {
+		return nil, 0, io.EOF
+	}
+	n := len(ab.pending)
+	if n > maxRecords {
+		n = maxRecords
+	}
+	return append([][]byte(nil), ab.pending[:n]...), ab.base + int64(n), nil
+}
+
+// Commit drops the records before offset
+func (ab *archiveBuffer) Commit(offset int64) error {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+
+	n := offset - ab.base
+	if n <= 0 {
+		return nil
+	}
+	if n > int64(len(ab.pending)) {
+		return fmt.Errorf("commit offset %d is beyond read records", offset)
+	}
+	ab.pending = ab.pending[n:]
+	ab.base = offset
+	return nil
+}
+
+// HasData reports whether any records are left to deliver
+func (ab *archiveBuffer) HasData() bool {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	ab.fill(1)
+	return len(ab.pending) > 0
+}
+
+// GetSize returns the size of the records read but not committed yet
+func (ab *archiveBuffer) GetSize() int64 {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	var size int64
+	for _, data := range ab.pending {
+		size += int64(len(data))
+	}
+	return size
+}
+
+// committed returns the number of records delivered so far
+func (ab *archiveBuffer) committed() int64 {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	return ab.base
+}
+
+// readErr returns the error that stopped reading the archive, if any
+func (ab *archiveBuffer) readErr() error {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	return ab.err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "export-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	keys, _ := parseKeyRing("k1:" + testKeyHex)
+	source := filepath.Join(tmpdir, "source.log")
+	buf, err := NewBufferWithOptions(source, 1024*1024, BufferOptions{Keys: keys, Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	lines := []string{"delivered\n", "pending one\n", strings.Repeat("pending two ", 20) + "\n"}
+	fillBuffer(t, buf, lines, 1)
+
+	keyFile := filepath.Join(tmpdir, "keys")
+	os.WriteFile(keyFile, []byte("k1:"+testKeyHex+"\n"), 0600)
+	archivePath := filepath.Join(tmpdir, "backlog.ndjson.gz")
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"export", "-encryption-key-file", keyFile, "-o", archivePath, source}
+	if code := runBufferCommand(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("export exited with %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Exported 2 records") {
+		t.Errorf("Unexpected export output %q", stderr.String())
+	}
+
+	// Export leaves the source buffer untouched
+	reopened, err := NewBufferWithOptions(source, 1024*1024, BufferOptions{Keys: keys})
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	if records, _, _ := reopened.ReadRecords(-1); len(records) != 2 {
+		t.Errorf("Source buffer holds %d records after export, want 2", len(records))
+	}
+	reopened.Close()
+
+	// Import appends to whatever is already in the target buffer
+	target := filepath.Join(tmpdir, "wal")
+	existing, err := NewSegmentBuffer(target, 1024*1024, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	fillBuffer(t, existing, []string{"already here\n"}, 0)
+
+	stderr.Reset()
+	if code := runBufferCommand([]string{"import", "-type", "segment", archivePath, target}, &stdout, &stderr); code != 0 {
+		t.Fatalf("import exited with %d: %s", code, stderr.String())
+	}
+
+	imported, err := NewSegmentBuffer(target, 1024*1024, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open imported buffer: %v", err)
+	}
+	defer imported.Close()
+	records, _, err := imported.ReadRecords(-1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if got, want := string(bytes.Join(records, nil)), "already here\n"+lines[1]+lines[2]; got != want {
+		t.Errorf("Imported buffer holds %q, want %q", got, want)
+	}
+
+	// An import that doesn't fit fails instead of dropping records
+	stderr.Reset()
+	small := filepath.Join(tmpdir, "small.log")
+	if code := runBufferCommand([]string{"import", "-maxsize", "100", archivePath, small}, &stdout, &stderr); code != 1 {
+		t.Errorf("import into a small buffer exited with %d: %s", code, stderr.String())
+	}
+}
+
+func TestShipArchive(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		delivered = append(delivered, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	tmpdir, err := os.MkdirTemp("", "export-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	archivePath := filepath.Join(tmpdir, "backlog.ndjson")
+	file, _ := os.Create(archivePath)
+	aw, _ := newArchiveWriter(file, false, archiveHeader{Host: "old-host"})
+	for i := 0; i < 25; i++ {
+		aw.write([]byte("shipped line\n"))
+	}
+	aw.Close()
+	file.Close()
+
+	u, _ := url.Parse(server.URL)
+	var stdout, stderr bytes.Buffer
+	args := []string{"ship", "-host", u.Hostname(), "-port", u.Port(), "-token", "test-token", "-k", "-batch", "10", archivePath}
+	if code := runBufferCommand(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("ship exited with %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Shipped 25 records exported from old-host") {
+		t.Errorf("Unexpected ship output %q", stderr.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Count(strings.Join(delivered, ""), "shipped line"); got != 25 {
+		t.Errorf("Log service received %d lines, want 25", got)
+	}
+
+	if code := runBufferCommand([]string{"ship", archivePath}, &stdout, &stderr); code != 2 {
+		t.Errorf("ship without a host exited with %d, want 2", code)
+	}
+
+	// During an outage ship gives up instead of retrying forever
+	down := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	u, _ = url.Parse(down.URL)
+	stderr.Reset()
+	args = []string{"ship", "-host", u.Hostname(), "-port", u.Port(), "-token", "test-token", "-k", "-stall-timeout", "300ms", archivePath}
+	if code := runBufferCommand(args, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "no logs could be delivered") {
+		t.Errorf("ship during an outage exited with %d: %s", code, stderr.String())
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fair queuing
+//
+// A FairBuffer splits logs across a fixed number of buffers ("partitions")
+// by hashing a source key, such as the program name or a field of the line.
+// Each partition has its own size cap, so a chatty source can only overwrite
+// its own logs, and reads take turns between the partitions holding data, so
+// a backlog of one source doesn't hold back the others. Sources hashed to the
+// same partition share it, as in stochastic fair queuing; more partitions
+// make that less likely.
+//
+// Like priority lanes, a read only ever returns records of one partition, so
+// the offset handed to Commit carries the partition index in its low bits.
+const (
+	partitionBits         = 8
+	maxPartitions         = 1 << partitionBits
+	DefaultFairPartitions = 8
+)
+
+// Source keys selectable with -fair-key, besides field:NAME
+const (
+	SourceKeyProgram = "program" // The program name of the input
+	SourceKeyPath    = "path"    // The file an input reads, or its program name if it doesn't read a file
+)
+
+// logSource describes the input a line was read from
+type logSource struct {
+	Program string // Program name of the input
+	Path    string // File the input reads, if any
+}
+
+// sourceKey selects what fair queuing partitions logs by, as given with -fair-key
+type sourceKey struct {
+	spec  string
+	field *regexp.Regexp // Finds the value of the field for field:NAME
+}
+
+// String implements flag.Value
+func (k *sourceKey) String() string {
+	return k.spec
+}
+
+// Set implements flag.Value
+func (k *sourceKey) Set(spec string) error {
+	switch {
+	case spec == SourceKeyProgram, spec == SourceKeyPath:
+		*k = sourceKey{spec: spec}
+	case strings.HasPrefix(spec, "field:") && len(spec) > len("field:"):
+		// name=value, name: value or "name": "value"
+		name := regexp.QuoteMeta(strings.TrimPrefix(spec, "field:"))
+		pattern, err := regexp.Compile(`(?:^|[^\w.-])"?` + name + `"?\s*[:=]\s*(?:"([^"]*)"|([^\s,;}"]+))`)
+		if err != nil {
+			return fmt.Errorf("invalid source key %q: %w", spec, err)
+		}
+		*k = sourceKey{spec: spec, field: pattern}
+	default:
+		return fmt.Errorf("source key %q must be program, path or field:NAME", spec)
+	}
+	return nil
+}
+
+// isSet reports whether a source key was given
+func (k sourceKey) isSet() bool {
+	return k.spec != ""
+}
+
+// of returns the key of a line read from src. Lines without the field, and
+// inputs that don't read a file, fall back to the program name.
+func (k sourceKey) of(src logSource, line []byte) string {
+	switch {
+	case k.field != nil:
+		if m := k.field.FindSubmatch(line); m != nil {
+			return string(m[1]) + string(m[2])
+		}
+	case k.spec == SourceKeyPath && src.Path != "":
+		return src.Path
+	}
+	return src.Program
+}
+
+// weightFlags collects repeated -fair-weight flags
+type weightFlags map[string]int
+
+// String implements flag.Value
+func (f *weightFlags) String() string {
+	weights := make([]string, 0, len(*f))
+	for key, weight := range *f {
+		weights = append(weights, key+"="+strconv.Itoa(weight))
+	}
+	sort.Strings(weights)
+	return strings.Join(weights, ",")
+}
+
+// Set implements flag.Value
+func (f *weightFlags) Set(spec string) error {
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 {
+		return fmt.Errorf("fair queuing weight %q must be KEY=WEIGHT", spec)
+	}
+	weight, err := strconv.Atoi(spec[i+1:])
+	if err != nil || weight < 1 {
+		return fmt.Errorf("fair queuing weight %q must be a positive number", spec[i+1:])
+	}
+	if *f == nil {
+		*f = weightFlags{}
+	}
+	(*f)[spec[:i]] = weight
+	return nil
+}
+
+// partitionPath returns the path of a partition's buffer: log_fwd_buffer.log
+// becomes log_fwd_buffer-source-3.log
+func partitionPath(bufferPath string, partition int) string {
+	return programBufferPath(bufferPath, "source-"+strconv.Itoa(partition))
+}
+
+// bufferPartition is one of the buffers of a FairBuffer
+type bufferPartition struct {
+	buffer BufferInterface
+	weight int // Batches delivered from the partition per turn
+}
+
+// FairBuffer implements fair queuing on top of other buffers
+type FairBuffer struct {
+	key        sourceKey
+	partitions []bufferPartition
+	mutex      sync.Mutex // Guards the turn
+	current    int        // Partition whose turn it is
+	served     int        // Batches committed from the current partition this turn
+}
+
+// NewFairBuffer combines buffers into fair queuing partitions. Sources with a
+// weight get that many batches delivered per turn instead of one; sources
+// sharing a partition share the highest of their weights.
+func NewFairBuffer(key sourceKey, weights map[string]int, buffers []BufferInterface) (*FairBuffer, error) {
+	if len(buffers) == 0 || len(buffers) > maxPartitions {
+		return nil, fmt.Errorf("fair queuing needs between 1 and %d partitions", maxPartitions)
+	}
+
+	fb := &FairBuffer{key: key}
+	for _, buffer := range buffers {
+		fb.partitions = append(fb.partitions, bufferPartition{buffer: buffer, weight: 1})
+	}
+	for source, weight := range weights {
+		p := &fb.partitions[fb.partition(source)]
+		p.weight = max(p.weight, weight)
+	}
+	return fb, nil
+}
+
+// openFairQueue opens a buffer for each fair queuing partition next to the
+// buffer path
+func openFairQueue(cfg *Config, opts BufferOptions) (*FairBuffer, error) {
+	var buffers []BufferInterface
+	closeAll := func() {
+		for _, buffer := range buffers {
+			buffer.Close()
+		}
+	}
+
+	size := cfg.FairPartitionSize
+	if size == 0 {
+		size = cfg.MaxSize / int64(cfg.FairPartitions)
+	}
+	for i := 0; i < cfg.FairPartitions; i++ {
+		partOpts := opts
+		if opts.SpillPath != "" {
+			partOpts.SpillPath = partitionPath(opts.SpillPath, i)
+		}
+		buffer, err := openBufferAt(cfg.BufferType, partitionPath(cfg.BufferPath, i), size, partOpts)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("partition %d: %w", i, err)
+		}
+		buffers = append(buffers, buffer)
+	}
+
+	fb, err := NewFairBuffer(cfg.FairKey, cfg.FairWeights, buffers)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return fb, nil
+}
+
+// partition returns the partition of a source key
+func (fb *FairBuffer) partition(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(fb.partitions)))
+}
+
+// write stores a line read from src in its partition
+func (fb *FairBuffer) write(src logSource, data []byte) (int, error) {
+	return fb.partitions[fb.partition(fb.key.of(src, data))].buffer.Write(data)
+}
+
+// Write stores data in the partition of its source key, keying lines without
+// a known input by their field or an empty program name
+func (fb *FairBuffer) Write(data []byte) (int, error) {
+	return fb.write(logSource{}, data)
+}
+
+// writeBatch stores lines read from src in their partitions
+func (fb *FairBuffer) writeBatch(src logSource, data [][]byte) (int, error) {
+	return writeRuns(data, func(d []byte) BufferInterface {
+		return fb.partitions[fb.partition(fb.key.of(src, d))].buffer
+	})
+}
+
+// WriteBatch stores each record in the partition of its source key, like Write
+func (fb *FairBuffer) WriteBatch(data [][]byte) (int, error) {
+	return fb.writeBatch(logSource{}, data)
+}
+
+// next reads from the first partition holding data, starting with the one
+// whose turn it is, and makes it the current one
+func (fb *FairBuffer) next(read func(p bufferPartition) error) (int, error) {
+	for n := range fb.partitions {
+		i := (fb.current + n) % len(fb.partitions)
+		err := read(fb.partitions[i])
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("partition %d: %w", i, err)
+		}
+		if i != fb.current {
+			fb.current, fb.served = i, 0
+		}
+		return i, nil
+	}
+	return 0, io.EOF
+}
+
+// serve counts a batch delivered from a partition, passing the turn on once
+// the partition has had its share
+func (fb *FairBuffer) serve(partition int) {
+	if partition != fb.current {
+		return
+	}
+	fb.served++
+	if fb.served >= fb.partitions[partition].weight {
+		fb.current, fb.served = (partition+1)%len(fb.partitions), 0
+	}
+}
+
+// Read reads and consumes records from the partition whose turn it is
+func (fb *FairBuffer) Read(maxBytes int64) ([]byte, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+
+	var data []byte
+	i, err := fb.next(func(p bufferPartition) error {
+		if !p.buffer.HasData() {
+			return io.EOF
+		}
+		var err error
+		data, err = p.buffer.Read(maxBytes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fb.serve(i)
+	return data, nil
+}
+
+// ReadRecords returns records from the partition whose turn it is, without
+// consuming them. The returned offset identifies the partition as well.
+func (fb *FairBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+
+	var records [][]byte
+	var offset int64
+	i, err := fb.next(func(p bufferPartition) error {
+		var err error
+		records, offset, err = p.buffer.ReadRecords(maxRecords)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, offset<<partitionBits | int64(i), nil
+}
+
+// Commit consumes the records of a partition up to an offset returned by
+// ReadRecords
+func (fb *FairBuffer) Commit(offset int64) error {
+	i := int(offset & (maxPartitions - 1))
+	if offset < 0 || i >= len(fb.partitions) {
+		return fmt.Errorf("commit offset %d doesn't belong to a partition", offset)
+	}
+	if err := fb.partitions[i].buffer.Commit(offset >> partitionBits); err != nil {
+		return err
+	}
+
+	fb.mutex.Lock()
+	fb.serve(i)
+	fb.mutex.Unlock()
+	return nil
+}
+
+// Sync flushes the writes of all partitions to disk
+func (fb *FairBuffer) Sync() error {
+	var errs []error
+	for _, p := range fb.partitions {
+		if syncable, ok := p.buffer.(Syncable); ok {
+			errs = append(errs, syncable.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TakeDrops returns the drops of all partitions, naming the partition
+func (fb *FairBuffer) TakeDrops() []DropReport {
+	var reports []DropReport
+	for i, p := range fb.partitions {
+		reporter, ok := p.buffer.(DropReporter)
+		if !ok {
+			continue
+		}
+		for _, report := range reporter.TakeDrops() {
+			report.Reason += fmt.Sprintf(" in source partition %d", i)
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// HasData returns true if any partition holds data
+func (fb *FairBuffer) HasData() bool {
+	for _, p := range fb.partitions {
+		if p.buffer.HasData() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSize returns the total size of all partitions
+func (fb *FairBuffer) GetSize() int64 {
+	var size int64
+	for _, p := range fb.partitions {
+		size += p.buffer.GetSize()
+	}
+	return size
+}
+
+// Close closes all partitions, returning the errors
+func (fb *FairBuffer) Close() error {
+	var errs []error
+	for i, p := range fb.partitions {
+		if err := p.buffer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sourceBuffer is what an input writes to: a FairBuffer that knows where its
+// lines come from
+type sourceBuffer struct {
+	*FairBuffer
+	source logSource
+}
+
+// Write stores data in the partition of the input's source key
+func (sb sourceBuffer) Write(data []byte) (int, error) {
+	return sb.write(sb.source, data)
+}
+
+// WriteBatch stores each record in the partition of the input's source key
+func (sb sourceBuffer) WriteBatch(data [][]byte) (int, error) {
+	return sb.writeBatch(sb.source, data)
+}
+
+// bufferForSource returns the buffer an input reading from src writes to
+func bufferForSource(buffer BufferInterface, src logSource) BufferInterface {
+	if fb, ok := buffer.(*FairBuffer); ok {
+		return sourceBuffer{FairBuffer: fb, source: src}
+	}
+	return buffer
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceKey(t *testing.T) {
+	src := logSource{Program: "web", Path: "/var/log/web/access.log"}
+	tests := []struct {
+		spec string
+		line string
+		want string
+	}{
+		{"program", `anything`, "web"},
+		{"path", `anything`, "/var/log/web/access.log"},
+		{"field:tenant", `{"level":"info","tenant":"acme","msg":"hi"}`, "acme"},
+		{"field:tenant", `{"tenant": "big corp"}`, "big corp"},
+		{"field:tenant", `level=info tenant=acme msg=hi`, "acme"},
+		{"field:tenant", `level=info subtenant=acme`, "web"}, // Only whole field names count
+		{"field:tenant", `no fields here`, "web"},
+	}
+	for _, tt := range tests {
+		var key sourceKey
+		if err := key.Set(tt.spec); err != nil {
+			t.Fatalf("Set(%q) failed: %v", tt.spec, err)
+		}
+		if got := key.of(src, []byte(tt.line)); got != tt.want {
+			t.Errorf("%s key of %q = %q, want %q", tt.spec, tt.line, got, tt.want)
+		}
+	}
+
+	// Inputs that don't read a file are keyed by program for path
+	var key sourceKey
+	key.Set("path")
+	if got := key.of(logSource{Program: "stdin-app"}, []byte("x")); got != "stdin-app" {
+		t.Errorf("path key without a path = %q, want the program name", got)
+	}
+
+	for _, spec := range []string{"", "host", "field:"} {
+		if err := key.Set(spec); err == nil {
+			t.Errorf("Set(%q) should fail", spec)
+		}
+	}
+}
+
+func TestWeightFlags(t *testing.T) {
+	var weights weightFlags
+	for _, spec := range []string{"web=3", "a=b=2"} {
+		if err := weights.Set(spec); err != nil {
+			t.Fatalf("Set(%q) failed: %v", spec, err)
+		}
+	}
+	if weights["web"] != 3 || weights["a=b"] != 2 {
+		t.Errorf("weights = %v", weights)
+	}
+	if got := weights.String(); got != "a=b=2,web=3" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, spec := range []string{"web", "=2", "web=0", "web=x"} {
+		if err := weights.Set(spec); err == nil {
+			t.Errorf("Set(%q) should fail", spec)
+		}
+	}
+}
+
+// newTestFairBuffer creates a fair buffer keyed by program over memory
+// buffers, checking that the chatty and quiet sources get separate partitions
+func newTestFairBuffer(t *testing.T, partitions int, size int64, weights map[string]int) *FairBuffer {
+	t.Helper()
+	var buffers []BufferInterface
+	for i := 0; i < partitions; i++ {
+		buffer, err := NewMemoryBuffer(size, BufferOptions{})
+		if err != nil {
+			t.Fatalf("NewMemoryBuffer failed: %v", err)
+		}
+		buffers = append(buffers, buffer)
+	}
+
+	fb, err := NewFairBuffer(sourceKey{spec: SourceKeyProgram}, weights, buffers)
+	if err != nil {
+		t.Fatalf("NewFairBuffer failed: %v", err)
+	}
+	t.Cleanup(func() { fb.Close() })
+	if fb.partition("chatty") == fb.partition("quiet") {
+		t.Fatalf("chatty and quiet share partition %d", fb.partition("chatty"))
+	}
+	return fb
+}
+
+// writeLines writes n numbered lines from a program
+func writeLines(t *testing.T, buffer BufferInterface, program string, n int) {
+	t.Helper()
+	out := bufferForSource(buffer, logSource{Program: program})
+	for i := 0; i < n; i++ {
+		if _, err := out.Write([]byte(fmt.Sprintf("%s line %d\n", program, i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+}
+
+// drainBatches reads and commits batches, returning the program of each
+func drainBatches(t *testing.T, buffer BufferInterface, batchSize, batches int) []string {
+	t.Helper()
+	var programs []string
+	for len(programs) < batches {
+		records, offset, err := buffer.ReadRecords(batchSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		program, _, _ := strings.Cut(string(records[0]), " ")
+		for _, record := range records {
+			if !strings.HasPrefix(string(record), program+" ") {
+				t.Fatalf("Batch mixes sources: %q", records)
+			}
+		}
+		programs = append(programs, program)
+		if err := buffer.Commit(offset); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	return programs
+}
+
+func TestFairBufferTakesTurns(t *testing.T) {
+	fb := newTestFairBuffer(t, 4, 1<<20, nil)
+
+	// A backlog of the chatty source doesn't hold back the quiet one
+	writeLines(t, fb, "chatty", 100)
+	writeLines(t, fb, "quiet", 10)
+
+	got := drainBatches(t, fb, 5, 5)
+	want := []string{"chatty", "quiet", "chatty", "quiet", "chatty"}
+	if fb.partition("quiet") < fb.partition("chatty") {
+		want = []string{"quiet", "chatty", "quiet", "chatty", "chatty"}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Delivered batches from %v, want %v", got, want)
+	}
+
+	// Once the quiet source is drained the chatty one has every turn
+	got = drainBatches(t, fb, 5, 100)
+	if len(got) != 17 || strings.Contains(strings.Join(got, ","), "quiet") {
+		t.Errorf("Delivered the rest in batches from %v, want 17 chatty batches", got)
+	}
+	if fb.HasData() || fb.GetSize() != 0 {
+		t.Error("Buffer should be empty after draining every partition")
+	}
+	if err := fb.Commit(255); err == nil {
+		t.Error("Expected an error committing an offset of a partition that doesn't exist")
+	}
+}
+
+func TestFairBufferFailedSendKeepsTurn(t *testing.T) {
+	fb := newTestFairBuffer(t, 4, 1<<20, nil)
+	writeLines(t, fb, "chatty", 10)
+	writeLines(t, fb, "quiet", 10)
+
+	// Reading again without committing, as after a failed send, returns the
+	// same batch
+	first, _, err := fb.ReadRecords(5)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	again, _, err := fb.ReadRecords(5)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if string(first[0]) != string(again[0]) {
+		t.Errorf("Retried read returned %q, want %q", again[0], first[0])
+	}
+}
+
+func TestFairBufferWeights(t *testing.T) {
+	fb := newTestFairBuffer(t, 4, 1<<20, map[string]int{"chatty": 3})
+	writeLines(t, fb, "chatty", 100)
+	writeLines(t, fb, "quiet", 100)
+
+	counts := map[string]int{}
+	for _, program := range drainBatches(t, fb, 5, 8) {
+		counts[program]++
+	}
+	if counts["chatty"] != 6 || counts["quiet"] != 2 {
+		t.Errorf("First 8 batches came from %v, want 6 chatty and 2 quiet", counts)
+	}
+}
+
+func TestFairBufferPartitionCaps(t *testing.T) {
+	fb := newTestFairBuffer(t, 4, 1024, nil)
+
+	// The chatty source overwrites its own logs, not the quiet source's
+	writeLines(t, fb, "quiet", 3)
+	writeLines(t, fb, "chatty", 200)
+
+	var quiet int
+	for {
+		records, offset, err := fb.ReadRecords(100)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		for _, record := range records {
+			if strings.HasPrefix(string(record), "quiet ") {
+				quiet++
+			}
+		}
+		fb.Commit(offset)
+	}
+	if quiet != 3 {
+		t.Errorf("Delivered %d quiet lines, want all 3", quiet)
+	}
+
+	drops := fb.TakeDrops()
+	want := fmt.Sprintf("in source partition %d", fb.partition("chatty"))
+	if len(drops) != 1 || drops[0].Lines == 0 || !strings.HasSuffix(drops[0].Reason, want) {
+		t.Errorf("TakeDrops returned %+v, want drops %s", drops, want)
+	}
+}
+
+func TestOpenBufferWithFairQueue(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		BufferType:     BufferTypeFile,
+		BufferPath:     filepath.Join(dir, "buffer.log"),
+		MaxSize:        1 << 20,
+		FairKey:        sourceKey{spec: SourceKeyProgram},
+		FairPartitions: 2,
+	}
+
+	buffer, err := openBuffer(cfg)
+	if err != nil {
+		t.Fatalf("openBuffer failed: %v", err)
+	}
+	writeLines(t, buffer, "web", 1)
+	writeLines(t, buffer, "db", 1)
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, name := range []string{"buffer-source-0.log", "buffer-source-1.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected buffer file %s: %v", name, err)
+		}
+	}
+
+	// Every partition survives a restart
+	buffer, err = openBuffer(cfg)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	defer buffer.Close()
+	var data []byte
+	for buffer.HasData() {
+		chunk, err := buffer.Read(1024)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		data = append(data, chunk...)
+	}
+	if !strings.Contains(string(data), "web line 0\n") || !strings.Contains(string(data), "db line 0\n") {
+		t.Errorf("Read %q after reopening, want both lines", data)
+	}
+}
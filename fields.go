@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Inputs that know more about a line than its text, such as the file it was
+// read from, store it in the buffer as a tagged line: a JSON object of fields
+// between two ASCII record separators, followed by the line itself. The
+// separator can't appear in encoded JSON, and the buffers, archives and
+// exports handle tagged lines like any other record. On delivery the fields
+// are sent as part of the line's log entry, and a "dt" field, as sent by
+// shippers posting to the ingest endpoint, replaces the time of delivery.
+const fieldSeparator = '\x1e'
+
+// fieldsPrefix returns the prefix that tags lines with fields
+func fieldsPrefix(fields map[string]any) []byte {
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		// Fields are strings, numbers and decoded JSON, which always encode
+		panic(err)
+	}
+	prefix := make([]byte, 0, len(encoded)+2)
+	prefix = append(prefix, fieldSeparator)
+	prefix = append(prefix, encoded...)
+	return append(prefix, fieldSeparator)
+}
+
+// tagLine returns line tagged with a prefix from fieldsPrefix
+func tagLine(prefix, line []byte) []byte {
+	tagged := make([]byte, 0, len(prefix)+len(line))
+	return append(append(tagged, prefix...), line...)
+}
+
+// isTagged reports whether a record holds a tagged line
+func isTagged(record []byte) bool {
+	return len(record) > 0 && record[0] == fieldSeparator
+}
+
+// untaggedLine returns the text of a line from an input that doesn't tag its
+// lines, without the field separators it starts with, so that a writer can't
+// forge fields by making its line look tagged
+func untaggedLine(text []byte) []byte {
+	return bytes.TrimLeft(text, string(fieldSeparator))
+}
+
+// untagLine splits a line into its fields and text. Untagged lines, and
+// tagged lines whose fields can't be decoded, have no fields.
+func untagLine(line string) (map[string]any, string) {
+	if !isTagged([]byte(line)) {
+		return nil, line
+	}
+	end := strings.IndexByte(line[1:], fieldSeparator)
+	if end < 0 {
+		return nil, line
+	}
+	fields, err := decodeFields([]byte(line[1 : end+1]))
+	if err != nil {
+		return nil, line
+	}
+	return fields, line[end+2:]
+}
+
+// decodeFields decodes a JSON object of fields, keeping numbers as they were
+// written so that large integers such as IDs don't lose precision
+func decodeFields(data []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("expected a JSON object")
+	}
+	return fields, nil
+}
+
+// newLogEntry creates the log entry sent for a line read from the buffer
+func newLogEntry(line string) LogEntry {
+	fields, text := untagLine(line)
+	entry := LogEntry{
+		Timestamp: time.Now().UTC().Format(TimestampFormat),
+		Message:   extractMessage(strings.TrimSuffix(text, "\n")),
+		Fields:    fields,
+	}
+	if dt, ok := fields["dt"].(string); ok && dt != "" {
+		entry.Timestamp = dt
+	}
+	return entry
+}
+
+// line returns the entry as a tagged line for the buffer, keeping its
+// timestamp if it has one
+func (e LogEntry) line() []byte {
+	fields := make(map[string]any, len(e.Fields)+1)
+	for name, value := range e.Fields {
+		fields[name] = value
+	}
+	if e.Timestamp != "" {
+		fields["dt"] = e.Timestamp
+	}
+	return tagLine(fieldsPrefix(fields), []byte(e.Message+"\n"))
+}
+
+// UnmarshalJSON decodes an entry, keeping the fields next to its timestamp
+// and message. A message that isn't a string is kept as JSON text.
+func (e *LogEntry) UnmarshalJSON(data []byte) error {
+	fields, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+
+	*e = LogEntry{}
+	if dt, ok := fields["dt"]; ok {
+		if e.Timestamp, ok = dt.(string); !ok {
+			return errors.New("dt must be a string")
+		}
+		delete(fields, "dt")
+	}
+	if message, ok := fields["message"]; ok {
+		if e.Message, ok = message.(string); !ok {
+			text, err := json.Marshal(message)
+			if err != nil {
+				return err
+			}
+			e.Message = string(text)
+		}
+		delete(fields, "message")
+	}
+	if len(fields) > 0 {
+		e.Fields = fields
+	}
+	return nil
+}
+
+// MarshalJSON encodes the entry's fields next to its timestamp and message,
+// which take precedence over fields of the same name
+func (e LogEntry) MarshalJSON() ([]byte, error) {
+	type plain LogEntry
+	encoded, err := json.Marshal(plain(e))
+	if err != nil || len(e.Fields) == 0 {
+		return encoded, err
+	}
+
+	fields := make(map[string]any, len(e.Fields))
+	for name, value := range e.Fields {
+		if name != "dt" && name != "message" {
+			fields[name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return encoded, nil
+	}
+	extra, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Join the two objects: {"dt":...,"message":...,"field":...}
+	var joined bytes.Buffer
+	joined.Write(encoded[:len(encoded)-1])
+	joined.WriteByte(',')
+	joined.Write(extra[1:])
+	return joined.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTagLine(t *testing.T) {
+	prefix := fieldsPrefix(map[string]any{"file": map[string]any{"path": "/var/log/app.log"}})
+	line := tagLine(prefix, []byte("hello\n"))
+	if !isTagged(line) {
+		t.Fatalf("%q isn't tagged", line)
+	}
+
+	fields, text := untagLine(string(line))
+	if text != "hello\n" {
+		t.Errorf("untagLine returned text %q", text)
+	}
+	if path := fields["file"].(map[string]any)["path"]; path != "/var/log/app.log" {
+		t.Errorf("untagLine returned path %v", path)
+	}
+
+	// Untagged lines, and tags that can't be decoded, are left as they are
+	for _, line := range []string{"plain line\n", "\x1enot json\x1eline\n", "\x1eunterminated"} {
+		if fields, text := untagLine(line); fields != nil || text != line {
+			t.Errorf("untagLine(%q) = %v, %q", line, fields, text)
+		}
+	}
+}
+
+func TestUntaggedInputCantForgeFields(t *testing.T) {
+	forged := "\x1e\x1e{\"level\":\"audit\"}\x1eforged"
+
+	lines := make(chan []byte, 1)
+	if err := readLines(strings.NewReader(forged+"\n"), lines, nil); err != nil {
+		t.Fatalf("readLines failed: %v", err)
+	}
+	for _, line := range [][]byte{<-lines, socketLine(nil, []byte(forged))} {
+		if isTagged(line) {
+			t.Errorf("Untagged input %q was stored as a tagged line", line)
+		}
+		if fields, _ := untagLine(string(line)); fields != nil {
+			t.Errorf("Untagged input got fields %v", fields)
+		}
+	}
+
+	// Tagged inputs keep their own prefix in front of the text
+	prefix := fieldsPrefix(map[string]any{"peer": map[string]any{"pid": 1}})
+	if fields, text := untagLine(string(socketLine(prefix, []byte(forged)))); fields["level"] != nil || text != forged+"\n" {
+		t.Errorf("untagLine returned %v, %q", fields, text)
+	}
+}
+
+func TestLogEntryMarshalJSON(t *testing.T) {
+	entry := LogEntry{
+		Timestamp: "2024-05-01T10:00:00Z",
+		Message:   "hello",
+		Fields:    map[string]any{"file": map[string]any{"path": "/var/log/app.log"}, "message": "ignored"},
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	want := `{"dt":"2024-05-01T10:00:00Z","message":"hello","file":{"path":"/var/log/app.log"}}`
+	if string(data) != want {
+		t.Errorf("Marshal returned %s, want %s", data, want)
+	}
+
+	// Entries without fields are encoded as before
+	entry.Fields = nil
+	if data, _ := json.Marshal(entry); string(data) != `{"dt":"2024-05-01T10:00:00Z","message":"hello"}` {
+		t.Errorf("Marshal returned %s", data)
+	}
+}
+
+func TestReadPendingBatchKeepsTaggedLines(t *testing.T) {
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+	prefix := fieldsPrefix(map[string]any{"source": "test"})
+	buffer.Write(tagLine(prefix, []byte("first\nsecond\n")))
+	buffer.Write([]byte("third\nfourth\n"))
+
+	batch, err := readPendingBatch(buffer, 10)
+	if err != nil {
+		t.Fatalf("readPendingBatch failed: %v", err)
+	}
+	if len(batch.lines) != 3 {
+		t.Fatalf("Read lines %q, want the tagged record whole", batch.lines)
+	}
+	entry := newLogEntry(batch.lines[0])
+	if entry.Message != "first\nsecond" || entry.Fields["source"] != "test" {
+		t.Errorf("newLogEntry returned %+v", entry)
+	}
+}
+
+func TestLogEntryUnmarshalJSON(t *testing.T) {
+	var entry LogEntry
+	data := `{"dt":"2024-05-01T10:00:00Z","message":"hello","request_id":12345678901234567890,"user":{"name":"ada"}}`
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if entry.Timestamp != "2024-05-01T10:00:00Z" || entry.Message != "hello" || len(entry.Fields) != 2 {
+		t.Errorf("Unmarshal returned %+v", entry)
+	}
+
+	// The entry survives the buffer unchanged, large numbers included
+	if got, _ := json.Marshal(newLogEntry(string(entry.line()))); string(got) != `{"dt":"2024-05-01T10:00:00Z","message":"hello","request_id":12345678901234567890,"user":{"name":"ada"}}` {
+		t.Errorf("Entry came out of the buffer as %s", got)
+	}
+
+	// Messages that aren't strings are kept as JSON text
+	if err := json.Unmarshal([]byte(`{"message":{"a":1}}`), &entry); err != nil || entry.Message != `{"a":1}` || entry.Timestamp != "" {
+		t.Errorf("Unmarshal returned %+v, %v", entry, err)
+	}
+	for _, invalid := range []string{`{"dt":5}`, `[]`, `"text"`} {
+		if err := json.Unmarshal([]byte(invalid), &entry); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", invalid)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTP ingest
+//
+// The ingest endpoint lets applications and other shippers post logs to
+// log_fwd: a single JSON object, a JSON array of them (the LogBatch that
+// log_fwd itself sends), or NDJSON, optionally gzipped. Every entry is written
+// to the buffer and synced to disk before the response, whatever the -sync
+// policy, so a 2xx means the entries survive a crash. Concurrent requests
+// share their syncs through the buffer's group commit. A request is accepted
+// or rejected as a whole, except when the buffer fails part way through.
+
+const (
+	maxIngestBody         = 16 * 1024 * 1024 // Request bodies, after decompression
+	ingestShutdownTimeout = 5 * time.Second  // Time given to requests in flight on exit
+)
+
+// errIngestBodyTooLarge is returned for request bodies over maxIngestBody
+var errIngestBodyTooLarge = fmt.Errorf("request body is larger than %d bytes", maxIngestBody)
+
+// parseIngestBody decodes the log entries of a request body into lines for
+// the buffer: JSON objects, one after another as in NDJSON, or arrays of them
+func parseIngestBody(r io.Reader) ([][]byte, error) {
+	dec := json.NewDecoder(r)
+	var lines [][]byte
+	for {
+		var value json.RawMessage
+		err := dec.Decode(&value)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries := []json.RawMessage{value}
+		if bytes.HasPrefix(value, []byte("[")) {
+			if err := json.Unmarshal(value, &entries); err != nil {
+				return nil, err
+			}
+		}
+		for _, raw := range entries {
+			if !bytes.HasPrefix(raw, []byte("{")) {
+				return nil, fmt.Errorf("log entry %d is not a JSON object", len(lines)+1)
+			}
+			var entry LogEntry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return nil, fmt.Errorf("log entry %d: %w", len(lines)+1, err)
+			}
+			lines = append(lines, entry.line())
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no log entries")
+	}
+	return lines, nil
+}
+
+// limitedReader fails with errIngestBodyTooLarge instead of ending quietly
+// once a decompressed body exceeds its limit
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+// Read implements io.Reader
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, errIngestBodyTooLarge
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// ingestHandler serves the ingest endpoint
+type ingestHandler struct {
+	buffer BufferInterface
+	token  string
+	signal chan struct{}
+	cfg    *Config
+}
+
+// ingestResponse is the body of the ingest endpoint's responses
+type ingestResponse struct {
+	Accepted int    `json:"accepted"` // Entries written to the buffer
+	Error    string `json:"error,omitempty"`
+}
+
+// respond writes a JSON response
+func (h *ingestHandler) respond(w http.ResponseWriter, status, accepted int, err error) {
+	resp := ingestResponse{Accepted: accepted}
+	if err != nil {
+		resp.Error = err.Error()
+		debugf("Ingest request failed with %d: %v", status, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authorized checks the request's bearer token, if one is required
+func (h *ingestHandler) authorized(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// ServeHTTP implements http.Handler
+func (h *ingestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.respond(w, http.StatusMethodNotAllowed, 0, errors.New("logs must be POSTed"))
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="log_fwd"`)
+		h.respond(w, http.StatusUnauthorized, 0, errors.New("missing or invalid bearer token"))
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxIngestBody)
+	switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			h.respond(w, http.StatusBadRequest, 0, fmt.Errorf("invalid gzip body: %w", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		h.respond(w, http.StatusUnsupportedMediaType, 0, fmt.Errorf("unsupported content encoding %q", encoding))
+		return
+	}
+
+	lines, err := parseIngestBody(&limitedReader{r: body, left: maxIngestBody})
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, errIngestBodyTooLarge) || errors.As(err, &tooLarge):
+		h.respond(w, http.StatusRequestEntityTooLarge, 0, errIngestBodyTooLarge)
+		return
+	case err != nil:
+		h.respond(w, http.StatusBadRequest, 0, err)
+		return
+	}
+
+	written, err := h.write(r.Context(), lines)
+	if written > 0 {
+		// Only answer once the entries are on disk
+		if syncErr := h.sync(); syncErr != nil {
+			err = syncErr
+		}
+
+		// Signal new logs (non-blocking)
+		select {
+		case h.signal <- struct{}{}:
+		default:
+		}
+	}
+	switch {
+	case errors.Is(err, ErrBufferFull):
+		w.Header().Set("Retry-After", "1")
+		h.respond(w, http.StatusServiceUnavailable, written, err)
+	case err != nil:
+		h.respond(w, http.StatusInternalServerError, written, err)
+	default:
+		h.respond(w, http.StatusAccepted, written, nil)
+	}
+}
+
+// write writes lines to the buffer, returning how many were written. Under
+// the block overflow policy it waits for space like the other inputs, for as
+// long as the client waits.
+func (h *ingestHandler) write(ctx context.Context, lines [][]byte) (int, error) {
+	written := 0
+	for written < len(lines) {
+		n, err := h.buffer.WriteBatch(lines[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if !errors.Is(err, ErrBufferFull) || h.cfg.OverflowPolicy != OverflowBlock {
+			return written, err
+		}
+		if err := writeToBuffer(ctx, h.buffer, lines[written], h.signal, h.cfg); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// sync flushes the entries written to disk, if the buffer has a disk
+func (h *ingestHandler) sync() error {
+	if syncable, ok := h.buffer.(Syncable); ok {
+		return syncable.Sync()
+	}
+	return nil
+}
+
+// IngestServer accepts logs over HTTP
+type IngestServer struct {
+	listener net.Listener
+	token    string
+}
+
+// ListenIngest listens for ingest requests on addr. If token isn't empty,
+// requests must carry it as a bearer token.
+func ListenIngest(addr, token string) (*IngestServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return &IngestServer{listener: listener, token: token}, nil
+}
+
+// Serve writes the entries posted to the buffer until ctx is done, then lets
+// requests in flight finish
+func (s *IngestServer) Serve(ctx context.Context, buffer BufferInterface, programName string, signal chan struct{}, cfg *Config) {
+	server := &http.Server{
+		Handler: &ingestHandler{
+			buffer: bufferForSource(buffer, logSource{Program: programName}),
+			token:  s.token,
+			signal: signal,
+			cfg:    cfg,
+		},
+		ReadHeaderTimeout: DefaultRequestTimeout,
+	}
+
+	fmt.Fprintf(os.Stderr, "Listening for logs on http://%s\n", s.listener.Addr())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(s.listener)
+	}()
+
+	select {
+	case err := <-served:
+		fmt.Fprintf(os.Stderr, "Ingest server stopped: %v\n", err)
+		return
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ingestShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newIngestHandler returns an ingest handler writing to a memory buffer
+func newIngestHandler(t *testing.T, token string, opts BufferOptions) (*ingestHandler, *MemoryBuffer) {
+	t.Helper()
+	buffer, err := NewMemoryBuffer(1<<20, opts)
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	t.Cleanup(func() { buffer.Close() })
+	cfg := &Config{OverflowPolicy: opts.Overflow}
+	return &ingestHandler{buffer: buffer, token: token, signal: make(chan struct{}, 1), cfg: cfg}, buffer
+}
+
+// postIngest posts body to the handler and returns the response
+func postIngest(h http.Handler, body []byte, header http.Header) (*httptest.ResponseRecorder, ingestResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var resp ingestResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec, resp
+}
+
+func TestIngestFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"object", `{"message":"one"}`, []string{"one\n"}},
+		{"array", `[{"dt":"2024-05-01 10:00:00 UTC","message":"one"},{"dt":"2024-05-01 10:00:01 UTC","message":"two"}]`, []string{"one\n", "two\n"}},
+		{"ndjson", "{\"message\":\"one\"}\n{\"message\":\"two\"}\n\n{\"message\":\"three\"}\n", []string{"one\n", "two\n", "three\n"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h, buffer := newIngestHandler(t, "", BufferOptions{})
+			rec, resp := postIngest(h, []byte(tc.body), nil)
+			if rec.Code != http.StatusAccepted || resp.Accepted != len(tc.want) {
+				t.Fatalf("Response %d %+v, want %d accepted", rec.Code, resp, len(tc.want))
+			}
+			waitForLines(t, buffer, tc.want...)
+		})
+	}
+}
+
+func TestIngestKeepsEntries(t *testing.T) {
+	h, buffer := newIngestHandler(t, "", BufferOptions{})
+	body := `{"dt":"2024-05-01 10:00:00 UTC","message":"hello","level":"error","order_id":9007199254740993}`
+	if rec, resp := postIngest(h, []byte(body), nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("Response %d %+v", rec.Code, resp)
+	}
+
+	lines := waitForLines(t, buffer, "hello\n")
+	encoded, err := json.Marshal(newLogEntry(lines[0]))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(encoded) != body {
+		t.Errorf("Delivered %s, want %s", encoded, body)
+	}
+}
+
+func TestIngestGzip(t *testing.T) {
+	h, buffer := newIngestHandler(t, "", BufferOptions{})
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	fmt.Fprint(gz, "{\"message\":\"one\"}\n{\"message\":\"two\"}\n")
+	gz.Close()
+
+	rec, resp := postIngest(h, body.Bytes(), http.Header{"Content-Encoding": {"gzip"}})
+	if rec.Code != http.StatusAccepted || resp.Accepted != 2 {
+		t.Fatalf("Response %d %+v", rec.Code, resp)
+	}
+	waitForLines(t, buffer, "one\n", "two\n")
+
+	if rec, _ := postIngest(h, []byte("not gzip"), http.Header{"Content-Encoding": {"gzip"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Invalid gzip body got %d", rec.Code)
+	}
+	if rec, _ := postIngest(h, []byte(`{}`), http.Header{"Content-Encoding": {"br"}}); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Unsupported encoding got %d", rec.Code)
+	}
+}
+
+func TestIngestAuth(t *testing.T) {
+	h, buffer := newIngestHandler(t, "secret", BufferOptions{})
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		rec, _ := postIngest(h, []byte(`{"message":"denied"}`), http.Header{"Authorization": {auth}})
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q got %d", auth, rec.Code)
+		}
+	}
+
+	rec, _ := postIngest(h, []byte(`{"message":"allowed"}`), http.Header{"Authorization": {"Bearer secret"}})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Valid token got %d", rec.Code)
+	}
+	waitForLines(t, buffer, "allowed\n")
+}
+
+func TestIngestRejects(t *testing.T) {
+	h, buffer := newIngestHandler(t, "", BufferOptions{})
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"message":"one"`,
+		`"text"`,
+		`[{"message":"one"},2]`,
+		`{"dt":1}`,
+		// Nothing is written when a later entry is invalid
+		"{\"message\":\"one\"}\nnot json\n",
+	} {
+		if rec, resp := postIngest(h, []byte(body), nil); rec.Code != http.StatusBadRequest || resp.Error == "" {
+			t.Errorf("Body %q got %d %+v", body, rec.Code, resp)
+		}
+	}
+	if lines := readAllRecords(t, buffer); len(lines) != 0 {
+		t.Errorf("Rejected requests wrote %q", lines)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET got %d", rec.Code)
+	}
+
+	large := `{"message":"` + strings.Repeat("x", maxIngestBody) + `"}`
+	if rec, _ := postIngest(h, []byte(large), nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized body got %d", rec.Code)
+	}
+}
+
+func TestIngestBufferFull(t *testing.T) {
+	buffer, err := NewMemoryBuffer(64, BufferOptions{Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+	h := &ingestHandler{buffer: buffer, signal: make(chan struct{}, 1), cfg: &Config{OverflowPolicy: OverflowDropNewest}}
+
+	// The entries that fit are kept, and the response says how many
+	rec, resp := postIngest(h, []byte(strings.Repeat(`{"message":"some log line"}`, 10)), nil)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Response %d, want 503", rec.Code)
+	}
+	if lines := readAllRecords(t, buffer); resp.Accepted == 0 || len(lines) != resp.Accepted {
+		t.Errorf("Response says %d accepted, buffer holds %d lines", resp.Accepted, len(lines))
+	}
+}
+
+// syncRecorder is a buffer that records what was written when it was synced
+type syncRecorder struct {
+	*MemoryBuffer
+	onSync func()
+}
+
+// Sync implements Syncable
+func (b syncRecorder) Sync() error {
+	b.onSync()
+	return nil
+}
+
+func TestIngestSyncsBeforeResponding(t *testing.T) {
+	h, buffer := newIngestHandler(t, "", BufferOptions{})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{\"message\":\"one\"}\n{\"message\":\"two\"}\n"))
+	rec := httptest.NewRecorder()
+
+	syncs := 0
+	h.buffer = syncRecorder{MemoryBuffer: buffer, onSync: func() {
+		syncs++
+		if rec.Body.Len() != 0 {
+			t.Error("Synced after the response was written")
+		}
+		if lines := readAllRecords(t, buffer); len(lines) != 2 {
+			t.Errorf("Synced with %d of 2 entries written", len(lines))
+		}
+	}}
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted || syncs != 1 {
+		t.Errorf("Response %d after %d syncs, want 202 after 1", rec.Code, syncs)
+	}
+
+	// Nothing is synced when nothing was written
+	postIngest(h, []byte("not json"), nil)
+	if syncs != 1 {
+		t.Errorf("Rejected request synced the buffer")
+	}
+}
+
+func TestIngestServer(t *testing.T) {
+	server, err := ListenIngest("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatalf("ListenIngest failed: %v", err)
+	}
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx, buffer, "test-program", make(chan struct{}, 1), &Config{})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	url := "http://" + server.listener.Addr().String() + "/"
+	resp, err := http.Post(url, "application/x-ndjson", strings.NewReader("{\"message\":\"over http\"}\n"))
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Post got %s", resp.Status)
+	}
+
+	// The entry is in the buffer by the time the request is answered
+	if lines := readAllRecords(t, buffer); len(lines) != 1 || !strings.HasSuffix(lines[0], "over http\n") {
+		t.Errorf("Buffer holds %q", lines)
+	}
+}
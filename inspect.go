@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Output formats of log_fwd buffer inspect
+const (
+	inspectFormatText   = "text"
+	inspectFormatNDJSON = "ndjson"
+)
+
+// inspectPreviewLen caps how much of the oldest and newest records the statistics show
+const inspectPreviewLen = 200
+
+// bufferStats describes the contents of a buffer on disk
+type bufferStats struct {
+	Path              string `json:"path"`
+	Type              string `json:"type"`
+	State             string `json:"state"` // Whether the persisted cursors could be loaded
+	DiskBytes         int64  `json:"disk_bytes"`
+	Segments          int    `json:"segments,omitempty"`
+	PendingRecords    int64  `json:"pending_records"`
+	PendingBytes      int64  `json:"pending_bytes"`
+	CorruptBytes      int64  `json:"corrupt_bytes"`
+	EncryptedRecords  int64  `json:"encrypted_records"`
+	CompressedRecords int64  `json:"compressed_records"`
+	UnreadableRecords int64  `json:"unreadable_records"`
+	Oldest            string `json:"oldest,omitempty"`
+	Newest            string `json:"newest,omitempty"`
+	OldestWritten     string `json:"oldest_written,omitempty"` // Only known for timestamped records
+	NewestWritten     string `json:"newest_written,omitempty"`
+}
+
+// inspectedRecord is a pending record as printed by log_fwd buffer inspect.
+// Offsets are logical offsets for segment buffers, and relative to the oldest
+// pending record for file buffers.
+type inspectedRecord struct {
+	Offset     int64          `json:"offset"`
+	Size       int64          `json:"size"`
+	Encrypted  bool           `json:"encrypted,omitempty"`
+	Compressed bool           `json:"compressed,omitempty"`
+	Written    string         `json:"written,omitempty"`
+	Fields     map[string]any `json:"fields,omitempty"` // Fields of a tagged line
+	Data       string         `json:"data,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// recordVisitor is called for every pending record of a buffer, oldest first
+type recordVisitor func(offset int64, rec record) error
+
+// runInspect implements "log_fwd buffer inspect"
+func runInspect(args []string, stdout, stderr io.Writer) int {
+	fs := newCommandFlags("inspect", `Usage: log_fwd buffer inspect [options] <buffer path>
+
+Shows statistics about a buffer, or prints its pending records with -dump or
+-tail. The buffer is only read, so this is safe while log_fwd is running.
+`, stderr)
+	bufferType := fs.String("type", "", "Buffer type: file or segment (detected from the path if not set)")
+	keyFile := fs.String("encryption-key-file", "", "File with the buffer encryption keys (or set "+EncryptionKeyEnv+")")
+	dump := fs.Bool("dump", false, "Print all pending records")
+	tail := fs.Int("tail", 0, "Print the newest N pending records")
+	format := fs.String("format", inspectFormatText, "Output format: text or ndjson")
+	if code, ok := parseCommandFlags(fs, args, 1); !ok {
+		return code
+	}
+	if (*format != inspectFormatText && *format != inspectFormatNDJSON) || *tail < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	stats, records, err := inspectBuffer(fs.Arg(0), *bufferType, *keyFile, *dump, *tail, stdout, *format)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	// The newest records are only known once the whole buffer has been read
+	for _, rec := range records {
+		if err := printRecord(stdout, rec, *format); err != nil {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	if *dump || *tail > 0 {
+		return 0
+	}
+
+	if err := printStats(stdout, stats, *format); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// inspectBuffer reads the pending records of a buffer, collecting statistics.
+// With dump, every record is printed as it is read; otherwise the newest tail
+// records are returned.
+func inspectBuffer(path, bufferType, keyFile string, dump bool, tail int, out io.Writer, format string) (bufferStats, []inspectedRecord, error) {
+	stats := bufferStats{Path: path, Type: bufferType}
+	codec, err := readOnlyCodec(path, &stats.Type, keyFile)
+	if err != nil {
+		return stats, nil, err
+	}
+
+	var last []inspectedRecord
+
+	visit := func(offset int64, rec record) error {
+		inspected := inspectedRecord{
+			Offset:     offset,
+			Size:       recordSize(len(rec.payload)),
+			Encrypted:  rec.flags&recordEncrypted != 0,
+			Compressed: rec.flags&recordCompressed != 0,
+		}
+
+		stats.PendingRecords++
+		if inspected.Encrypted {
+			stats.EncryptedRecords++
+		}
+		if inspected.Compressed {
+			stats.CompressedRecords++
+		}
+		if written, ok := recordTime(rec); ok {
+			inspected.Written = written.UTC().Format(time.RFC3339Nano)
+			if stats.OldestWritten == "" {
+				stats.OldestWritten = inspected.Written
+			}
+			stats.NewestWritten = inspected.Written
+		}
+
+		data, err := codec.decode(rec)
+		if err != nil {
+			stats.UnreadableRecords++
+			inspected.Error = err.Error()
+		} else {
+			inspected.Fields, inspected.Data = untagLine(string(data))
+			if stats.Oldest == "" {
+				stats.Oldest = preview([]byte(inspected.Data))
+			}
+			stats.Newest = preview([]byte(inspected.Data))
+		}
+
+		if dump {
+			return printRecord(out, inspected, format)
+		}
+		if tail > 0 {
+			// Trim now and then rather than on every record
+			if len(last) >= 2*tail {
+				last = append(last[:0], last[len(last)-tail:]...)
+			}
+			last = append(last, inspected)
+		}
+		return nil
+	}
+
+	err = walkBuffer(path, &stats, visit)
+	if len(last) > tail {
+		last = last[len(last)-tail:]
+	}
+	return stats, last, err
+}
+
+// walkBuffer visits the pending records of the buffer at path, of the type
+// given in stats, without changing any of its files
+func walkBuffer(path string, stats *bufferStats, visit recordVisitor) error {
+	switch stats.Type {
+	case BufferTypeFile, BufferTypeMmap:
+		return walkFileBuffer(path, stats, visit)
+	case BufferTypeSegment:
+		return walkSegmentBuffer(path, stats, visit)
+	}
+	return fmt.Errorf("can't read buffer type %q", stats.Type)
+}
+
+// walkFileBuffer visits the pending records of a CircularBuffer file
+func walkFileBuffer(path string, stats *bufferStats, visit recordVisitor) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open buffer file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat buffer file: %w", err)
+	}
+	stats.DiskBytes = info.Size()
+
+	// Without valid cursors, log_fwd starts with an empty buffer
+	stateFile, err := os.Open(statePath(path))
+	if os.IsNotExist(err) {
+		stats.State = "missing"
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open buffer state file: %w", err)
+	}
+	defer stateFile.Close()
+
+	state, err := readState(stateFile)
+	if err == errNoState {
+		stats.State = "missing"
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load buffer state: %w", err)
+	}
+	if err := state.validate(info.Size()); err != nil {
+		stats.State = "invalid: " + err.Error()
+		return nil
+	}
+	stats.State = "ok"
+	stats.PendingBytes = state.size
+
+	ring := &CircularBuffer{file: file, fileSize: state.fileSize}
+	var consumed int64
+	pos := state.readPos
+	for consumed < state.size {
+		rec, skipped, recLen, err := ring.nextRecord(pos, state.size-consumed)
+		if err != nil {
+			return fmt.Errorf("failed to read buffer records: %w", err)
+		}
+		stats.CorruptBytes += skipped
+		if recLen > 0 {
+			if err := visit(consumed+skipped, rec); err != nil {
+				return err
+			}
+		}
+		consumed += skipped + recLen
+		pos = (pos + skipped + recLen) % state.fileSize
+	}
+	return nil
+}
+
+// walkSegmentBuffer visits the pending records of a SegmentBuffer directory
+func walkSegmentBuffer(dir string, stats *bufferStats, visit recordVisitor) error {
+	bases, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	// Without a cursor, log_fwd starts from the oldest segment
+	committed := int64(-1)
+	cursorFile, err := os.Open(filepath.Join(dir, segmentCursorFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open segment cursor file: %w", err)
+	}
+	if err == nil {
+		defer cursorFile.Close()
+		state, err := readState(cursorFile)
+		if err != nil && err != errNoState {
+			return fmt.Errorf("failed to load segment cursor: %w", err)
+		}
+		if err == nil {
+			committed = state.readPos
+		}
+	}
+	stats.State = "ok"
+	if committed < 0 {
+		stats.State = "missing"
+	}
+
+	sb := &SegmentBuffer{dir: dir}
+	for _, base := range bases {
+		if err := walkSegment(sb, base, committed, stats, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSegment visits the records of one segment at or after committed
+func walkSegment(sb *SegmentBuffer, base, committed int64, stats *bufferStats, visit recordVisitor) error {
+	path := segmentPath(sb.dir, base)
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment: %w", err)
+	}
+	seg := &segment{file: file, path: path, base: base, size: info.Size()}
+	stats.Segments++
+	stats.DiskBytes += seg.size
+
+	pos := seg.base
+	if committed > pos {
+		pos = committed
+	}
+	if pos >= seg.end() {
+		return nil
+	}
+	stats.PendingBytes += seg.end() - pos
+
+	read := sb.segmentReader(seg)
+	for pos < seg.end() {
+		rec, skipped, recLen, err := findRecord(read, pos, seg.end()-pos)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		stats.CorruptBytes += skipped
+		if recLen > 0 {
+			if err := visit(pos+skipped, rec); err != nil {
+				return err
+			}
+		}
+		pos += skipped + recLen
+	}
+	return nil
+}
+
+// preview returns the start of a record for display
+func preview(data []byte) string {
+	if len(data) > inspectPreviewLen {
+		return string(data[:inspectPreviewLen]) + "..."
+	}
+	return string(data)
+}
+
+// printRecord prints one record in the given format
+func printRecord(w io.Writer, rec inspectedRecord, format string) error {
+	if format == inspectFormatNDJSON {
+		return json.NewEncoder(w).Encode(rec)
+	}
+
+	line := rec.Data
+	if len(rec.Fields) > 0 {
+		fields, err := json.Marshal(rec.Fields)
+		if err != nil {
+			return err
+		}
+		line = string(fields) + " " + line
+	}
+	if rec.Error != "" {
+		line = fmt.Sprintf("[unreadable record at offset %d: %s]", rec.Offset, rec.Error)
+	}
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+// printStats prints buffer statistics in the given format
+func printStats(w io.Writer, stats bufferStats, format string) error {
+	if format == inspectFormatNDJSON {
+		return json.NewEncoder(w).Encode(stats)
+	}
+
+	disk := fmt.Sprintf("%d bytes", stats.DiskBytes)
+	if stats.Type == BufferTypeSegment {
+		disk += fmt.Sprintf(" in %d segments", stats.Segments)
+	}
+
+	lines := [][2]string{
+		{"Buffer", fmt.Sprintf("%s (%s)", stats.Path, stats.Type)},
+		{"State", stats.State},
+		{"Disk usage", disk},
+		{"Pending", fmt.Sprintf("%d records, %d bytes", stats.PendingRecords, stats.PendingBytes)},
+		{"Corrupt data", fmt.Sprintf("%d bytes", stats.CorruptBytes)},
+		{"Encrypted", fmt.Sprintf("%d records", stats.EncryptedRecords)},
+		{"Compressed", fmt.Sprintf("%d records", stats.CompressedRecords)},
+		{"Unreadable", fmt.Sprintf("%d records", stats.UnreadableRecords)},
+	}
+	if stats.PendingRecords > stats.UnreadableRecords {
+		lines = append(lines,
+			[2]string{"Oldest record", fmt.Sprintf("%q", stats.Oldest)},
+			[2]string{"Newest record", fmt.Sprintf("%q", stats.Newest)})
+	}
+	if stats.OldestWritten != "" {
+		lines = append(lines, [2]string{"Written", stats.OldestWritten + " to " + stats.NewestWritten})
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintf(w, "%-15s %s\n", line[0]+":", line[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fillBuffer writes lines to a buffer, delivers the first committed of them and closes it
+func fillBuffer(t *testing.T, buf BufferInterface, lines []string, committed int) {
+	for _, line := range lines {
+		if _, err := buf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if committed > 0 {
+		_, offset, err := buf.ReadRecords(committed)
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		buf.Commit(offset)
+	}
+	if err := buf.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// snapshotDir returns the contents of every file below dir
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, _ := os.ReadFile(path)
+		files[path] = string(data)
+		return nil
+	})
+	return files
+}
+
+func TestInspectBuffers(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "inspect-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	lines := []string{"first\n", "second\n", "third\n", "fourth\n", "fifth\n"}
+	filePath := filepath.Join(tmpdir, "buffer.log")
+	circular, err := NewBuffer(filePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	fillBuffer(t, circular, lines, 2)
+
+	segmentDir := filepath.Join(tmpdir, "wal")
+	segments, err := NewSegmentBuffer(segmentDir, 1024*1024, BufferOptions{SegmentSize: 20})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	fillBuffer(t, segments, lines, 2)
+
+	before := snapshotDir(t, tmpdir)
+
+	for _, path := range []string{filePath, segmentDir} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runBufferCommand([]string{"inspect", path}, &stdout, &stderr); code != 0 {
+				t.Fatalf("inspect exited with %d: %s", code, stderr.String())
+			}
+			out := stdout.String()
+			for _, want := range []string{"State:          ok", "Pending:        3 records", `Oldest record:  "third\n"`, `Newest record:  "fifth\n"`} {
+				if !strings.Contains(out, want) {
+					t.Errorf("Statistics missing %q:\n%s", want, out)
+				}
+			}
+
+			stdout.Reset()
+			if code := runBufferCommand([]string{"inspect", "-dump", path}, &stdout, &stderr); code != 0 {
+				t.Fatalf("inspect -dump exited with %d: %s", code, stderr.String())
+			}
+			if got := stdout.String(); got != "third\nfourth\nfifth\n" {
+				t.Errorf("inspect -dump printed %q", got)
+			}
+
+			stdout.Reset()
+			if code := runBufferCommand([]string{"inspect", "-tail", "2", "-format", "ndjson", path}, &stdout, &stderr); code != 0 {
+				t.Fatalf("inspect -tail exited with %d: %s", code, stderr.String())
+			}
+			var got []string
+			scanner := bufio.NewScanner(&stdout)
+			for scanner.Scan() {
+				var rec inspectedRecord
+				if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+					t.Fatalf("Invalid NDJSON line %q: %v", scanner.Text(), err)
+				}
+				got = append(got, rec.Data)
+			}
+			if strings.Join(got, "") != "fourth\nfifth\n" {
+				t.Errorf("inspect -tail 2 returned %q", got)
+			}
+		})
+	}
+
+	// Inspecting must not change the buffer files
+	after := snapshotDir(t, tmpdir)
+	if len(after) != len(before) {
+		t.Errorf("Inspecting changed the files in the buffer directory: %d before, %d after", len(before), len(after))
+	}
+	for path, data := range before {
+		if after[path] != data {
+			t.Errorf("Inspecting modified %s", path)
+		}
+	}
+}
+
+func TestInspectEncryptedBuffer(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "inspect-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	keys, _ := parseKeyRing("k1:" + testKeyHex)
+	path := filepath.Join(tmpdir, "buffer.log")
+	buf, err := NewBufferWithOptions(path, 1024*1024, BufferOptions{Keys: keys, Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	fillBuffer(t, buf, []string{"secret\n", strings.Repeat("compressible secret\n", 10)}, 0)
+
+	keyFile := filepath.Join(tmpdir, "keys")
+	os.WriteFile(keyFile, []byte("k1:"+testKeyHex+"\n"), 0600)
+	t.Setenv(EncryptionKeyEnv, "")
+
+	var stdout, stderr bytes.Buffer
+	if code := runBufferCommand([]string{"inspect", "-format", "ndjson", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("inspect exited with %d: %s", code, stderr.String())
+	}
+	var stats bufferStats
+	if err := json.Unmarshal(stdout.Bytes(), &stats); err != nil {
+		t.Fatalf("Invalid JSON statistics %q: %v", stdout.String(), err)
+	}
+	if stats.PendingRecords != 2 || stats.EncryptedRecords != 2 || stats.CompressedRecords != 1 || stats.UnreadableRecords != 2 {
+		t.Errorf("Statistics without keys = %+v", stats)
+	}
+
+	stdout.Reset()
+	if code := runBufferCommand([]string{"inspect", "-dump", "-encryption-key-file", keyFile, path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("inspect exited with %d: %s", code, stderr.String())
+	}
+	if want := "secret\n" + strings.Repeat("compressible secret\n", 10); stdout.String() != want {
+		t.Errorf("inspect -dump with keys printed %q", stdout.String())
+	}
+}
+
+func TestBufferCommandUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, 2},
+		{[]string{"help"}, 0},
+		{[]string{"shred"}, 2},
+		{[]string{"inspect"}, 2},
+		{[]string{"inspect", "-format", "xml", "buffer.log"}, 2},
+		{[]string{"inspect", "/nonexistent/buffer.log"}, 1},
+	}
+
+	for _, tc := range tests {
+		var stdout, stderr bytes.Buffer
+		if code := runBufferCommand(tc.args, &stdout, &stderr); code != tc.code {
+			t.Errorf("runBufferCommand(%q) = %d, want %d", tc.args, code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ErrBufferLocked is returned when another process is using a buffer
+var ErrBufferLocked = errors.New("buffer is in use by another process")
+
+// errLockHeld is returned by lockFile when another process holds the lock
+var errLockHeld = errors.New("lock is held")
+
+// lockFileName is the lock file inside a segment buffer directory
+const lockFileName = "lock"
+
+// fileLock is an exclusive advisory lock on a lock file, held for the
+// lifetime of a buffer so that two forwarders can't write to the same buffer.
+// The file holds the PID of the holder for error messages.
+type fileLock struct {
+	file *os.File
+}
+
+// lockPath returns the lock file of a buffer file
+func lockPath(bufferPath string) string {
+	return bufferPath + ".lock"
+}
+
+// acquireLock locks the lock file at path, failing right away if another
+// process holds it
+func acquireLock(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		defer file.Close()
+		if !errors.Is(err, errLockHeld) {
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if pid := readLockPID(file); pid > 0 {
+			return nil, fmt.Errorf("%w: %s is held by pid %d", ErrBufferLocked, path, pid)
+		}
+		return nil, fmt.Errorf("%w: %s is held by another process", ErrBufferLocked, path)
+	}
+
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt(pid, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	debugf("Locked %s", path)
+	return &fileLock{file: file}, nil
+}
+
+// readLockPID returns the PID recorded in a lock file, or 0 if there is none
+func readLockPID(file *os.File) int {
+	data := make([]byte, 32)
+	n, _ := file.ReadAt(data, 0)
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// release unlocks the lock. The lock file is left in place: removing it could
+// let another process lock a new file under the same name while a third one
+// still holds the old one.
+func (l *fileLock) release() error {
+	if l == nil {
+		return nil
+	}
+	// Closing the file releases the lock
+	return l.file.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op where flock isn't available, so buffers aren't
+// protected against concurrent use there
+func lockFile(file *os.File) error {
+	return nil
+}
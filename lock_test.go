@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuffersAreLocked(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "lock-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	openers := map[string]func() (BufferInterface, error){
+		"circular": func() (BufferInterface, error) {
+			return NewBuffer(filepath.Join(tmpdir, "buffer.log"), 1024*1024)
+		},
+		"segment": func() (BufferInterface, error) {
+			return NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1024*1024, BufferOptions{})
+		},
+	}
+
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			first, err := open()
+			if err != nil {
+				t.Fatalf("Failed to create buffer: %v", err)
+			}
+
+			// A second forwarder on the same buffer fails, naming the holder
+			if _, err := open(); !errors.Is(err, ErrBufferLocked) {
+				t.Fatalf("Opening a locked buffer error = %v, want ErrBufferLocked", err)
+			} else if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+				t.Errorf("Lock error %q doesn't name the holding PID", err)
+			}
+
+			// Once closed, the buffer can be opened again
+			if err := first.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			second, err := open()
+			if err != nil {
+				t.Fatalf("Failed to reopen buffer after Close: %v", err)
+			}
+			second.Close()
+		})
+	}
+}
+
+func TestProgramBufferPath(t *testing.T) {
+	tests := []struct {
+		path, program, want string
+	}{
+		{"log_fwd_buffer.log", "api", "log_fwd_buffer-api.log"},
+		{"/var/lib/log_fwd/wal", "worker-2", "/var/lib/log_fwd/wal-worker-2"},
+		{"/var/lib/log_fwd/wal/", "worker", "/var/lib/log_fwd/wal-worker"},
+		{"buffer.log", "my app/v2", "buffer-my_app_v2.log"},
+	}
+
+	for _, tc := range tests {
+		if got := programBufferPath(tc.path, tc.program); got != tc.want {
+			t.Errorf("programBufferPath(%q, %q) = %q, want %q", tc.path, tc.program, got, tc.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"sync"
 	"syscall"
 )
 
@@ -71,6 +72,11 @@ func main() {
 		}
 	}()
 
+	// Subcommands have their own flags
+	if len(os.Args) > 1 && os.Args[1] == "buffer" {
+		os.Exit(runBufferCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Parse command line arguments
 	cfg := ParseFlags()
 
@@ -97,8 +103,31 @@ func main() {
 	// Setup signal handling
 	setupSignalHandling(cancel)
 
+	// Listen before opening the buffer, so that a taken port fails early
+	var syslog *SyslogServer
+	if cfg.SyslogUDP != "" || cfg.SyslogTCP != "" {
+		var err error
+		if syslog, err = ListenSyslog(cfg.SyslogUDP, cfg.SyslogTCP); err != nil {
+			log.Fatalf("Failed to start syslog input: %v", err)
+		}
+	}
+	var unix *UnixServer
+	if cfg.UnixSocket != "" || cfg.UnixDatagram != "" {
+		var err error
+		if unix, err = ListenUnix(cfg.UnixSocket, cfg.UnixDatagram, os.FileMode(cfg.UnixSocketMode)); err != nil {
+			log.Fatalf("Failed to start Unix socket input: %v", err)
+		}
+	}
+	var ingest *IngestServer
+	if cfg.IngestAddr != "" {
+		var err error
+		if ingest, err = ListenIngest(cfg.IngestAddr, cfg.IngestToken); err != nil {
+			log.Fatalf("Failed to start HTTP ingest: %v", err)
+		}
+	}
+
 	// Initialize the buffer
-	buffer, err := NewBuffer(cfg.BufferPath, cfg.MaxSize)
+	buffer, err := openBuffer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create buffer: %v", err)
 	}
@@ -127,8 +156,41 @@ func main() {
 	// Start sender goroutine
 	go client.SendLogs(ctx, buffer, newLogs)
 
-	// Process stdin and write to buffer
-	ProcessInput(ctx, buffer, hostname, cfg.ProgramName, newLogs, cfg)
+	// Process stdin, or follow files and listen for logs, and write to buffer
+	if cfg.readsStdin() {
+		ProcessInput(ctx, buffer, hostname, cfg.ProgramName, newLogs, cfg)
+		return
+	}
+	var inputs sync.WaitGroup
+	if syslog != nil {
+		inputs.Add(1)
+		go func() {
+			defer inputs.Done()
+			syslog.Serve(ctx, buffer, cfg.ProgramName, newLogs, cfg)
+		}()
+	}
+	if unix != nil {
+		inputs.Add(1)
+		go func() {
+			defer inputs.Done()
+			unix.Serve(ctx, buffer, cfg.ProgramName, newLogs, cfg)
+		}()
+	}
+	if ingest != nil {
+		inputs.Add(1)
+		go func() {
+			defer inputs.Done()
+			ingest.Serve(ctx, buffer, cfg.ProgramName, newLogs, cfg)
+		}()
+	}
+	if len(cfg.Files) > 0 {
+		inputs.Add(1)
+		go func() {
+			defer inputs.Done()
+			TailFiles(ctx, buffer, cfg.ProgramName, newLogs, cfg)
+		}()
+	}
+	inputs.Wait()
 }
 
 // setupSignalHandling sets up handlers for OS signals
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// MemoryBuffer is a buffer of records kept in memory, for environments where
+// no buffer file can or should be written. Buffered logs are lost when the
+// process exits, but otherwise it behaves like CircularBuffer: it holds up to
+// maxSize bytes of records and applies the same overflow policies.
+type MemoryBuffer struct {
+	mutex    sync.Mutex
+	records  []record // Ring of pending records, starting at start
+	start    int
+	count    int
+	size     int64 // Bytes the pending records count towards maxSize
+	maxSize  int64
+	head     int64 // Logical offset of the first pending record
+	closed   bool
+	overflow *overflowHandler // Decides what happens to records that don't fit
+	drops    dropCounter      // Records lost to overflow, reported as gap markers
+	skipped  skippedRecords   // Records the last read skipped, dropped once committed
+	codec    recordCodec      // Compresses records when enabled
+}
+
+// NewMemoryBuffer creates an in-memory buffer holding up to maxSize bytes.
+// Records are never encrypted, since they are never written to disk; the
+// encryption keys only apply to the spill file.
+func NewMemoryBuffer(maxSize int64, opts BufferOptions) (*MemoryBuffer, error) {
+	debugf("Creating memory buffer, maxSize: %d bytes", maxSize)
+
+	mb := &MemoryBuffer{maxSize: maxSize}
+	overflow, err := newOverflowHandler(opts, "", &mb.drops)
+	if err != nil {
+		return nil, err
+	}
+	mb.overflow = overflow
+
+	// Without a dictionary file, a dictionary is learned for this run only
+	comp, err := newCompressor(opts.Compression, "", nil, true)
+	if err != nil {
+		return nil, err
+	}
+	mb.codec = recordCodec{compressor: comp, maxAge: opts.MaxAge}
+
+	return mb, nil
+}
+
+// recordCost returns how many bytes a record counts towards maxSize. The
+// record framing is included so that -maxsize means the same for every buffer type.
+func recordCost(rec record) int64 {
+	return recordSize(len(rec.payload))
+}
+
+// Write appends data to the buffer as a single record
+func (mb *MemoryBuffer) Write(data []byte) (int, error) {
+	// Empty records are never stored
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	payload, flags, err := mb.codec.encode(data)
+	if err != nil {
+		return 0, err
+	}
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.add(data, record{payload: payload, flags: flags})
+}
+
+// WriteBatch appends several records to the buffer under a single lock
+func (mb *MemoryBuffer) WriteBatch(data [][]byte) (int, error) {
+	recs, err := encodeBatch(mb.codec, data)
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	for n, rec := range recs {
+		if len(data[n]) == 0 {
+			continue
+		}
+		if _, err := mb.add(data[n], rec); err != nil {
+			return n, err
+		}
+	}
+	return len(recs), err
+}
+
+// add stores rec, the encoded form of data, making room for it; the caller
+// must hold the mutex
+func (mb *MemoryBuffer) add(data []byte, rec record) (int, error) {
+	if rec.flags == 0 {
+		// The caller may reuse data, so keep a copy
+		rec.payload = append([]byte(nil), rec.payload...)
+	}
+	cost := recordCost(rec)
+
+	if mb.closed {
+		return 0, os.ErrClosed
+	}
+	if cost > mb.maxSize || len(rec.payload) > maxRecordPayload {
+		return 0, fmt.Errorf("data exceeds maximum buffer size")
+	}
+
+	// Without room, let the overflow policy decide what to do with the record
+	if mb.size+cost > mb.maxSize && !mb.overflow.dropsOldest() {
+		return mb.overflow.handle(data)
+	}
+
+	// Drop the oldest records until the new one fits
+	for mb.size+cost > mb.maxSize {
+		dropped := mb.pop()
+		debugf("Buffer full, dropping oldest record (%d bytes)", len(dropped.payload))
+		mb.drops.add(DropReasonOverflow, 1, int64(len(dropped.payload)))
+	}
+
+	mb.push(rec)
+	return len(data), nil
+}
+
+// push appends a record to the ring, growing it if needed; the caller must hold the mutex
+func (mb *MemoryBuffer) push(rec record) {
+	if mb.count == len(mb.records) {
+		grown := make([]record, 2*len(mb.records)+16)
+		for i := 0; i < mb.count; i++ {
+			grown[i] = mb.records[(mb.start+i)%len(mb.records)]
+		}
+		mb.records = grown
+		mb.start = 0
+	}
+
+	mb.records[(mb.start+mb.count)%len(mb.records)] = rec
+	mb.count++
+	mb.size += recordCost(rec)
+}
+
+// pop removes the oldest record; the caller must hold the mutex
+func (mb *MemoryBuffer) pop() record {
+	rec := mb.records[mb.start]
+	mb.records[mb.start] = record{} // Let the payload be garbage collected
+	mb.start = (mb.start + 1) % len(mb.records)
+	mb.count--
+
+	cost := recordCost(rec)
+	mb.size -= cost
+	mb.head += cost
+	return rec
+}
+
+// at returns the i-th pending record; the caller must hold the mutex
+func (mb *MemoryBuffer) at(i int) record {
+	return mb.records[(mb.start+i)%len(mb.records)]
+}
+
+// Read reads and consumes whole records from the buffer, returning their
+// concatenated payloads. At least one record is returned even if it is larger
+// than maxBytes, so a record is never split.
+func (mb *MemoryBuffer) Read(maxBytes int64) ([]byte, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	records, offset, err := mb.readRecords(-1, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := mb.commit(offset); err != nil {
+		return nil, err
+	}
+
+	return bytes.Join(records, nil), nil
+}
+
+// ReadRecords returns up to maxRecords records without consuming them. The
+// returned offset must be passed to Commit once the records have been delivered.
+func (mb *MemoryBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.readRecords(maxRecords, -1)
+}
+
+// Commit consumes all records up to an offset returned by ReadRecords
+func (mb *MemoryBuffer) Commit(offset int64) error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.commit(offset)
+}
+
+// readRecords collects records until maxRecords records or maxBytes of
+// payload have been collected (negative means no limit). Records that can't
+// be decoded are skipped and included in the returned offset. The caller must
+// hold the mutex.
+func (mb *MemoryBuffer) readRecords(maxRecords int, maxBytes int64) ([][]byte, int64, error) {
+	if mb.count == 0 {
+		return nil, 0, io.EOF
+	}
+
+	var records [][]byte
+	var skippedRecs skippedRecords
+	var payloadBytes, consumed int64
+
+	for i := 0; i < mb.count && (maxRecords < 0 || len(records) < maxRecords); i++ {
+		rec := mb.at(i)
+		payload, dropped, err := mb.codec.readable(rec)
+		if err != nil && consumed > 0 {
+			// Deliver what comes before the record first
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Stop before exceeding maxBytes, but always return at least one record
+		if maxBytes >= 0 && len(records) > 0 && payloadBytes+int64(len(payload)) > maxBytes {
+			break
+		}
+
+		consumed += recordCost(rec)
+		if dropped != "" {
+			skippedRecs = append(skippedRecs, skippedRecord{mb.head + consumed, dropped, int64(len(rec.payload))})
+			continue
+		}
+		records = append(records, payload)
+		payloadBytes += int64(len(payload))
+	}
+
+	mb.skipped = skippedRecs
+	return records, mb.head + consumed, nil
+}
+
+// commit drops the records before offset; the caller must hold the mutex
+func (mb *MemoryBuffer) commit(offset int64) error {
+	// Data before the head was already consumed or dropped
+	if offset <= mb.head {
+		return nil
+	}
+	if offset-mb.head > mb.size {
+		return fmt.Errorf("commit offset %d is beyond buffered data", offset)
+	}
+
+	for mb.head < offset {
+		if mb.head+recordCost(mb.at(0)) > offset {
+			return fmt.Errorf("commit offset %d is not at a record boundary", offset)
+		}
+		end := mb.head + recordCost(mb.at(0))
+		mb.skipped = mb.skipped.commit(mb.head, end, &mb.drops)
+		mb.pop()
+	}
+	return nil
+}
+
+// Sync flushes the spill file to disk. The records in memory can't be made
+// durable.
+func (mb *MemoryBuffer) Sync() error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.overflow.sync()
+}
+
+// TakeDrops returns the records lost to overflow since the last call
+func (mb *MemoryBuffer) TakeDrops() []DropReport {
+	return mb.drops.take()
+}
+
+// HasData returns true if buffer contains data
+func (mb *MemoryBuffer) HasData() bool {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.count > 0
+}
+
+// GetSize returns the number of bytes the pending records count towards
+// maxSize, including their framing
+func (mb *MemoryBuffer) GetSize() int64 {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.size
+}
+
+// Close discards the buffered records and closes the spill file, if any
+func (mb *MemoryBuffer) Close() error {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	if mb.count > 0 {
+		debugf("Closing memory buffer, discarding %d pending records", mb.count)
+	}
+	mb.closed = true
+	mb.records = nil
+	mb.start, mb.count, mb.size = 0, 0, 0
+	return mb.overflow.Close()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryBufferBasic(t *testing.T) {
+	buf, err := NewMemoryBuffer(1024*1024, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create memory buffer: %v", err)
+	}
+	defer buf.Close()
+
+	if buf.HasData() {
+		t.Error("New buffer should be empty")
+	}
+	if _, _, err := buf.ReadRecords(10); err != io.EOF {
+		t.Errorf("ReadRecords on empty buffer error = %v, want io.EOF", err)
+	}
+
+	// The buffer must keep its own copy of the written data
+	line := []byte("line one\n")
+	buf.Write(line)
+	copy(line, "LINE ONE\n")
+	buf.Write([]byte("line two\n"))
+
+	if got, want := buf.GetSize(), recordSize(9)*2; got != want {
+		t.Errorf("GetSize() = %d, want %d", got, want)
+	}
+
+	records, offset, err := buf.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 1 || string(records[0]) != "line one\n" {
+		t.Errorf("ReadRecords returned %q, expected [%q]", records, "line one\n")
+	}
+
+	// Nothing is consumed until the offset is committed
+	if again, _, _ := buf.ReadRecords(1); string(again[0]) != "line one\n" {
+		t.Errorf("ReadRecords before Commit returned %q", again)
+	}
+	if err := buf.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := buf.Commit(offset); err != nil {
+		t.Errorf("Repeated Commit failed: %v", err)
+	}
+	if err := buf.Commit(offset + 1); err == nil {
+		t.Error("Expected an error committing into the middle of a record")
+	}
+
+	data, err := buf.Read(1024)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data) != "line two\n" {
+		t.Errorf("Read returned %q, expected %q", data, "line two\n")
+	}
+	if buf.HasData() || buf.GetSize() != 0 {
+		t.Errorf("Buffer should be empty, size %d", buf.GetSize())
+	}
+}
+
+func TestMemoryBufferRingGrowth(t *testing.T) {
+	buf, err := NewMemoryBuffer(1024*1024, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create memory buffer: %v", err)
+	}
+	defer buf.Close()
+
+	// Interleave writes and commits so the ring wraps while it grows
+	next, want := 0, 0
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 7; i++ {
+			buf.Write([]byte(fmt.Sprintf("line %d\n", next)))
+			next++
+		}
+		records, offset, err := buf.ReadRecords(5)
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		for _, rec := range records {
+			if got := fmt.Sprintf("line %d\n", want); string(rec) != got {
+				t.Fatalf("Got record %q, want %q", rec, got)
+			}
+			want++
+		}
+		buf.Commit(offset)
+	}
+
+	records, _, _ := buf.ReadRecords(-1)
+	if want+len(records) != next {
+		t.Errorf("Got %d remaining records, want %d", len(records), next-want)
+	}
+}
+
+func TestMemoryBufferOverflowPolicies(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "memory-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Two records of this size fill the buffer
+	maxSize := int64(1024)
+	record := make([]byte, maxSize/2-recordHeaderSize)
+	for i := range record {
+		record[i] = 'a'
+	}
+	spillPath := filepath.Join(tmpdir, "memory.spill")
+
+	tests := []struct {
+		policy    string
+		wantErr   error
+		wantFirst byte // First byte of the oldest record after the overflow
+		wantDrops int64
+	}{
+		{OverflowDropOldest, nil, 'b', 1},
+		{OverflowDropNewest, ErrBufferFull, 'a', 1},
+		{OverflowBlock, ErrBufferFull, 'a', 0},
+		{OverflowSpill, nil, 'a', 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			buf, err := NewMemoryBuffer(maxSize, BufferOptions{Overflow: tc.policy, SpillPath: spillPath})
+			if err != nil {
+				t.Fatalf("Failed to create buffer: %v", err)
+			}
+			defer buf.Close()
+
+			record[0] = 'a'
+			buf.Write(record)
+			record[0] = 'b'
+			buf.Write(record)
+			record[0] = 'c'
+			_, err = buf.Write(record)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Write to full buffer error = %v, want %v", err, tc.wantErr)
+			}
+
+			records, _, err := buf.ReadRecords(1)
+			if err != nil {
+				t.Fatalf("ReadRecords failed: %v", err)
+			}
+			if records[0][0] != tc.wantFirst {
+				t.Errorf("Oldest record starts with %q, want %q", records[0][0], tc.wantFirst)
+			}
+
+			var dropped int64
+			for _, report := range buf.TakeDrops() {
+				dropped += report.Lines
+			}
+			if dropped != tc.wantDrops {
+				t.Errorf("Dropped %d records, want %d", dropped, tc.wantDrops)
+			}
+		})
+	}
+
+	spilled, err := os.ReadFile(spillPath)
+	if err != nil {
+		t.Fatalf("Failed to read spill file: %v", err)
+	}
+	if len(spilled) != len(record) || spilled[0] != 'c' {
+		t.Errorf("Spill file holds %d bytes, want %d bytes starting with 'c'", len(spilled), len(record))
+	}
+
+	if _, err := NewMemoryBuffer(maxSize, BufferOptions{Overflow: OverflowSpill}); err == nil {
+		t.Error("Expected an error for the spill policy without a spill file")
+	}
+	buf, _ := NewMemoryBuffer(maxSize, BufferOptions{})
+	if _, err := buf.Write(make([]byte, maxSize)); err == nil {
+		t.Error("Expected an error for a record larger than the buffer")
+	}
+}
+
+func TestMemoryBufferCompression(t *testing.T) {
+	plain, _ := NewMemoryBuffer(64*1024, BufferOptions{})
+	compressed, err := NewMemoryBuffer(64*1024, BufferOptions{Compression: CompressionDict})
+	if err != nil {
+		t.Fatalf("Failed to create memory buffer: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		plain.Write([]byte(testLogLine(i)))
+		compressed.Write([]byte(testLogLine(i)))
+	}
+	if compressed.GetSize() >= plain.GetSize()/2 {
+		t.Errorf("Compressed buffer uses %d bytes, plain buffer %d", compressed.GetSize(), plain.GetSize())
+	}
+
+	records, _, err := compressed.ReadRecords(-1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if got := string(records[len(records)-1]); got != testLogLine(199) {
+		t.Errorf("Last record = %q, want %q", got, testLogLine(199))
+	}
+
+	compressed.Close()
+	if _, err := compressed.Write([]byte("late line\n")); err == nil {
+		t.Error("Expected an error writing to a closed buffer")
+	}
+}
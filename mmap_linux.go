@@ -0,0 +1,169 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// mappedFile accesses a file through a shared memory mapping of all of it,
+// so reads and writes are plain memory copies
+type mappedFile struct {
+	file  *os.File
+	mutex sync.RWMutex // Held exclusively while the mapping is replaced
+	data  []byte
+}
+
+// mapBufferFiles maps a buffer file and its state file into memory. The
+// state file is extended to hold both state slots.
+func mapBufferFiles(file, stateFile *os.File) (bufferFile, bufferFile, error) {
+	data, err := mapFile(file, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := mapFile(stateFile, 2*stateSlotSize)
+	if err != nil {
+		data.unmap()
+		return nil, nil, err
+	}
+	return data, state, nil
+}
+
+// mapFile maps file, first growing it to at least minSize bytes
+func mapFile(file *os.File, minSize int64) (*mappedFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", file.Name(), err)
+	}
+	size := info.Size()
+	if size < minSize {
+		if err := file.Truncate(minSize); err != nil {
+			return nil, fmt.Errorf("failed to extend %s: %w", file.Name(), err)
+		}
+		size = minSize
+	}
+
+	mf := &mappedFile{file: file}
+	if err := mf.mapSize(size); err != nil {
+		return nil, err
+	}
+	return mf, nil
+}
+
+// mapSize maps the first size bytes of the file; the caller must hold the
+// mutex exclusively, or be the only user
+func (mf *mappedFile) mapSize(size int64) error {
+	if size == 0 {
+		return nil
+	}
+	if size > math.MaxInt {
+		return fmt.Errorf("%s is too large to map", mf.file.Name())
+	}
+	data, err := syscall.Mmap(int(mf.file.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to map %s: %w", mf.file.Name(), err)
+	}
+	mf.data = data
+	return nil
+}
+
+// unmap removes the mapping; the caller must hold the mutex exclusively, or
+// be the only user
+func (mf *mappedFile) unmap() error {
+	if mf.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(mf.data)
+	mf.data = nil
+	return err
+}
+
+// ReadAt implements io.ReaderAt
+func (mf *mappedFile) ReadAt(p []byte, off int64) (int, error) {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+
+	if off < 0 || off >= int64(len(mf.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, mf.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt. Writes can't extend the file; use Truncate.
+func (mf *mappedFile) WriteAt(p []byte, off int64) (int, error) {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+
+	if off < 0 || off+int64(len(p)) > int64(len(mf.data)) {
+		return 0, errors.New("write beyond the end of a mapped file")
+	}
+	return copy(mf.data[off:], p), nil
+}
+
+// Truncate resizes the file and maps it again. Growing also allocates the
+// new space, since writing to a mapped page the filesystem has no room for
+// would crash the process rather than fail.
+func (mf *mappedFile) Truncate(size int64) error {
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+
+	oldSize := int64(len(mf.data))
+	if err := mf.unmap(); err != nil {
+		return fmt.Errorf("failed to unmap %s: %w", mf.file.Name(), err)
+	}
+
+	err := mf.file.Truncate(size)
+	if err == nil && size > oldSize {
+		err = syscall.Fallocate(int(mf.file.Fd()), 0, oldSize, size-oldSize)
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			err = nil // Nothing to be done on filesystems without fallocate
+		}
+		if err != nil {
+			mf.file.Truncate(oldSize)
+		}
+	}
+	if err != nil {
+		if mapErr := mf.mapSize(oldSize); mapErr != nil {
+			return mapErr
+		}
+		return err
+	}
+	return mf.mapSize(size)
+}
+
+// Sync flushes the mapped pages and the file metadata to disk
+func (mf *mappedFile) Sync() error {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+
+	if len(mf.data) > 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mf.data[0])), uintptr(len(mf.data)), syscall.MS_SYNC)
+		if errno != 0 {
+			return fmt.Errorf("failed to sync %s: %w", mf.file.Name(), errno)
+		}
+	}
+	return mf.file.Sync()
+}
+
+// Close unmaps and closes the file
+func (mf *mappedFile) Close() error {
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+
+	err := mf.unmap()
+	if closeErr := mf.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mapBufferFiles is only implemented on Linux
+func mapBufferFiles(file, stateFile *os.File) (bufferFile, bufferFile, error) {
+	return nil, nil, errors.New("the mmap buffer is only supported on Linux")
+}
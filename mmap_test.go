@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func skipWithoutMmap(t testing.TB) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the mmap buffer is only supported on Linux")
+	}
+}
+
+func TestMmapBuffer(t *testing.T) {
+	skipWithoutMmap(t)
+	path := filepath.Join(t.TempDir(), "buffer.log")
+
+	buf, err := NewMmapBuffer(path, InitialBufferSize*8, BufferOptions{ShrinkAfter: 1})
+	if err != nil {
+		t.Fatalf("Failed to create mmap buffer: %v", err)
+	}
+
+	// Enough records to grow, and so remap, the file several times
+	record := make([]byte, 1000)
+	next, expected := 0, 0
+	for buf.size+recordSize(len(record)) <= buf.maxSize {
+		copy(record, fmt.Sprintf("%08d", next))
+		if _, err := buf.Write(record); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		next++
+	}
+	for i := 0; i < 50; i++ {
+		records, offset, err := buf.ReadRecords(5)
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		for _, rec := range records {
+			if got := string(rec[:8]); got != fmt.Sprintf("%08d", expected) {
+				t.Fatalf("Read record %s, expected %08d", got, expected)
+			}
+			expected++
+		}
+		if err := buf.Commit(offset); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	if err := buf.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The files are the same as those of the file buffer
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != InitialBufferSize*8 {
+		t.Fatalf("Buffer file size = %v, %v", info.Size(), err)
+	}
+	file, err := NewBuffer(path, InitialBufferSize*8)
+	if err != nil {
+		t.Fatalf("Failed to open mmap buffer files as a file buffer: %v", err)
+	}
+	data, err := file.Read(1)
+	if err != nil || string(data[:8]) != fmt.Sprintf("%08d", expected) {
+		t.Fatalf("File buffer read %q, %v, expected record %08d", data[:8], err, expected)
+	}
+	expected++
+	file.Close()
+
+	// Draining the rest shrinks the mapped file
+	buf, err = NewMmapBuffer(path, InitialBufferSize*8, BufferOptions{ShrinkAfter: 1})
+	if err != nil {
+		t.Fatalf("Failed to reopen mmap buffer: %v", err)
+	}
+	defer buf.Close()
+	for buf.HasData() {
+		data, err := buf.Read(1)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if got := string(data[:8]); got != fmt.Sprintf("%08d", expected) {
+			t.Fatalf("Read record %s, expected %08d", got, expected)
+		}
+		expected++
+	}
+	if expected != next {
+		t.Errorf("Read %d records, expected %d", expected, next)
+	}
+	buf.Write([]byte("after draining\n"))
+	buf.Write([]byte("after draining\n"))
+	if buf.fileSize != InitialBufferSize {
+		t.Errorf("File size after draining = %d, want %d", buf.fileSize, InitialBufferSize)
+	}
+	if data, err := buf.Read(1); err != nil || string(data) != "after draining\n" {
+		t.Errorf("Read after shrinking returned %q, %v", data, err)
+	}
+}
+
+func TestOpenMmapBuffer(t *testing.T) {
+	skipWithoutMmap(t)
+	cfg := &Config{BufferType: BufferTypeMmap, BufferPath: filepath.Join(t.TempDir(), "buffer.log"), MaxSize: 1 << 20, SyncPolicy: SyncAlways}
+	buffer, err := openBuffer(cfg)
+	if err != nil {
+		t.Fatalf("openBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+
+	if _, ok := buffer.(*CircularBuffer); !ok {
+		t.Fatalf("openBuffer returned %T, want *CircularBuffer", buffer)
+	}
+	if _, ok := buffer.(*CircularBuffer).file.(*os.File); ok {
+		t.Error("The mmap buffer should access its file through a mapping")
+	}
+
+	// Syncing goes through msync
+	if _, err := buffer.Write([]byte("synced\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
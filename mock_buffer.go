@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"sync"
 )
@@ -11,6 +12,7 @@ type MockBuffer struct {
 	buffer     bytes.Buffer
 	mutex      sync.Mutex
 	closed     bool
+	head       int64 // Number of bytes consumed so far, used as the Peek offset base
 	WriteError error // Error to return on Write calls
 	ReadError  error // Error to return on Read calls
 }
@@ -37,6 +39,16 @@ func (m *MockBuffer) Write(data []byte) (int, error) {
 	return m.buffer.Write(data)
 }
 
+// WriteBatch implements the WriteBatch method for the mock buffer
+func (m *MockBuffer) WriteBatch(data [][]byte) (int, error) {
+	for n, d := range data {
+		if _, err := m.Write(d); err != nil {
+			return n, err
+		}
+	}
+	return len(data), nil
+}
+
 // Read implements the Read method for the mock buffer
 func (m *MockBuffer) Read(maxBytes int64) ([]byte, error) {
 	m.mutex.Lock()
@@ -66,10 +78,69 @@ func (m *MockBuffer) Read(maxBytes int64) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	m.head += int64(n)
 
 	return data[:n], nil
 }
 
+// ReadRecords implements the ReadRecords method for the mock buffer. Each
+// newline-terminated line of the written data counts as one record.
+func (m *MockBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, 0, io.ErrClosedPipe
+	}
+
+	// Return error if one is set
+	if m.ReadError != nil {
+		return nil, 0, m.ReadError
+	}
+
+	if m.buffer.Len() == 0 {
+		return nil, 0, io.EOF
+	}
+
+	data := m.buffer.Bytes()
+	var records [][]byte
+	consumed := 0
+	for consumed < len(data) && len(records) < maxRecords {
+		end := bytes.IndexByte(data[consumed:], '\n') + 1
+		if end == 0 {
+			end = len(data) - consumed
+		}
+		record := make([]byte, end)
+		copy(record, data[consumed:consumed+end])
+		records = append(records, record)
+		consumed += end
+	}
+
+	return records, m.head + int64(consumed), nil
+}
+
+// Commit implements the Commit method for the mock buffer
+func (m *MockBuffer) Commit(offset int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return io.ErrClosedPipe
+	}
+
+	if offset <= m.head {
+		return nil
+	}
+	n := offset - m.head
+	if n > int64(m.buffer.Len()) {
+		return fmt.Errorf("commit offset %d is beyond buffered data", offset)
+	}
+
+	m.buffer.Next(int(n))
+	m.head = offset
+	return nil
+}
+
 // HasData returns whether the buffer has data
 func (m *MockBuffer) HasData() bool {
 	m.mutex.Lock()
@@ -108,5 +179,6 @@ func (m *MockBuffer) Reset() {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	m.head += int64(m.buffer.Len())
 	m.buffer.Reset()
 }
@@ -82,4 +82,40 @@ func TestMockBuffer(t *testing.T) {
 	if err != io.ErrClosedPipe {
 		t.Errorf("Read after close should return ErrClosedPipe, got %v", err)
 	}
-}
\ No newline at end of file
+}
+
+func TestMockBufferReadRecordsCommit(t *testing.T) {
+	buffer := NewMockBuffer()
+	buffer.Write([]byte("first\nsecond\nthird"))
+
+	records, offset, err := buffer.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 1 || string(records[0]) != "first\n" {
+		t.Errorf("ReadRecords returned %q, expected [%q]", records, "first\n")
+	}
+	if buffer.GetSize() != 18 {
+		t.Errorf("GetSize() after ReadRecords = %d, expected 18", buffer.GetSize())
+	}
+
+	if err := buffer.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if string(buffer.GetContents()) != "second\nthird" {
+		t.Errorf("Contents after commit = %q, expected %q", buffer.GetContents(), "second\nthird")
+	}
+
+	// An unterminated trailing line is returned as the last record
+	records, _, err = buffer.ReadRecords(10)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 2 || string(records[1]) != "third" {
+		t.Errorf("ReadRecords returned %q, expected [second third]", records)
+	}
+
+	if err := buffer.Commit(offset + 100); err == nil {
+		t.Error("Expected error committing beyond buffered data")
+	}
+}
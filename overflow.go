@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Overflow policies for a full buffer, selectable with -overflow
+const (
+	OverflowDropOldest = "drop-oldest" // Overwrite the oldest records (default)
+	OverflowDropNewest = "drop-newest" // Reject the record being written
+	OverflowBlock      = "block"       // Reject the record so the producer waits and retries
+	OverflowSpill      = "spill"       // Append the record to a secondary spill file
+)
+
+// ErrBufferFull is returned by Write when a record doesn't fit in the buffer
+// and the overflow policy rejects it
+var ErrBufferFull = errors.New("buffer full")
+
+// validOverflowPolicy reports whether policy names a known overflow policy
+func validOverflowPolicy(policy string) bool {
+	switch policy {
+	case "", OverflowDropOldest, OverflowDropNewest, OverflowBlock, OverflowSpill:
+		return true
+	}
+	return false
+}
+
+// overflowHandler applies an overflow policy to records that don't fit
+type overflowHandler struct {
+	policy    string
+	spillPath string
+	spill     *os.File     // Opened on first use
+	drops     *dropCounter // Counts records rejected by the drop-newest policy
+	keys      *keyRing     // Encrypts spilled data when set
+	disk      *diskGuard   // Keeps the spill file within the free space reserve
+}
+
+// newOverflowHandler creates the handler for a buffer stored at bufferPath.
+// Buffers without a path need an explicit spill file for OverflowSpill.
+func newOverflowHandler(opts BufferOptions, bufferPath string, drops *dropCounter) (*overflowHandler, error) {
+	if !validOverflowPolicy(opts.Overflow) {
+		return nil, fmt.Errorf("unknown overflow policy %q", opts.Overflow)
+	}
+
+	policy := opts.Overflow
+	if policy == "" {
+		policy = OverflowDropOldest
+	}
+	spillPath := opts.SpillPath
+	if spillPath == "" && bufferPath != "" {
+		spillPath = bufferPath + ".spill"
+	}
+	if policy == OverflowSpill && spillPath == "" {
+		return nil, errors.New("overflow policy spill requires a spill file")
+	}
+
+	return &overflowHandler{
+		policy:    policy,
+		spillPath: spillPath,
+		drops:     drops,
+		keys:      opts.Keys,
+		disk:      newDiskGuard(filepath.Dir(spillPath), opts.MinFree),
+	}, nil
+}
+
+// dropsOldest reports whether the buffer should make room by dropping old records
+func (h *overflowHandler) dropsOldest() bool {
+	return h.policy == OverflowDropOldest
+}
+
+// handle disposes of data that doesn't fit according to the policy
+func (h *overflowHandler) handle(data []byte) (int, error) {
+	switch h.policy {
+	case OverflowDropNewest:
+		h.drops.add(DropReasonOverflow, 1, int64(len(data)))
+		return 0, ErrBufferFull
+	case OverflowBlock:
+		// The writer retries, so nothing is lost yet
+		return 0, ErrBufferFull
+	}
+
+	if h.spill == nil {
+		debugf("Buffer full, spilling records to %s", h.spillPath)
+		file, err := os.OpenFile(h.spillPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open spill file: %w", err)
+		}
+		h.spill = file
+	}
+
+	// Keep encrypted data encrypted by spilling it as framed records
+	spilled := data
+	if h.keys != nil {
+		sealed, err := h.keys.seal(data)
+		if err != nil {
+			return 0, err
+		}
+		spilled = encodeRecord(sealed, recordEncrypted)
+	}
+	if !h.disk.allow(int64(len(spilled))) {
+		h.drops.add(DropReasonDiskFull, 1, int64(len(data)))
+		return 0, ErrBufferFull
+	}
+	if _, err := h.spill.Write(spilled); err != nil {
+		return 0, fmt.Errorf("failed to write to spill file: %w", err)
+	}
+	return len(data), nil
+}
+
+// refuse disposes of data that doesn't fit even after dropping old records,
+// which happens when the free space reserve stops the buffer from growing.
+// The drop-oldest policy has nothing left to drop, so it drops the new record.
+func (h *overflowHandler) refuse(data []byte) (int, error) {
+	if h.policy == OverflowDropOldest {
+		h.drops.add(DropReasonDiskFull, 1, int64(len(data)))
+		return 0, ErrBufferFull
+	}
+	return h.handle(data)
+}
+
+// sync flushes the spill file to disk if it was opened
+func (h *overflowHandler) sync() error {
+	if h.spill == nil {
+		return nil
+	}
+	if err := h.spill.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spill file: %w", err)
+	}
+	return nil
+}
+
+// Close closes the spill file if it was opened
+func (h *overflowHandler) Close() error {
+	if h.spill == nil {
+		return nil
+	}
+	return h.spill.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCircularBufferOverflowPolicies(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "overflow-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Two records of this size fill the buffer
+	maxSize := int64(InitialBufferSize)
+	record := make([]byte, maxSize/2-recordHeaderSize)
+	for i := range record {
+		record[i] = 'a'
+	}
+
+	tests := []struct {
+		policy    string
+		wantErr   error
+		wantFirst byte // First byte of the oldest record after the overflow
+	}{
+		{OverflowDropOldest, nil, 'b'},
+		{OverflowDropNewest, ErrBufferFull, 'a'},
+		{OverflowBlock, ErrBufferFull, 'a'},
+		{OverflowSpill, nil, 'a'},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			bufferPath := filepath.Join(tmpdir, tc.policy+".log")
+			buf, err := NewBufferWithOptions(bufferPath, maxSize, BufferOptions{Overflow: tc.policy})
+			if err != nil {
+				t.Fatalf("Failed to create buffer: %v", err)
+			}
+			defer buf.Close()
+
+			record[0] = 'a'
+			buf.Write(record)
+			record[0] = 'b'
+			buf.Write(record)
+			record[0] = 'c'
+			_, err = buf.Write(record)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Write to full buffer error = %v, want %v", err, tc.wantErr)
+			}
+
+			records, _, err := buf.ReadRecords(1)
+			if err != nil {
+				t.Fatalf("ReadRecords failed: %v", err)
+			}
+			if records[0][0] != tc.wantFirst {
+				t.Errorf("Oldest record starts with %q, want %q", records[0][0], tc.wantFirst)
+			}
+		})
+	}
+
+	// The spilled record must have been written to the spill file
+	spilled, err := os.ReadFile(filepath.Join(tmpdir, OverflowSpill+".log.spill"))
+	if err != nil {
+		t.Fatalf("Failed to read spill file: %v", err)
+	}
+	if len(spilled) != len(record) || spilled[0] != 'c' {
+		t.Errorf("Spill file holds %d bytes starting with %q, want %d bytes starting with 'c'", len(spilled), spilled[0], len(record))
+	}
+}
+
+func TestSegmentBufferOverflowDropNewest(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "overflow-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	buf, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 400, BufferOptions{Overflow: OverflowDropNewest})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer buf.Close()
+
+	record := make([]byte, 92) // 100 bytes once framed
+	var written int
+	for i := 0; i < 10; i++ {
+		if _, err := buf.Write(record); err != nil {
+			if !errors.Is(err, ErrBufferFull) {
+				t.Fatalf("Write failed: %v", err)
+			}
+			break
+		}
+		written++
+	}
+	if written != 4 {
+		t.Errorf("Wrote %d records before the buffer was full, want 4", written)
+	}
+
+	// Acknowledging a whole segment frees its space again
+	_, offset, err := buf.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if err := buf.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, err := buf.Write(record); err != nil {
+		t.Errorf("Write after commit failed: %v", err)
+	}
+}
+
+func TestUnknownOverflowPolicy(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "overflow-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if _, err := NewBufferWithOptions(filepath.Join(tmpdir, "buf.log"), 1024, BufferOptions{Overflow: "bogus"}); err == nil {
+		t.Error("Expected an error for an unknown overflow policy")
+	}
+}
+
+func TestWriteToBufferBlocks(t *testing.T) {
+	buffer := NewMockBuffer()
+	buffer.WriteError = ErrBufferFull
+	signal := make(chan struct{}, 1)
+	cfg := &Config{OverflowPolicy: OverflowBlock}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- writeToBuffer(context.Background(), buffer, []byte("line\n"), signal, cfg)
+	}()
+
+	// The write must wait while the buffer is full and nudge the sender
+	select {
+	case err := <-done:
+		t.Fatalf("writeToBuffer returned %v while the buffer was full", err)
+	case <-signal:
+	case <-time.After(time.Second):
+		t.Fatal("writeToBuffer did not signal the sender")
+	}
+
+	buffer.mutex.Lock()
+	buffer.WriteError = nil
+	buffer.mutex.Unlock()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("writeToBuffer failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writeToBuffer did not resume once space was available")
+	}
+	if got := buffer.GetSize(); got != int64(len("line\n")) {
+		t.Errorf("Buffer size = %d, want %d", got, len("line\n"))
+	}
+}
+
+func TestWriteToBufferBlockCanceled(t *testing.T) {
+	buffer := NewMockBuffer()
+	buffer.WriteError = ErrBufferFull
+	cfg := &Config{OverflowPolicy: OverflowBlock}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- writeToBuffer(ctx, buffer, []byte("line\n"), make(chan struct{}, 1), cfg)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("writeToBuffer error = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writeToBuffer did not return after cancellation")
+	}
+
+	// Without the block policy a full buffer is reported immediately
+	cfg.OverflowPolicy = OverflowDropNewest
+	if err := writeToBuffer(context.Background(), buffer, []byte("line\n"), nil, cfg); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("writeToBuffer error = %v, want ErrBufferFull", err)
+	}
+}
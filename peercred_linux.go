@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// credentialsOOBSize is the size of the control message carrying the
+// credentials of a datagram's sender
+var credentialsOOBSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// peerCredentials returns the credentials of the process at the other end of
+// a Unix stream connection (SO_PEERCRED)
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &peerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
+
+// enableCredentials makes the kernel pass the credentials of the sender along
+// with every datagram received (SO_PASSCRED)
+func enableCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		optErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err == nil {
+		err = optErr
+	}
+	return err
+}
+
+// datagramCredentials returns the sender credentials in the control messages
+// of a datagram, if there are any
+func datagramCredentials(oob []byte) *peerCred {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if ucred, err := syscall.ParseUnixCredentials(&msg); err == nil {
+			return &peerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// credentialsOOBSize is zero, as datagrams carry no credentials here
+var credentialsOOBSize = 0
+
+// peerCredentials reports that peer credentials are only available on Linux
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// enableCredentials does nothing, as datagrams carry no credentials here
+func enableCredentials(conn *net.UnixConn) error {
+	return nil
+}
+
+// datagramCredentials returns no credentials
+func datagramCredentials(oob []byte) *peerCred {
+	return nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Log levels, in increasing severity, as detected by detectLevel
+const (
+	LevelUnknown = iota
+	LevelTrace
+	LevelDebug
+	LevelInfo
+	LevelNotice
+	LevelWarn
+	LevelError
+	LevelCritical // Also fatal, panic, alert and emergency
+)
+
+// levelNames maps level names, as written in logs, to levels
+var levelNames = map[string]int{
+	"trace":     LevelTrace,
+	"debug":     LevelDebug,
+	"info":      LevelInfo,
+	"notice":    LevelNotice,
+	"warn":      LevelWarn,
+	"warning":   LevelWarn,
+	"error":     LevelError,
+	"err":       LevelError,
+	"crit":      LevelCritical,
+	"critical":  LevelCritical,
+	"fatal":     LevelCritical,
+	"panic":     LevelCritical,
+	"alert":     LevelCritical,
+	"emerg":     LevelCritical,
+	"emergency": LevelCritical,
+}
+
+// syslogLevels maps syslog severities to levels
+var syslogLevels = [8]int{LevelCritical, LevelCritical, LevelCritical, LevelError, LevelWarn, LevelNotice, LevelInfo, LevelDebug}
+
+var (
+	// level=error, "level": "error", severity: ERROR and the like
+	levelFieldPattern = regexp.MustCompile(`(?i)\b"?(?:level|lvl|severity)"?\s*[:=]\s*"?([a-z]+)`)
+	// A level written on its own in upper case, as in "2024-05-01 ERROR failed"
+	levelWordPattern = regexp.MustCompile(`\b(TRACE|DEBUG|INFO|NOTICE|WARN|WARNING|ERROR|ERR|CRIT|CRITICAL|FATAL|PANIC|ALERT|EMERG|EMERGENCY)\b`)
+	// A syslog priority at the start of the line, as in "<11>..."
+	syslogPriorityPattern = regexp.MustCompile(`^<(\d{1,3})>`)
+)
+
+// levelScanLen limits how far into a line detectLevel looks for a level word
+const levelScanLen = 256
+
+// detectLevel guesses the level of a log line from a level field (JSON or
+// key=value), a syslog priority or an upper case level word
+func detectLevel(line []byte) int {
+	if m := levelFieldPattern.FindSubmatch(line); m != nil {
+		if level, ok := levelNames[strings.ToLower(string(m[1]))]; ok {
+			return level
+		}
+	}
+	if m := syslogPriorityPattern.FindSubmatch(line); m != nil {
+		if pri, err := strconv.Atoi(string(m[1])); err == nil && pri < 192 {
+			return syslogLevels[pri%8]
+		}
+	}
+
+	head := line
+	if len(head) > levelScanLen {
+		head = head[:levelScanLen]
+	}
+	if m := levelWordPattern.Find(head); m != nil {
+		return levelNames[strings.ToLower(string(m))]
+	}
+	return LevelUnknown
+}
+
+// parseLevel parses a level name
+func parseLevel(name string) (int, error) {
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// Priority lanes
+//
+// A LaneBuffer splits logs across several buffers ("lanes"), each with its
+// own size budget. Lines matching a lane's rule go to the first such lane;
+// everything else goes to the default lane. Reads always come from the first
+// lane holding data, so higher priority logs are delivered first and can't
+// be overwritten by a flood of lower priority ones.
+//
+// A read only ever returns records of a single lane, so the offset handed to
+// Commit can carry the lane index in its low bits.
+const (
+	laneBits    = 3
+	maxLanes    = 1 << laneBits // Including the default lane
+	DefaultLane = "default"
+)
+
+// laneSpec describes a priority lane, as given with -priority
+type laneSpec struct {
+	Name     string
+	Size     int64          // Size budget of the lane's buffer
+	MinLevel int            // Lines at this level or above belong to the lane, if set
+	Pattern  *regexp.Regexp // Lines matching this belong to the lane, if set
+}
+
+// parseLaneSpec parses a lane given as NAME:SIZE:RULE, where the rule is
+// level>=LEVEL or re:REGEX, e.g. "errors:16MB:level>=error"
+func parseLaneSpec(spec string) (laneSpec, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		return laneSpec{}, fmt.Errorf("priority lane %q must be NAME:SIZE:RULE", spec)
+	}
+
+	lane := laneSpec{Name: parts[0]}
+	if lane.Name == "" || lane.Name == DefaultLane || strings.ContainsAny(lane.Name, `/\`) {
+		return laneSpec{}, fmt.Errorf("invalid priority lane name %q", lane.Name)
+	}
+
+	size, err := parseSize(parts[1])
+	if err != nil {
+		return laneSpec{}, fmt.Errorf("priority lane %s: %w", lane.Name, err)
+	}
+	lane.Size = size
+
+	rule := parts[2]
+	switch {
+	case strings.HasPrefix(rule, "level>="):
+		if lane.MinLevel, err = parseLevel(strings.TrimPrefix(rule, "level>=")); err != nil {
+			return laneSpec{}, fmt.Errorf("priority lane %s: %w", lane.Name, err)
+		}
+	case strings.HasPrefix(rule, "re:"):
+		if lane.Pattern, err = regexp.Compile(strings.TrimPrefix(rule, "re:")); err != nil {
+			return laneSpec{}, fmt.Errorf("priority lane %s: %w", lane.Name, err)
+		}
+	default:
+		return laneSpec{}, fmt.Errorf("priority lane %s: rule must be level>=LEVEL or re:REGEX", lane.Name)
+	}
+	return lane, nil
+}
+
+// matches reports whether a line of the given level belongs to the lane
+func (l laneSpec) matches(line []byte, level int) bool {
+	if l.MinLevel != LevelUnknown && level >= l.MinLevel {
+		return true
+	}
+	return l.Pattern != nil && l.Pattern.Match(line)
+}
+
+// laneFlags collects repeated -priority flags
+type laneFlags []laneSpec
+
+// String implements flag.Value
+func (f *laneFlags) String() string {
+	names := make([]string, len(*f))
+	for i, lane := range *f {
+		names[i] = lane.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// Set implements flag.Value
+func (f *laneFlags) Set(spec string) error {
+	lane, err := parseLaneSpec(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, lane)
+	return nil
+}
+
+// lanePath returns the path of a lane's buffer: log_fwd_buffer.log becomes
+// log_fwd_buffer-lane-errors.log
+func lanePath(bufferPath, lane string) string {
+	return programBufferPath(bufferPath, "lane-"+lane)
+}
+
+// bufferLane is one of the buffers of a LaneBuffer
+type bufferLane struct {
+	spec   laneSpec
+	buffer BufferInterface
+}
+
+// LaneBuffer implements priority lanes on top of other buffers
+type LaneBuffer struct {
+	lanes  []bufferLane // In priority order; the last one is the default lane
+	detect bool         // Whether any lane needs the detected log level
+}
+
+// NewLaneBuffer combines buffers into priority lanes: one buffer per spec, in
+// priority order, followed by the buffer of the default lane
+func NewLaneBuffer(specs []laneSpec, buffers []BufferInterface) (*LaneBuffer, error) {
+	if len(buffers) != len(specs)+1 || len(buffers) > maxLanes {
+		return nil, fmt.Errorf("priority lanes need one buffer per lane plus the default lane, at most %d", maxLanes)
+	}
+
+	lb := &LaneBuffer{}
+	for i, buffer := range buffers {
+		spec := laneSpec{Name: DefaultLane}
+		if i < len(specs) {
+			spec = specs[i]
+			lb.detect = lb.detect || spec.MinLevel != LevelUnknown
+		}
+		lb.lanes = append(lb.lanes, bufferLane{spec: spec, buffer: buffer})
+	}
+	return lb, nil
+}
+
+// openLanes opens a buffer for each priority lane next to the buffer path,
+// and the default lane at the buffer path itself
+func openLanes(cfg *Config, opts BufferOptions) (*LaneBuffer, error) {
+	var buffers []BufferInterface
+	closeAll := func() {
+		for _, buffer := range buffers {
+			buffer.Close()
+		}
+	}
+
+	for _, spec := range cfg.PriorityLanes {
+		laneOpts := opts
+		if opts.SpillPath != "" {
+			laneOpts.SpillPath = lanePath(opts.SpillPath, spec.Name)
+		}
+		buffer, err := openBufferAt(cfg.BufferType, lanePath(cfg.BufferPath, spec.Name), spec.Size, laneOpts)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("%s lane: %w", spec.Name, err)
+		}
+		buffers = append(buffers, buffer)
+	}
+
+	buffer, err := openBufferAt(cfg.BufferType, cfg.BufferPath, cfg.MaxSize, opts)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	buffers = append(buffers, buffer)
+
+	lb, err := NewLaneBuffer(cfg.PriorityLanes, buffers)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return lb, nil
+}
+
+// classify returns the lane a line belongs to
+func (lb *LaneBuffer) classify(data []byte) int {
+	level := LevelUnknown
+	if lb.detect {
+		level = detectLevel(data)
+	}
+	for i, lane := range lb.lanes[:len(lb.lanes)-1] {
+		if lane.spec.matches(data, level) {
+			return i
+		}
+	}
+	return len(lb.lanes) - 1
+}
+
+// Write stores data in the lane it belongs to
+func (lb *LaneBuffer) Write(data []byte) (int, error) {
+	return lb.lanes[lb.classify(data)].buffer.Write(data)
+}
+
+// WriteBatch stores each record in the lane it belongs to
+func (lb *LaneBuffer) WriteBatch(data [][]byte) (int, error) {
+	return writeRuns(data, func(d []byte) BufferInterface {
+		return lb.lanes[lb.classify(d)].buffer
+	})
+}
+
+// Read reads and consumes records from the first lane holding data
+func (lb *LaneBuffer) Read(maxBytes int64) ([]byte, error) {
+	for _, lane := range lb.lanes {
+		if lane.buffer.HasData() {
+			return lane.buffer.Read(maxBytes)
+		}
+	}
+	return nil, io.EOF
+}
+
+// ReadRecords returns records from the first lane holding data, without
+// consuming them. The returned offset identifies the lane as well.
+func (lb *LaneBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	for i, lane := range lb.lanes {
+		records, offset, err := lane.buffer.ReadRecords(maxRecords)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s lane: %w", lane.spec.Name, err)
+		}
+		return records, offset<<laneBits | int64(i), nil
+	}
+	return nil, 0, io.EOF
+}
+
+// Commit consumes the records of a lane up to an offset returned by ReadRecords
+func (lb *LaneBuffer) Commit(offset int64) error {
+	lane := int(offset & (maxLanes - 1))
+	if offset < 0 || lane >= len(lb.lanes) {
+		return fmt.Errorf("commit offset %d doesn't belong to a lane", offset)
+	}
+	return lb.lanes[lane].buffer.Commit(offset >> laneBits)
+}
+
+// Sync flushes the writes of all lanes to disk
+func (lb *LaneBuffer) Sync() error {
+	var errs []error
+	for _, lane := range lb.lanes {
+		if syncable, ok := lane.buffer.(Syncable); ok {
+			errs = append(errs, syncable.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TakeDrops returns the drops of all lanes, naming the priority lanes
+func (lb *LaneBuffer) TakeDrops() []DropReport {
+	var reports []DropReport
+	for i, lane := range lb.lanes {
+		reporter, ok := lane.buffer.(DropReporter)
+		if !ok {
+			continue
+		}
+		for _, report := range reporter.TakeDrops() {
+			if i < len(lb.lanes)-1 {
+				report.Reason += " in the " + lane.spec.Name + " lane"
+			}
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// HasData returns true if any lane holds data
+func (lb *LaneBuffer) HasData() bool {
+	for _, lane := range lb.lanes {
+		if lane.buffer.HasData() {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSize returns the total size of all lanes
+func (lb *LaneBuffer) GetSize() int64 {
+	var size int64
+	for _, lane := range lb.lanes {
+		size += lane.buffer.GetSize()
+	}
+	return size
+}
+
+// Close closes all lanes, returning the first error
+func (lb *LaneBuffer) Close() error {
+	var errs []error
+	for _, lane := range lb.lanes {
+		if err := lane.buffer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s lane: %w", lane.spec.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseSize parses a byte size such as 1048576, 512KB, 16MB or 1GB
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+
+	number, scale := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, scale = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/scale {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectLevel(t *testing.T) {
+	tests := []struct {
+		line string
+		want int
+	}{
+		{`{"time":"2024-05-01T10:00:00Z","level":"error","msg":"failed"}`, LevelError},
+		{`{"severity": "WARNING", "message": "slow"}`, LevelWarn},
+		{`time=2024-05-01T10:00:00Z level=debug msg="cache miss"`, LevelDebug},
+		{`ts=1 lvl=info msg=started`, LevelInfo},
+		{`<11>May  1 10:00:00 web app[12]: failed`, LevelError},
+		{`<30>May  1 10:00:00 web app[12]: started`, LevelInfo},
+		{`<8>1 2024-05-01T10:00:00Z web app - - - panic`, LevelCritical},
+		{`2024-05-01 10:00:00 ERROR connection refused`, LevelError},
+		{`[FATAL] out of memory`, LevelCritical},
+		{`request served in 3ms`, LevelUnknown},
+		{`no errors found`, LevelUnknown}, // Level words only count in upper case
+	}
+
+	for _, tt := range tests {
+		if got := detectLevel([]byte(tt.line)); got != tt.want {
+			t.Errorf("detectLevel(%q) = %d, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseLaneSpec(t *testing.T) {
+	lane, err := parseLaneSpec("errors:16MB:level>=error")
+	if err != nil {
+		t.Fatalf("parseLaneSpec failed: %v", err)
+	}
+	if lane.Name != "errors" || lane.Size != 16<<20 || lane.MinLevel != LevelError || lane.Pattern != nil {
+		t.Errorf("parseLaneSpec returned %+v", lane)
+	}
+
+	// The regex may itself contain colons
+	lane, err = parseLaneSpec("audit:512KB:re:^audit: ")
+	if err != nil {
+		t.Fatalf("parseLaneSpec failed: %v", err)
+	}
+	if lane.Size != 512<<10 || lane.Pattern == nil || !lane.Pattern.MatchString("audit: login") {
+		t.Errorf("parseLaneSpec returned %+v", lane)
+	}
+
+	for _, spec := range []string{
+		"errors:16MB",
+		":16MB:level>=error",
+		"default:16MB:level>=error",
+		"a/b:16MB:level>=error",
+		"errors:lots:level>=error",
+		"errors:0:level>=error",
+		"errors:16MB:level>=loud",
+		"errors:16MB:re:(",
+		"errors:16MB:error",
+	} {
+		if _, err := parseLaneSpec(spec); err == nil {
+			t.Errorf("parseLaneSpec(%q) should fail", spec)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1048576": 1048576,
+		"100B":    100,
+		"64k":     64 << 10,
+		"512KB":   512 << 10,
+		"16MB":    16 << 20,
+		"2G":      2 << 30,
+	}
+	for s, want := range tests {
+		if got, err := parseSize(s); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1", "1.5MB", "99999999999GB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) should fail", s)
+		}
+	}
+}
+
+// newTestLanes creates a LaneBuffer of memory buffers with an errors lane
+// and an audit lane ahead of the default lane
+func newTestLanes(t *testing.T, laneSize, defaultSize int64) *LaneBuffer {
+	t.Helper()
+	specs := []laneSpec{
+		mustParseLane(t, "errors:1MB:level>=error"),
+		mustParseLane(t, "audit:1MB:re:^audit:"),
+	}
+	var buffers []BufferInterface
+	for _, size := range []int64{laneSize, laneSize, defaultSize} {
+		buffer, err := NewMemoryBuffer(size, BufferOptions{})
+		if err != nil {
+			t.Fatalf("Failed to create memory buffer: %v", err)
+		}
+		buffers = append(buffers, buffer)
+	}
+	lb, err := NewLaneBuffer(specs, buffers)
+	if err != nil {
+		t.Fatalf("NewLaneBuffer failed: %v", err)
+	}
+	t.Cleanup(func() { lb.Close() })
+	return lb
+}
+
+func mustParseLane(t *testing.T, spec string) laneSpec {
+	t.Helper()
+	lane, err := parseLaneSpec(spec)
+	if err != nil {
+		t.Fatalf("parseLaneSpec(%q) failed: %v", spec, err)
+	}
+	return lane
+}
+
+func TestLaneBufferDrainsByPriority(t *testing.T) {
+	lb := newTestLanes(t, 1<<20, 1<<20)
+
+	for _, line := range []string{
+		"level=info msg=one\n",
+		"audit: user logged in\n",
+		"level=error msg=two\n",
+		"level=info msg=three\n",
+		"level=fatal msg=four\n",
+	} {
+		if _, err := lb.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if got, want := lb.GetSize(), int64(0); got <= want || !lb.HasData() {
+		t.Fatalf("GetSize() = %d, HasData() = %v after writes", got, lb.HasData())
+	}
+
+	// Errors come first, then audit logs, then everything else, each in order
+	want := [][]string{
+		{"level=error msg=two\n", "level=fatal msg=four\n"},
+		{"audit: user logged in\n"},
+		{"level=info msg=one\n", "level=info msg=three\n"},
+	}
+	for _, batch := range want {
+		records, offset, err := lb.ReadRecords(10)
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		if len(records) != len(batch) {
+			t.Fatalf("ReadRecords returned %q, want %q", records, batch)
+		}
+		for i := range batch {
+			if string(records[i]) != batch[i] {
+				t.Errorf("ReadRecords returned %q, want %q", records, batch)
+			}
+		}
+		if err := lb.Commit(offset); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+
+	if lb.HasData() || lb.GetSize() != 0 {
+		t.Error("Buffer should be empty after committing every lane")
+	}
+	if _, _, err := lb.ReadRecords(10); err != io.EOF {
+		t.Errorf("ReadRecords on empty buffer error = %v, want io.EOF", err)
+	}
+	if err := lb.Commit(7); err == nil {
+		t.Error("Expected an error committing an offset of a lane that doesn't exist")
+	}
+}
+
+func TestLaneBufferCommitAfterHigherPriorityWrite(t *testing.T) {
+	lb := newTestLanes(t, 1<<20, 1<<20)
+	lb.Write([]byte("INFO first\n"))
+
+	records, offset, err := lb.ReadRecords(10)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadRecords returned %q, %v", records, err)
+	}
+
+	// An error arriving while the batch is in flight must not confuse the commit
+	lb.Write([]byte("ERROR second\n"))
+	if err := lb.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	data, err := lb.Read(1024)
+	if err != nil || string(data) != "ERROR second\n" {
+		t.Errorf("Read returned %q, %v", data, err)
+	}
+	if lb.HasData() {
+		t.Error("Buffer should be empty")
+	}
+}
+
+func TestLaneBufferBudgets(t *testing.T) {
+	// A small default lane overflows without touching the errors lane
+	lb := newTestLanes(t, 1<<20, 1024)
+
+	lb.Write([]byte("ERROR disk failing\n"))
+	for i := 0; i < 200; i++ {
+		lb.Write([]byte(testLogLine(i)))
+	}
+
+	data, err := lb.Read(1 << 20)
+	if err != nil || string(data) != "ERROR disk failing\n" {
+		t.Errorf("Read returned %q, %v, want the error line", data, err)
+	}
+
+	drops := lb.TakeDrops()
+	if len(drops) != 1 || drops[0].Lines == 0 {
+		t.Fatalf("TakeDrops returned %+v, want drops from the default lane", drops)
+	}
+	if strings.Contains(drops[0].Reason, "lane") {
+		t.Errorf("Default lane drop reason %q shouldn't name a lane", drops[0].Reason)
+	}
+
+	// Overflowing a priority lane names it
+	lb = newTestLanes(t, 256, 1<<20)
+	for i := 0; i < 20; i++ {
+		lb.Write([]byte(fmt.Sprintf("ERROR request %d failed after %d retries\n", i, i%4)))
+	}
+	drops = lb.TakeDrops()
+	if len(drops) != 1 || !strings.HasSuffix(drops[0].Reason, "in the errors lane") {
+		t.Errorf("TakeDrops returned %+v, want drops from the errors lane", drops)
+	}
+}
+
+func TestOpenBufferWithLanes(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		BufferType:    BufferTypeFile,
+		BufferPath:    filepath.Join(dir, "buffer.log"),
+		MaxSize:       1 << 20,
+		PriorityLanes: laneFlags{mustParseLane(t, "errors:64KB:level>=error")},
+	}
+
+	buffer, err := openBuffer(cfg)
+	if err != nil {
+		t.Fatalf("openBuffer failed: %v", err)
+	}
+	buffer.Write([]byte("INFO kept for later\n"))
+	buffer.Write([]byte("ERROR sent first\n"))
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, name := range []string{"buffer.log", "buffer-lane-errors.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected buffer file %s: %v", name, err)
+		}
+	}
+
+	// Both lanes survive a restart
+	buffer, err = openBuffer(cfg)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	defer buffer.Close()
+	for _, want := range []string{"ERROR sent first\n", "INFO kept for later\n"} {
+		data, err := buffer.Read(1024)
+		if err != nil || string(data) != want {
+			t.Errorf("Read returned %q, %v, want %q", data, err, want)
+		}
+	}
+}
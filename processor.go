@@ -3,55 +3,269 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"time"
 )
 
-// ProcessInput reads from stdin and writes to the buffer
-func ProcessInput(ctx context.Context, buffer BufferInterface, hostname, programName string, signal chan struct{}, cfg *Config) {
-	scanner := bufio.NewScanner(os.Stdin)
+// blockedWriteInterval is how often a blocked write retries a full buffer
+const blockedWriteInterval = 50 * time.Millisecond
+
+// DefaultWriteWindow is how long ProcessInput waits by default for more input
+// lines to write to the buffer together
+const DefaultWriteWindow = 2 * time.Millisecond
+
+// writeToBuffer writes a record to the buffer. With the block overflow policy
+// it waits for the sender to free space instead of failing with ErrBufferFull,
+// which stops reading input and so applies backpressure to the producer.
+func writeToBuffer(ctx context.Context, buffer BufferInterface, data []byte, signal chan struct{}, cfg *Config) error {
+	_, err := buffer.Write(data)
+	if !errors.Is(err, ErrBufferFull) || cfg.OverflowPolicy != OverflowBlock {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Buffer full, pausing input until logs are delivered\n")
+	ticker := time.NewTicker(blockedWriteInterval)
+	defer ticker.Stop()
+
+	for {
+		// Make sure the sender is draining the buffer
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		_, err = buffer.Write(data)
+		if !errors.Is(err, ErrBufferFull) {
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "Buffer has space again, resuming input\n")
+			}
+			return err
+		}
+	}
+}
+
+// Limits of the batches ProcessInput writes to the buffer at once
+const (
+	maxWriteBatchLines = 1024
+	maxWriteBatchBytes = 1024 * 1024
+)
+
+// writeBatchToBuffer writes lines to the buffer in as few batches as
+// possible. A line that fails is handled like a single failed write: dropped
+// if the buffer is full, waited on under the block policy, or reported.
+func writeBatchToBuffer(ctx context.Context, buffer BufferInterface, lines [][]byte, signal chan struct{}, cfg *Config) {
+	for len(lines) > 0 {
+		n, err := buffer.WriteBatch(lines)
+		if err == nil {
+			return
+		}
+		if n >= len(lines) {
+			// Every line was stored, but the write didn't complete
+			fmt.Fprintf(os.Stderr, "Error writing to buffer: %v\n", err)
+			return
+		}
+
+		line := lines[n]
+		lines = lines[n+1:]
+		if errors.Is(err, ErrBufferFull) && cfg.OverflowPolicy == OverflowBlock {
+			err = writeToBuffer(ctx, buffer, line, signal, cfg)
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrBufferFull):
+			debugf("Buffer full, dropping new log line")
+		case ctx.Err() != nil:
+			return
+		default:
+			fmt.Fprintf(os.Stderr, "Error writing to buffer: %v\n", err)
+		}
+	}
+}
+
+// readLines sends the lines of r, newline terminated, to lines until r ends
+// or stop is closed, then closes lines
+func readLines(r io.Reader, lines chan<- []byte, stop <-chan struct{}) error {
+	defer close(lines)
+	scanner := bufio.NewScanner(r)
 
 	// Increase the buffer size to handle large lines
 	const maxScannerBuffer = 256 * 1024 // 256KB
 	buf := make([]byte, maxScannerBuffer)
 	scanner.Buffer(buf, maxScannerBuffer)
 
+	for scanner.Scan() {
+		// Just append a newline for readability in the buffer
+		text := untaggedLine(scanner.Bytes())
+		line := append(append(make([]byte, 0, len(text)+1), text...), '\n')
+		select {
+		case lines <- line:
+		case <-stop:
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// collectBatch starts a batch with first and adds the lines that arrive within
+// window, up to the batch limits. Without a window, only lines that are
+// already waiting are added. It reports whether lines is still open.
+func collectBatch(lines <-chan []byte, first []byte, window time.Duration) ([][]byte, bool) {
+	batch, size := [][]byte{first}, len(first)
+
+	var expired <-chan time.Time
+	if window > 0 {
+		timer := time.NewTimer(window)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for len(batch) < maxWriteBatchLines && size < maxWriteBatchBytes {
+		var line []byte
+		var ok bool
+		if expired == nil {
+			select {
+			case line, ok = <-lines:
+			default:
+				return batch, true
+			}
+		} else {
+			select {
+			case line, ok = <-lines:
+			case <-expired:
+				return batch, true
+			}
+		}
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, line)
+		size += len(line)
+	}
+	return batch, true
+}
+
+// bufferLines writes the lines sent by concurrent inputs to the buffer, in
+// batches as ProcessInput does, until lines is closed
+func bufferLines(ctx context.Context, buffer BufferInterface, lines <-chan []byte, signal chan struct{}, cfg *Config) {
+	for line := range lines {
+		batch, open := collectBatch(lines, line, cfg.WriteWindow)
+		writeBatchToBuffer(ctx, buffer, batch, signal, cfg)
+
+		// Signal new logs (non-blocking)
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// drainLines writes the lines already waiting in lines to the buffer without
+// waiting for more, so that input accepted before shutdown isn't lost
+func drainLines(ctx context.Context, buffer BufferInterface, lines <-chan []byte, signal chan struct{}, cfg *Config) {
+	defer func() {
+		// Signal new logs (non-blocking)
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	}()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			batch, open := collectBatch(lines, line, 0)
+			writeBatchToBuffer(ctx, buffer, batch, signal, cfg)
+			if !open {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// serveLines runs a listening input until ctx is done: receive sends the
+// lines it receives until stop is called, and they are written to the buffer.
+// Lines received before stop are written before serveLines returns.
+func serveLines(ctx context.Context, buffer BufferInterface, signal chan struct{}, cfg *Config, receive func(lines chan<- []byte), stop func()) {
+	lines := make(chan []byte, maxWriteBatchLines)
+	written := make(chan struct{})
+	go func() {
+		bufferLines(ctx, buffer, lines, signal, cfg)
+		close(written)
+	}()
+	received := make(chan struct{})
+	go func() {
+		receive(lines)
+		close(received)
+	}()
+
+	<-ctx.Done()
+	stop()
+	<-received
+	close(lines)
+	<-written
+}
+
+// ProcessInput reads from stdin and writes to the buffer. Lines that arrive
+// within the write window of each other are written as one batch.
+func ProcessInput(ctx context.Context, buffer BufferInterface, hostname, programName string, signal chan struct{}, cfg *Config) {
+	buffer = bufferForSource(buffer, logSource{Program: programName})
+
+	lines := make(chan []byte, maxWriteBatchLines)
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func(stdin io.Reader) {
+		readErr <- readLines(stdin, lines, stop)
+	}(os.Stdin)
+
+	// Echo lines to stdout unless in quiet mode, once per batch
+	echo := bufio.NewWriter(os.Stdout)
+
 	// Track if we got any logs to process
 	hasProcessedLogs := false
 
-	for scanner.Scan() {
-		// Check if we should exit
+	for open := true; open; {
+		var line []byte
 		select {
 		case <-ctx.Done():
+			// Lines read from stdin are written before exiting
+			close(stop)
+			drainLines(ctx, buffer, lines, signal, cfg)
 			return
-		default:
+		case line, open = <-lines:
+		}
+		if !open {
+			break
 		}
 
-		line := scanner.Text()
+		var batch [][]byte
+		batch, open = collectBatch(lines, line, cfg.WriteWindow)
 		hasProcessedLogs = true
 
-		// Echo the line to stdout if not in quiet mode
 		if !cfg.Quiet {
-			fmt.Println(line)
-		}
-
-		// We'll just store the raw message and format it later in the HTTP client
-		// Just append a newline for readability in the buffer
-		logMessage := line + "\n"
-
-		// Write to buffer
-		if _, err := buffer.Write([]byte(logMessage)); err != nil {
-			fmt.Fprintf(os.Stderr, "Error writing to buffer: %v\n", err)
-			// Check context before continuing
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
+			for _, line := range batch {
+				echo.Write(line)
 			}
+			echo.Flush()
 		}
 
+		writeBatchToBuffer(ctx, buffer, batch, signal, cfg)
+
 		// Signal new logs (non-blocking)
 		select {
 		case signal <- struct{}{}:
@@ -59,7 +273,7 @@ func ProcessInput(ctx context.Context, buffer BufferInterface, hostname, program
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := <-readErr; err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
 	}
 
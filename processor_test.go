@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -552,3 +554,102 @@ func TestProcessInputEmptyLines(t *testing.T) {
 		t.Error("Buffer doesn't contain the actual message")
 	}
 }
+
+// batchCountingBuffer counts the writes made to a mock buffer
+type batchCountingBuffer struct {
+	*MockBuffer
+	mutex   sync.Mutex
+	batches int
+	lines   int
+}
+
+func (b *batchCountingBuffer) WriteBatch(data [][]byte) (int, error) {
+	b.mutex.Lock()
+	b.batches++
+	b.lines += len(data)
+	b.mutex.Unlock()
+	return b.MockBuffer.WriteBatch(data)
+}
+
+func (b *batchCountingBuffer) counts() (int, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.batches, b.lines
+}
+
+func TestProcessInputBatchesLines(t *testing.T) {
+	buffer := &batchCountingBuffer{MockBuffer: NewMockBuffer()}
+
+	originalStdin := os.Stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stdin = r
+	defer func() {
+		os.Stdin = originalStdin
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	testConfig := &Config{Quiet: true, WriteWindow: 50 * time.Millisecond}
+	go func() {
+		ProcessInput(ctx, buffer, "test-host", "test-program", make(chan struct{}, 1), testConfig)
+		close(done)
+	}()
+
+	// Lines arriving together are written together
+	var input strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&input, "line %d\n", i)
+	}
+	if _, err := io.WriteString(w, input.String()); err != nil {
+		t.Fatalf("Failed to write to pipe: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, lines := buffer.counts(); lines == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the lines to be buffered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if batches, _ := buffer.counts(); batches > 10 {
+		t.Errorf("200 lines were written in %d batches, want them coalesced", batches)
+	}
+
+	records, _, err := buffer.ReadRecords(1000)
+	if err != nil || len(records) != 200 || string(records[199]) != "line 199\n" {
+		t.Errorf("Buffered %d records, %v, want the 200 lines in order", len(records), err)
+	}
+
+	cancel()
+	w.Close()
+	<-done
+}
+
+func TestDrainLines(t *testing.T) {
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+
+	// Lines read before shutdown are written even though ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lines := make(chan []byte, maxWriteBatchLines)
+	for i := 0; i < 3; i++ {
+		lines <- []byte(fmt.Sprintf("line %d\n", i))
+	}
+	drainLines(ctx, buffer, lines, make(chan struct{}, 1), &Config{})
+
+	if got := readAllRecords(t, buffer); strings.Join(got, "") != "line 0\nline 1\nline 2\n" {
+		t.Errorf("Drained %q", got)
+	}
+}
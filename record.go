@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Record layout
+//
+// Every Write to a CircularBuffer is stored as one record so that a log line
+// is always read back, overwritten or dropped as a whole:
+//
+//	length(4) crc32(4) payload(length)
+//
+// The CRC covers the payload only. A zero length is never written, which lets
+// zero-filled regions of the file be recognized as invalid.
+//
+// The top bits of the length word hold flags describing how the payload is
+// encoded (such as encryption). Records without flags look exactly like those
+// written before flags existed. The CRC of a flagged record also covers the
+// flags byte.
+const (
+	recordHeaderSize = 8
+	recordFlagShift  = 28
+	maxRecordPayload = 1<<recordFlagShift - 1
+)
+
+// Record flags
+const (
+	recordEncrypted   uint8 = 1 << 0 // Payload is sealed with AES-GCM, see encryption.go
+	recordCompressed  uint8 = 1 << 1 // Payload is compressed (before any encryption), see compression.go
+	recordTimestamped uint8 = 1 << 2 // Payload starts with the time the record was written, see codec.go
+)
+
+// record is a decoded record as stored in a buffer
+type record struct {
+	payload []byte // Stored payload, still encoded as described by flags
+	flags   uint8
+}
+
+// errCorruptRecord is returned when a record header or checksum is invalid
+var errCorruptRecord = errors.New("corrupt buffer record")
+
+// encodeRecord frames a payload as a record
+func encodeRecord(payload []byte, flags uint8) []byte {
+	return appendRecord(make([]byte, 0, recordHeaderSize+len(payload)), payload, flags)
+}
+
+// appendRecord appends a payload framed as a record to dst
+func appendRecord(dst, payload []byte, flags uint8) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(flags)<<recordFlagShift|uint32(len(payload)))
+	dst = binary.LittleEndian.AppendUint32(dst, recordChecksum(payload, flags))
+	return append(dst, payload...)
+}
+
+// recordChecksum computes the checksum stored in a record header
+func recordChecksum(payload []byte, flags uint8) uint32 {
+	checksum := crc32.ChecksumIEEE(payload)
+	if flags != 0 {
+		checksum = crc32.Update(checksum, crc32.IEEETable, []byte{flags})
+	}
+	return checksum
+}
+
+// parseRecordHeader returns the payload length, flags and checksum from a record header
+func parseRecordHeader(header []byte) (int64, uint8, uint32) {
+	word := binary.LittleEndian.Uint32(header[0:4])
+	return int64(word & maxRecordPayload), uint8(word >> recordFlagShift), binary.LittleEndian.Uint32(header[4:8])
+}
+
+// recordSize returns the number of bytes a payload occupies once framed
+func recordSize(payloadLen int) int64 {
+	return int64(recordHeaderSize + payloadLen)
+}
+
+// readAtFunc reads n bytes at a logical position of some record storage
+type readAtFunc func(pos, n int64) ([]byte, error)
+
+// readRecordAt reads and verifies the record at pos, which must fit within avail bytes
+func readRecordAt(read readAtFunc, pos, avail int64) (record, error) {
+	if avail < recordHeaderSize {
+		return record{}, errCorruptRecord
+	}
+
+	header, err := read(pos, recordHeaderSize)
+	if err != nil {
+		return record{}, err
+	}
+
+	length, flags, checksum := parseRecordHeader(header)
+	if length == 0 || recordSize(int(length)) > avail {
+		return record{}, errCorruptRecord
+	}
+
+	payload, err := read(pos+recordHeaderSize, length)
+	if err != nil {
+		return record{}, err
+	}
+	if recordChecksum(payload, flags) != checksum {
+		return record{}, errCorruptRecord
+	}
+
+	return record{payload: payload, flags: flags}, nil
+}
+
+// findRecord reads the first valid record at or after pos within avail bytes.
+// It returns the record, the number of corrupt bytes skipped before it and
+// the record's size, which is zero if no valid record was found.
+func findRecord(read readAtFunc, pos, avail int64) (record, int64, int64, error) {
+	var skipped int64
+	for avail-skipped >= recordHeaderSize {
+		rec, err := readRecordAt(read, pos+skipped, avail-skipped)
+		if err == nil {
+			return rec, skipped, recordSize(len(rec.payload)), nil
+		}
+		if err != errCorruptRecord {
+			return record{}, 0, 0, err
+		}
+		skipped++
+	}
+	return record{}, avail, 0, nil
+}
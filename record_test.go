@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func TestRecordFlags(t *testing.T) {
+	read := func(data []byte) readAtFunc {
+		return func(pos, n int64) ([]byte, error) {
+			return data[pos : pos+n], nil
+		}
+	}
+
+	// A record written before flags existed parses as unflagged
+	legacy := make([]byte, recordHeaderSize+5)
+	binary.LittleEndian.PutUint32(legacy[0:4], 5)
+	binary.LittleEndian.PutUint32(legacy[4:8], crc32.ChecksumIEEE([]byte("hello")))
+	copy(legacy[recordHeaderSize:], "hello")
+	if string(encodeRecord([]byte("hello"), 0)) != string(legacy) {
+		t.Error("Unflagged records must keep the original layout")
+	}
+
+	framed := encodeRecord([]byte("hello"), recordEncrypted)
+	rec, err := readRecordAt(read(framed), 0, int64(len(framed)))
+	if err != nil {
+		t.Fatalf("readRecordAt failed: %v", err)
+	}
+	if string(rec.payload) != "hello" || rec.flags != recordEncrypted {
+		t.Errorf("readRecordAt() = %q flags %#x, want %q flags %#x", rec.payload, rec.flags, "hello", recordEncrypted)
+	}
+
+	// The checksum covers the flags, so a flipped flag is detected
+	framed[3] ^= 0x20
+	if _, err := readRecordAt(read(framed), 0, int64(len(framed))); err != errCorruptRecord {
+		t.Errorf("readRecordAt() with a flipped flag error = %v, want errCorruptRecord", err)
+	}
+}
+
+func TestTimestampedRecords(t *testing.T) {
+	codec := recordCodec{maxAge: time.Hour}
+	before := time.Now()
+	payload, flags, err := codec.encode([]byte("hello"))
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if flags != recordTimestamped || len(payload) != recordTimeSize+5 {
+		t.Fatalf("encode returned %d bytes with flags %#x", len(payload), flags)
+	}
+
+	rec := record{payload: payload, flags: flags}
+	written, ok := recordTime(rec)
+	if !ok || written.Before(before) || written.After(time.Now()) {
+		t.Errorf("recordTime() = %v, %v", written, ok)
+	}
+	if codec.expired(rec) {
+		t.Error("A fresh record shouldn't be expired")
+	}
+
+	// Decoding doesn't need the maximum age, so any reader can strip the time
+	data, err := recordCodec{}.decode(rec)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("decode() = %q, %v", data, err)
+	}
+
+	binary.LittleEndian.PutUint64(rec.payload, uint64(before.Add(-2*time.Hour).UnixNano()))
+	if _, dropped, _ := codec.readable(rec); dropped != DropReasonExpired {
+		t.Errorf("A record older than the maximum age should be skipped as expired, got %q", dropped)
+	}
+
+	if _, err := (recordCodec{}).decode(record{payload: []byte("abc"), flags: recordTimestamped}); err == nil {
+		t.Error("Expected an error decoding a truncated timestamped record")
+	}
+}
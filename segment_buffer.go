@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segment file naming: each segment is named after the logical offset of its
+// first record, so offsets stay meaningful across segments and restarts
+const (
+	segmentSuffix     = ".seg"
+	segmentNameDigits = 20
+	segmentCursorFile = "cursor.state"
+	segmentDictFile   = "compression.dict"
+)
+
+// segment is one append-only file of records in a SegmentBuffer
+type segment struct {
+	file    *os.File
+	path    string
+	base    int64     // Logical offset of the first byte in the segment
+	size    int64     // Bytes of valid records in the segment
+	created time.Time // When the segment was started (last modified, if reopened), used for rolling by age
+}
+
+// end returns the logical offset just past the segment's last record
+func (s *segment) end() int64 {
+	return s.base + s.size
+}
+
+// SegmentBuffer implements a write-ahead log of records split across
+// append-only segment files in a directory
+type SegmentBuffer struct {
+	dir         string
+	mutex       sync.Mutex
+	segments    []*segment // Ordered by base offset; the last one is written to
+	cursorFile  *os.File   // Holds the acknowledged offset
+	cursorSeq   uint64
+	committed   int64 // Logical offset up to which records have been acknowledged
+	maxSize     int64
+	segmentSize int64
+	segmentAge  time.Duration
+	overflow    *overflowHandler // Decides what happens to records that don't fit
+	drops       dropCounter      // Records lost to overflow, reported as gap markers
+	skipped     skippedRecords   // Records the last read skipped, dropped once committed
+	syncer      *syncer          // Flushes writes to disk according to the sync policy
+	codec       recordCodec      // Encodes log data into record payloads
+	lock        *fileLock        // Keeps other processes from using the buffer
+	disk        *diskGuard       // Limits growth to keep free disk space in reserve
+}
+
+// NewSegmentBuffer opens or creates a segment buffer in dir. Segments are
+// rolled once they reach opts.SegmentSize bytes or opts.SegmentAge (zero
+// disables it).
+func NewSegmentBuffer(dir string, maxSize int64, opts BufferOptions) (*SegmentBuffer, error) {
+	segmentSize := opts.SegmentSize
+	debugf("Creating segment buffer in %s, maxSize: %d bytes, segment size: %d bytes", dir, maxSize, segmentSize)
+
+	sb := &SegmentBuffer{dir: dir, maxSize: maxSize, segmentAge: opts.SegmentAge, disk: newDiskGuard(dir, opts.MinFree)}
+	overflow, err := newOverflowHandler(opts, dir, &sb.drops)
+	if err != nil {
+		return nil, err
+	}
+	sb.overflow = overflow
+
+	// Keep several segments within the budget so that dropping the oldest
+	// one on overflow only loses a fraction of the buffer
+	if segmentSize <= 0 || segmentSize > maxSize/4 {
+		segmentSize = maxSize / 4
+	}
+	sb.segmentSize = segmentSize
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		debugf("Failed to create segment directory: %v", err)
+		return nil, fmt.Errorf("failed to create segment directory: %w", err)
+	}
+
+	// Make sure no other forwarder is using the buffer
+	lock, err := acquireLock(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+	sb.lock = lock
+
+	cursorFile, err := os.OpenFile(filepath.Join(dir, segmentCursorFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		debugf("Failed to open segment cursor file: %v", err)
+		lock.release()
+		return nil, fmt.Errorf("failed to open segment cursor file: %w", err)
+	}
+
+	sb.cursorFile = cursorFile
+
+	sb.syncer, err = newSyncer(opts, sb.syncActive)
+	if err != nil {
+		cursorFile.Close()
+		lock.release()
+		return nil, err
+	}
+
+	if err := sb.load(); err != nil {
+		sb.syncer.Close()
+		sb.closeFiles()
+		return nil, err
+	}
+
+	sb.codec, err = newRecordCodec(opts, filepath.Join(dir, segmentDictFile), sb.active().end() == sb.committed)
+	if err != nil {
+		sb.syncer.Close()
+		sb.closeFiles()
+		return nil, err
+	}
+
+	return sb, nil
+}
+
+// load opens the existing segments and restores the acknowledged offset
+func (sb *SegmentBuffer) load() error {
+	// The cursor file stores the acknowledged offset in the readPos field
+	state, err := readState(sb.cursorFile)
+	if err != nil && err != errNoState {
+		return fmt.Errorf("failed to load segment cursor: %w", err)
+	}
+	sb.cursorSeq = state.seq
+	sb.committed = state.readPos
+
+	bases, err := listSegments(sb.dir)
+	if err != nil {
+		return err
+	}
+
+	for i, base := range bases {
+		seg, err := sb.openSegment(base, false)
+		if err != nil {
+			return err
+		}
+		sb.segments = append(sb.segments, seg)
+
+		// Only the last segment can end in a torn record from a crash
+		if i == len(bases)-1 {
+			if err := sb.recoverTail(seg); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Start a fresh log if there is none yet
+	if len(sb.segments) == 0 {
+		seg, err := sb.openSegment(sb.committed, true)
+		if err != nil {
+			return err
+		}
+		sb.segments = append(sb.segments, seg)
+	}
+
+	// Keep the cursor within the segments that still exist
+	first, last := sb.segments[0], sb.segments[len(sb.segments)-1]
+	if sb.committed < first.base || sb.committed > last.end() {
+		fmt.Fprintf(os.Stderr, "Warning: segment cursor %d is outside the buffered data (%d-%d), resetting it\n",
+			sb.committed, first.base, last.end())
+		if sb.committed < first.base {
+			sb.committed = first.base
+		} else {
+			sb.committed = last.end()
+		}
+		if err := sb.persistCursor(); err != nil {
+			return err
+		}
+	}
+
+	debugf("Loaded %d segments with %d bytes pending", len(sb.segments), last.end()-sb.committed)
+	return sb.cleanup()
+}
+
+// listSegments returns the base offsets of the segments in dir, in order
+func listSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segment directory: %w", err)
+	}
+
+	var bases []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			debugf("Ignoring unexpected file in segment directory: %s", name)
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+// segmentPath returns the path of the segment in dir starting at base
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%0*d%s", segmentNameDigits, base, segmentSuffix))
+}
+
+// openSegment opens the segment file starting at base
+func (sb *SegmentBuffer) openSegment(base int64, create bool) (*segment, error) {
+	path := segmentPath(sb.dir, base)
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		debugf("Failed to open segment %s: %v", path, err)
+		return nil, fmt.Errorf("failed to open segment: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat segment: %w", err)
+	}
+
+	return &segment{file: file, path: path, base: base, size: info.Size(), created: info.ModTime()}, nil
+}
+
+// recoverTail truncates a segment after its last valid record
+func (sb *SegmentBuffer) recoverTail(seg *segment) error {
+	read := sb.segmentReader(seg)
+	var pos int64
+	for pos < seg.size {
+		rec, err := readRecordAt(read, seg.base+pos, seg.size-pos)
+		if err == errCorruptRecord {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to verify segment: %w", err)
+		}
+		pos += recordSize(len(rec.payload))
+	}
+
+	if pos < seg.size {
+		fmt.Fprintf(os.Stderr, "Warning: discarding %d bytes of incomplete data at the end of %s\n", seg.size-pos, seg.path)
+		if err := seg.file.Truncate(pos); err != nil {
+			return fmt.Errorf("failed to truncate segment: %w", err)
+		}
+		seg.size = pos
+	}
+	return nil
+}
+
+// segmentReader returns a readAtFunc addressing a segment by logical offset
+func (sb *SegmentBuffer) segmentReader(seg *segment) readAtFunc {
+	return func(pos, n int64) ([]byte, error) {
+		data := make([]byte, n)
+		if _, err := seg.file.ReadAt(data, pos-seg.base); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// persistCursor records the acknowledged offset
+func (sb *SegmentBuffer) persistCursor() error {
+	sb.cursorSeq++
+	return writeState(sb.cursorFile, bufferState{seq: sb.cursorSeq, readPos: sb.committed})
+}
+
+// active returns the segment new records are appended to
+func (sb *SegmentBuffer) active() *segment {
+	return sb.segments[len(sb.segments)-1]
+}
+
+// diskSize returns the bytes held by all segments
+func (sb *SegmentBuffer) diskSize() int64 {
+	var total int64
+	for _, seg := range sb.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// syncActive flushes the active segment and the cursor file. Older segments
+// are flushed when they are rolled, whatever the sync policy, so that Sync
+// covers them too.
+func (sb *SegmentBuffer) syncActive() error {
+	sb.mutex.Lock()
+	files := []bufferFile{sb.cursorFile}
+	if len(sb.segments) > 0 {
+		files = []bufferFile{sb.active().file, sb.cursorFile}
+	}
+	sb.mutex.Unlock()
+	return syncFiles(files...)
+}
+
+// roll closes the active segment for writing and starts a new one
+func (sb *SegmentBuffer) roll() error {
+	// The syncer only flushes the active segment, so finish this one now
+	if err := sb.active().file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+
+	seg, err := sb.openSegment(sb.active().end(), true)
+	if err != nil {
+		return err
+	}
+	debugf("Rolled to new segment %s", seg.path)
+	sb.segments = append(sb.segments, seg)
+	return sb.cleanup()
+}
+
+// dropOldest deletes the oldest segment, even if it was not yet acknowledged
+func (sb *SegmentBuffer) dropOldest() error {
+	if len(sb.segments) == 1 {
+		if err := sb.roll(); err != nil {
+			return err
+		}
+	}
+
+	oldest := sb.segments[0]
+	if sb.committed < oldest.end() {
+		debugf("Buffer full, dropping %d unacknowledged bytes in %s", oldest.end()-sb.committed, oldest.path)
+		if err := sb.countDropped(oldest); err != nil {
+			return err
+		}
+		sb.committed = oldest.end()
+		if err := sb.persistCursor(); err != nil {
+			return err
+		}
+	}
+	return sb.cleanup()
+}
+
+// countDropped counts the unacknowledged records of a segment that is about to be dropped
+func (sb *SegmentBuffer) countDropped(seg *segment) error {
+	read := sb.segmentReader(seg)
+	var lines, bytes int64
+	for pos := sb.committed; pos < seg.end(); {
+		rec, skipped, recLen, err := findRecord(read, pos, seg.end()-pos)
+		if err != nil {
+			return err
+		}
+		if recLen > 0 {
+			lines++
+			bytes += int64(len(rec.payload))
+		}
+		pos += skipped + recLen
+	}
+	sb.drops.add(DropReasonOverflow, lines, bytes)
+	return nil
+}
+
+// cleanup deletes segments that have been fully acknowledged, except the active one
+func (sb *SegmentBuffer) cleanup() error {
+	for len(sb.segments) > 1 && sb.segments[0].end() <= sb.committed {
+		seg := sb.segments[0]
+		debugf("Deleting acknowledged segment %s", seg.path)
+		seg.file.Close()
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete segment: %w", err)
+		}
+		sb.disk.freed(seg.size)
+		sb.segments = sb.segments[1:]
+	}
+	return nil
+}
+
+// Write appends data to the active segment as a single record. Depending on
+// the sync policy it returns only once the record is on disk.
+func (sb *SegmentBuffer) Write(data []byte) (int, error) {
+	// Empty records are never stored
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	payload, flags, err := sb.codec.encode(data)
+	if err != nil {
+		return 0, err
+	}
+
+	n, seq, err := sb.write(data, record{payload: payload, flags: flags})
+	if err != nil || seq == 0 {
+		return n, err
+	}
+	if err := sb.syncer.wait(seq); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// write appends rec, the encoded form of data, and returns the sync sequence
+// number of the write, which is zero if nothing was written to the buffer
+func (sb *SegmentBuffer) write(data []byte, rec record) (int, uint64, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	var w stagedWrite
+	n, err := sb.add(&w, data, rec)
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := sb.finishWrite(&w)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, seq, nil
+}
+
+// WriteBatch appends several records under a single lock, with a single write
+// for the records that go to the same segment
+func (sb *SegmentBuffer) WriteBatch(data [][]byte) (int, error) {
+	recs, encodeErr := encodeBatch(sb.codec, data)
+
+	sb.mutex.Lock()
+	var w stagedWrite
+	n := 0
+	var err error
+	for ; n < len(recs); n++ {
+		if len(data[n]) == 0 {
+			continue
+		}
+		if _, err = sb.add(&w, data[n], recs[n]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = encodeErr
+	}
+	seq, finishErr := sb.finishWrite(&w)
+	if finishErr != nil {
+		err = finishErr
+	}
+	// Records that failed to be written were the last ones added
+	n -= w.lost
+	sb.mutex.Unlock()
+
+	if seq != 0 {
+		if err := sb.syncer.wait(seq); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// add makes room for rec, the encoded form of data, and stages it in w. It
+// returns the bytes of data stored, which includes records taken by the
+// overflow policy. Rolling or dropping segments writes the staged records
+// first. The caller must hold the mutex.
+func (sb *SegmentBuffer) add(w *stagedWrite, data []byte, rec record) (int, error) {
+	recLen := recordSize(len(rec.payload))
+	if recLen > sb.maxSize || len(rec.payload) > maxRecordPayload {
+		return 0, fmt.Errorf("data exceeds maximum buffer size")
+	}
+
+	// Roll the active segment by size or age
+	seg := sb.active()
+	if seg.size > 0 && (seg.size+recLen > sb.segmentSize ||
+		(sb.segmentAge > 0 && time.Since(seg.created) >= sb.segmentAge)) {
+		if err := sb.flushStaged(w); err != nil {
+			return 0, err
+		}
+		if err := sb.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	// The free space reserve can leave less room than maxSize
+	limit := sb.maxSize
+	if room := sb.disk.available(); room < limit-sb.diskSize() {
+		limit = sb.diskSize() + room
+		if sb.diskSize()+recLen > limit {
+			sb.disk.refused()
+		}
+	}
+
+	if sb.diskSize()+recLen > limit {
+		if err := sb.flushStaged(w); err != nil {
+			return 0, err
+		}
+	}
+
+	// Without room, let the overflow policy decide what to do with the record;
+	// space is only reclaimed once a whole segment has been acknowledged
+	if sb.diskSize()+recLen > limit && !sb.overflow.dropsOldest() {
+		return sb.overflow.handle(data)
+	}
+
+	// Enforce the size budget across all segments
+	for sb.diskSize()+recLen > limit && sb.diskSize() > 0 {
+		if err := sb.dropOldest(); err != nil {
+			return 0, err
+		}
+	}
+	if sb.diskSize()+recLen > limit {
+		return sb.overflow.refuse(data)
+	}
+
+	seg = sb.active()
+	w.add(seg.size, rec)
+	seg.size += recLen
+	sb.disk.wrote(recLen)
+	return len(data), nil
+}
+
+// flushStaged writes the staged records to the active segment. If that fails,
+// they are taken back out of the buffer. The caller must hold the mutex.
+func (sb *SegmentBuffer) flushStaged(w *stagedWrite) error {
+	if w.count == 0 {
+		return nil
+	}
+	seg := sb.active()
+	if _, err := seg.file.WriteAt(w.data, w.pos); err != nil {
+		seg.size = w.pos
+		sb.disk.freed(int64(len(w.data)))
+		w.abandon()
+		return err
+	}
+	w.reset()
+	return nil
+}
+
+// finishWrite writes the staged records, returning the sync sequence number
+// of the write, or zero if nothing was added to the buffer; the caller must
+// hold the mutex
+func (sb *SegmentBuffer) finishWrite(w *stagedWrite) (uint64, error) {
+	err := sb.flushStaged(w)
+	if w.size == 0 {
+		return 0, err
+	}
+	return sb.syncer.wrote(w.size), err
+}
+
+// Read reads and consumes whole records, returning their concatenated payloads
+func (sb *SegmentBuffer) Read(maxBytes int64) ([]byte, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	records, offset, err := sb.readRecords(-1, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := sb.commit(offset); err != nil {
+		return nil, err
+	}
+
+	return bytes.Join(records, nil), nil
+}
+
+// ReadRecords returns up to maxRecords records without consuming them
+func (sb *SegmentBuffer) ReadRecords(maxRecords int) ([][]byte, int64, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.readRecords(maxRecords, -1)
+}
+
+// Commit acknowledges all records up to an offset returned by ReadRecords
+func (sb *SegmentBuffer) Commit(offset int64) error {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.commit(offset)
+}
+
+// readRecords reads records from the acknowledged offset onwards; see
+// CircularBuffer.readRecords for the limits. The caller must hold the mutex.
+func (sb *SegmentBuffer) readRecords(maxRecords int, maxBytes int64) ([][]byte, int64, error) {
+	pos := sb.committed
+	if pos >= sb.active().end() {
+		return nil, 0, io.EOF
+	}
+
+	var records [][]byte
+	var skippedRecs skippedRecords
+	var payloadBytes int64
+	defer func() { sb.skipped = skippedRecs }()
+
+	for _, seg := range sb.segments {
+		if seg.end() <= pos {
+			continue
+		}
+
+		read := sb.segmentReader(seg)
+		for pos < seg.end() && (maxRecords < 0 || len(records) < maxRecords) {
+			rec, skipped, recLen, err := findRecord(read, pos, seg.end()-pos)
+			if err != nil {
+				return nil, 0, err
+			}
+			if skipped > 0 {
+				fmt.Fprintf(os.Stderr, "Warning: skipped %d bytes of corrupt buffer data in %s\n", skipped, seg.path)
+			}
+
+			var payload []byte
+			var dropped string
+			if recLen > 0 {
+				payload, dropped, err = sb.codec.readable(rec)
+				if err != nil && pos > sb.committed {
+					// Deliver what comes before the record first
+					return records, pos, nil
+				}
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+
+			// Stop before exceeding maxBytes, but always return at least one record
+			if recLen > 0 && maxBytes >= 0 && len(records) > 0 && payloadBytes+int64(len(payload)) > maxBytes {
+				return records, pos, nil
+			}
+
+			pos += skipped + recLen
+			switch {
+			case dropped != "":
+				skippedRecs = append(skippedRecs, skippedRecord{pos, dropped, int64(len(rec.payload))})
+			case recLen > 0:
+				records = append(records, payload)
+				payloadBytes += int64(len(payload))
+			}
+		}
+
+		if maxRecords >= 0 && len(records) >= maxRecords {
+			break
+		}
+	}
+
+	return records, pos, nil
+}
+
+// commit acknowledges records up to offset; the caller must hold the mutex
+func (sb *SegmentBuffer) commit(offset int64) error {
+	// Data before the cursor was already acknowledged or dropped
+	if offset <= sb.committed {
+		return nil
+	}
+	if offset > sb.active().end() {
+		return fmt.Errorf("commit offset %d is beyond buffered data", offset)
+	}
+
+	sb.skipped = sb.skipped.commit(sb.committed, offset, &sb.drops)
+	sb.committed = offset
+	if err := sb.persistCursor(); err != nil {
+		return err
+	}
+	sb.syncer.wrote(0)
+	return sb.cleanup()
+}
+
+// Sync flushes everything written so far to disk, whatever the sync policy
+func (sb *SegmentBuffer) Sync() error {
+	sb.mutex.Lock()
+	spillErr := sb.overflow.sync()
+	sb.mutex.Unlock()
+	if err := sb.syncer.flush(); err != nil {
+		return err
+	}
+	return spillErr
+}
+
+// TakeDrops returns the records lost to overflow since the last call
+func (sb *SegmentBuffer) TakeDrops() []DropReport {
+	return sb.drops.take()
+}
+
+// HasData returns true if there are unacknowledged records
+func (sb *SegmentBuffer) HasData() bool {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.active().end() > sb.committed
+}
+
+// GetSize returns the number of unacknowledged bytes stored in the segments,
+// counting compressed records with their compressed size
+func (sb *SegmentBuffer) GetSize() int64 {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.active().end() - sb.committed
+}
+
+// Close flushes and closes all segment files
+func (sb *SegmentBuffer) Close() error {
+	syncErr := sb.syncer.Close()
+
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	debugf("Closing segment buffer")
+	if err := sb.closeFiles(); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+// closeFiles closes the segment, cursor and lock files, returning the first error
+func (sb *SegmentBuffer) closeFiles() error {
+	var firstErr error
+	for _, seg := range sb.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := sb.cursorFile.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := sb.overflow.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := sb.lock.release(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
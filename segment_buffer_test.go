@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countSegments returns the number of segment files in dir
+func countSegments(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	return len(matches)
+}
+
+func TestSegmentBufferBasic(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "segment-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	buf, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1024*1024, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer buf.Close()
+
+	if buf.HasData() {
+		t.Error("New buffer should be empty")
+	}
+
+	buf.Write([]byte("line one\n"))
+	buf.Write([]byte("line two\n"))
+
+	if got, want := buf.GetSize(), recordSize(9)*2; got != want {
+		t.Errorf("GetSize() = %d, want %d", got, want)
+	}
+
+	records, offset, err := buf.ReadRecords(1)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 1 || string(records[0]) != "line one\n" {
+		t.Errorf("ReadRecords returned %q, expected [%q]", records, "line one\n")
+	}
+	if err := buf.Commit(offset); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	data, err := buf.Read(1024)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(data) != "line two\n" {
+		t.Errorf("Read returned %q, expected %q", data, "line two\n")
+	}
+	if buf.HasData() {
+		t.Error("Buffer should be empty after reading everything")
+	}
+
+	if err := buf.Commit(offset + 1000); err == nil {
+		t.Error("Expected error committing beyond buffered data")
+	}
+}
+
+func TestSegmentBufferRollAndDelete(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "segment-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "wal")
+	buf, err := NewSegmentBuffer(dir, 1024*1024, BufferOptions{SegmentSize: 200})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer buf.Close()
+
+	for i := 0; i < 20; i++ {
+		buf.Write([]byte(fmt.Sprintf("message number %02d\n", i)))
+	}
+	if n := countSegments(t, dir); n < 3 {
+		t.Fatalf("Expected writes to roll several segments, got %d", n)
+	}
+
+	// Acknowledging everything deletes all but the active segment
+	for buf.HasData() {
+		if _, err := buf.Read(1024); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if n := countSegments(t, dir); n != 1 {
+		t.Errorf("Expected only the active segment to remain, got %d", n)
+	}
+}
+
+func TestSegmentBufferRollByAge(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "segment-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "wal")
+	buf, err := NewSegmentBuffer(dir, 1024*1024, BufferOptions{SegmentAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer buf.Close()
+
+	buf.Write([]byte("early\n"))
+	time.Sleep(100 * time.Millisecond)
+	buf.Write([]byte("late\n"))
+
+	if n := countSegments(t, dir); n != 2 {
+		t.Errorf("Expected an old segment to be rolled, got %d segments", n)
+	}
+}
+
+func TestSegmentBufferMaxSize(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "segment-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	maxSize := int64(1000)
+	buf, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), maxSize, BufferOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	defer buf.Close()
+
+	for i := 0; i < 200; i++ {
+		if _, err := buf.Write([]byte(fmt.Sprintf("message number %03d\n", i))); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+		if size := buf.diskSize(); size > maxSize {
+			t.Fatalf("Segments hold %d bytes, more than maxSize %d", size, maxSize)
+		}
+	}
+
+	// The oldest records were dropped and the newest kept, in order
+	data, err := buf.Read(maxSize)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if last := lines[len(lines)-1]; last != "message number 199" {
+		t.Errorf("Last record = %q, expected the newest one", last)
+	}
+
+	if _, err := buf.Write(make([]byte, maxSize)); err == nil {
+		t.Error("Expected error writing a record larger than maxSize")
+	}
+}
+
+func TestSegmentBufferReopen(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "segment-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	dir := filepath.Join(tmpdir, "wal")
+	buf, err := NewSegmentBuffer(dir, 1024*1024, BufferOptions{SegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		buf.Write([]byte(fmt.Sprintf("message number %d\n", i)))
+	}
+	buf.Read(int64(len("message number 0\n")))
+	active := buf.active()
+	buf.Close()
+
+	// Simulate a torn write at the end of the last segment
+	f, err := os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.Write([]byte{0x20, 0, 0, 0, 1, 2})
+	f.Close()
+
+	buf, err = NewSegmentBuffer(dir, 1024*1024, BufferOptions{SegmentSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to reopen segment buffer: %v", err)
+	}
+	defer buf.Close()
+
+	records, _, err := buf.ReadRecords(100)
+	if err != nil {
+		t.Fatalf("ReadRecords failed: %v", err)
+	}
+	if len(records) != 9 || string(records[0]) != "message number 1\n" {
+		t.Errorf("ReadRecords after reopen returned %d records starting with %q", len(records), records[0])
+	}
+
+	// New writes go after the recovered tail
+	buf.Write([]byte("after reopen\n"))
+	records, _, _ = buf.ReadRecords(100)
+	if last := records[len(records)-1]; string(last) != "after reopen\n" {
+		t.Errorf("Last record = %q, expected %q", last, "after reopen\n")
+	}
+}
+
+func TestOpenBuffer(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "segment-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	tests := []struct {
+		bufferType string
+		wantType   string
+		wantErr    bool
+	}{
+		{"", "*main.CircularBuffer", false},
+		{BufferTypeFile, "*main.CircularBuffer", false},
+		{BufferTypeSegment, "*main.SegmentBuffer", false},
+		{BufferTypeMemory, "*main.MemoryBuffer", false},
+		{"tape", "", true},
+	}
+
+	for i, tc := range tests {
+		cfg := &Config{
+			BufferType: tc.bufferType,
+			BufferPath: filepath.Join(tmpdir, fmt.Sprintf("buffer-%d", i)),
+			MaxSize:    1024 * 1024,
+		}
+		buffer, err := openBuffer(cfg)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("openBuffer(%q) error = %v, wantErr %v", tc.bufferType, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := fmt.Sprintf("%T", buffer); got != tc.wantType {
+			t.Errorf("openBuffer(%q) returned %s, want %s", tc.bufferType, got, tc.wantType)
+		}
+		buffer.Close()
+	}
+}
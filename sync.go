@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sync policies for buffer writes, selectable with -sync
+const (
+	SyncNever    = "never"    // Leave flushing to the OS
+	SyncAlways   = "always"   // Every write is on disk before Write returns
+	SyncInterval = "interval" // Flush every -sync-interval
+	SyncBytes    = "bytes"    // Flush once -sync-bytes have been written
+)
+
+// validSyncPolicy reports whether policy names a known sync policy
+func validSyncPolicy(policy string) bool {
+	switch policy {
+	case "", SyncNever, SyncAlways, SyncInterval, SyncBytes:
+		return true
+	}
+	return false
+}
+
+// Syncable is implemented by buffers that can flush their writes to disk on
+// demand, whatever their sync policy
+type Syncable interface {
+	// Sync returns once everything written so far is on disk
+	Sync() error
+}
+
+// syncFunc flushes a buffer's files to stable storage
+type syncFunc func() error
+
+// syncer flushes a buffer according to a sync policy. In SyncAlways mode
+// writers that arrive while a flush is running wait for the next one, which
+// then covers all of them (group commit), so a single fsync is shared by
+// every concurrent write instead of each write paying for its own.
+type syncer struct {
+	policy   string
+	interval time.Duration
+	bytes    int64
+	sync     syncFunc
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	written   uint64 // Sequence number of the last write
+	synced    uint64 // Writes up to this sequence number are on disk
+	failedTo  uint64 // Writes up to this sequence number were covered by a failed flush
+	lastErr   error
+	syncing   bool
+	unsynced  int64 // Bytes written since the last flush
+	kick      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newSyncer creates a syncer for the policy in opts; flush does the actual syncing
+func newSyncer(opts BufferOptions, flush syncFunc) (*syncer, error) {
+	if !validSyncPolicy(opts.Sync) {
+		return nil, fmt.Errorf("unknown sync policy %q", opts.Sync)
+	}
+
+	s := &syncer{
+		policy:   opts.Sync,
+		interval: opts.SyncInterval,
+		bytes:    opts.SyncBytes,
+		sync:     flush,
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if s.policy == "" {
+		s.policy = SyncNever
+	}
+	if s.interval <= 0 {
+		s.interval = DefaultSyncInterval
+	}
+	if s.bytes <= 0 {
+		s.bytes = DefaultSyncBytes
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	// Interval and byte thresholds are flushed in the background
+	if s.policy == SyncInterval || s.policy == SyncBytes {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+
+	return s, nil
+}
+
+// run flushes in the background until the syncer is closed
+func (s *syncer) run() {
+	defer close(s.done)
+
+	var tick <-chan time.Time
+	if s.policy == SyncInterval {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-tick:
+		case <-s.kick:
+		}
+		if err := s.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error syncing buffer: %v\n", err)
+		}
+	}
+}
+
+// enabled reports whether the policy flushes writes at all
+func (s *syncer) enabled() bool {
+	return s.policy != SyncNever
+}
+
+// wrote records a write of n bytes and returns its sequence number for wait.
+// The caller must call it after the data has been written.
+func (s *syncer) wrote(n int64) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.written++
+	s.unsynced += n
+	if s.policy == SyncBytes && s.unsynced >= s.bytes {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return s.written
+}
+
+// wait blocks until the write with sequence number seq is on disk when the
+// policy requires it. It must be called without holding the buffer's mutex.
+func (s *syncer) wait(seq uint64) error {
+	if s.policy != SyncAlways {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.synced < seq {
+		if s.failedTo >= seq {
+			return s.lastErr
+		}
+		if s.syncing {
+			// Another writer is flushing; the next flush will cover this write
+			s.cond.Wait()
+			continue
+		}
+		s.flushLocked()
+	}
+	return nil
+}
+
+// flush writes everything written so far to disk
+func (s *syncer) flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.syncing {
+		s.cond.Wait()
+	}
+	if s.synced == s.written {
+		return nil
+	}
+	return s.flushLocked()
+}
+
+// flushLocked runs one flush covering all writes so far. The mutex is held
+// on entry and exit but released while syncing so that writers can continue.
+func (s *syncer) flushLocked() error {
+	target := s.written
+	s.syncing = true
+	s.unsynced = 0
+	s.mutex.Unlock()
+
+	err := s.sync()
+
+	s.mutex.Lock()
+	s.syncing = false
+	if err != nil {
+		s.failedTo = target
+		s.lastErr = fmt.Errorf("failed to sync buffer: %w", err)
+		err = s.lastErr
+	} else {
+		s.synced = target
+	}
+	s.cond.Broadcast()
+	return err
+}
+
+// Close stops background flushing and flushes any remaining writes
+func (s *syncer) Close() error {
+	s.closeOnce.Do(func() {
+		if s.policy == SyncInterval || s.policy == SyncBytes {
+			close(s.stop)
+		}
+	})
+	<-s.done
+
+	if !s.enabled() {
+		return nil
+	}
+	return s.flush()
+}
+
+// syncFiles fsyncs files in order, ignoring files that were closed in the
+// meantime (such as segments deleted after being acknowledged)
+func syncFiles(files ...bufferFile) error {
+	for _, file := range files {
+		if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncerGroupCommit(t *testing.T) {
+	var flushes int32
+	release := make(chan struct{})
+	s, err := newSyncer(BufferOptions{Sync: SyncAlways}, func() error {
+		// Hold the first flush until every writer has queued up behind it
+		if atomic.AddInt32(&flushes, 1) == 1 {
+			<-release
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create syncer: %v", err)
+	}
+	defer s.Close()
+
+	first := s.wrote(10)
+	firstDone := make(chan error, 1)
+	go func() { firstDone <- s.wait(first) }()
+
+	// Wait for the first flush to start, then queue more writers behind it
+	for atomic.LoadInt32(&flushes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		seq := s.wrote(10)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.wait(seq); err != nil {
+				t.Errorf("wait failed: %v", err)
+			}
+		}()
+	}
+
+	close(release)
+	if err := <-firstDone; err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	wg.Wait()
+
+	// The queued writers must have shared a single flush
+	if got := atomic.LoadInt32(&flushes); got != 2 {
+		t.Errorf("Expected 2 flushes for 21 writes, got %d", got)
+	}
+}
+
+func TestSyncerFlushError(t *testing.T) {
+	fail := true
+	s, err := newSyncer(BufferOptions{Sync: SyncAlways}, func() error {
+		if fail {
+			return errors.New("disk on fire")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create syncer: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.wait(s.wrote(1)); err == nil {
+		t.Error("Expected flush error to be returned to the writer")
+	}
+
+	// A later successful flush covers the next write
+	fail = false
+	if err := s.wait(s.wrote(1)); err != nil {
+		t.Errorf("wait after recovery failed: %v", err)
+	}
+}
+
+func TestSyncerPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   BufferOptions
+		writes int
+		want   bool // Whether a flush is expected shortly after the writes
+	}{
+		{"never", BufferOptions{Sync: SyncNever}, 5, false},
+		{"interval", BufferOptions{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond}, 1, true},
+		{"bytes below threshold", BufferOptions{Sync: SyncBytes, SyncBytes: 100}, 5, false},
+		{"bytes above threshold", BufferOptions{Sync: SyncBytes, SyncBytes: 100}, 10, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			flushed := make(chan struct{}, 10)
+			s, err := newSyncer(tc.opts, func() error {
+				flushed <- struct{}{}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Failed to create syncer: %v", err)
+			}
+
+			for i := 0; i < tc.writes; i++ {
+				if err := s.wait(s.wrote(10)); err != nil {
+					t.Fatalf("wait failed: %v", err)
+				}
+			}
+
+			select {
+			case <-flushed:
+				if !tc.want {
+					t.Error("Unexpected flush")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tc.want {
+					t.Error("Expected a flush")
+				}
+			}
+			s.Close()
+		})
+	}
+
+	if _, err := newSyncer(BufferOptions{Sync: "sometimes"}, nil); err == nil {
+		t.Error("Expected an error for an unknown sync policy")
+	}
+}
+
+func TestBuffersWithSyncAlways(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "sync-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	opts := BufferOptions{Sync: SyncAlways, SegmentSize: 100}
+	circular, err := NewBufferWithOptions(filepath.Join(tmpdir, "buffer.log"), 1024*1024, opts)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	segments, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1024*1024, opts)
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+
+	for _, buf := range []BufferInterface{circular, segments} {
+		// Concurrent writers all return once their records are flushed
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; j++ {
+					if _, err := buf.Write([]byte("durable line\n")); err != nil {
+						t.Errorf("Write failed: %v", err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		records, _, err := buf.ReadRecords(-1)
+		if err != nil {
+			t.Fatalf("ReadRecords failed: %v", err)
+		}
+		if len(records) != 200 {
+			t.Errorf("Expected 200 records, got %d", len(records))
+		}
+		if err := buf.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+}
+
+func TestBufferSyncOnDemand(t *testing.T) {
+	tmpdir := t.TempDir()
+	opts := BufferOptions{Sync: SyncNever, SegmentSize: 100}
+	circular, err := NewBufferWithOptions(filepath.Join(tmpdir, "buffer.log"), 1024*1024, opts)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	segments, err := NewSegmentBuffer(filepath.Join(tmpdir, "wal"), 1024*1024, opts)
+	if err != nil {
+		t.Fatalf("Failed to create segment buffer: %v", err)
+	}
+
+	for _, buf := range []struct {
+		BufferInterface
+		syncer *syncer
+	}{{circular, circular.syncer}, {segments, segments.syncer}} {
+		// Enough lines to roll segments, which are flushed as they are rolled
+		for i := 0; i < 20; i++ {
+			if _, err := buf.Write([]byte("durable line\n")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if buf.syncer.synced == buf.syncer.written {
+			t.Fatal("Writes were flushed without a sync policy")
+		}
+		if err := buf.BufferInterface.(Syncable).Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		if buf.syncer.synced != buf.syncer.written {
+			t.Errorf("Sync flushed up to write %d of %d", buf.syncer.synced, buf.syncer.written)
+		}
+		if err := buf.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+}
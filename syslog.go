@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Syslog input
+//
+// The syslog listener accepts messages over UDP, one per datagram, and over
+// TCP, framed by octet counting ("<length> <message>") or terminated by a
+// newline (RFC 6587), which it detects per message. Messages are parsed as
+// RFC 5424, or else as RFC 3164 (BSD syslog), as leniently as the senders
+// found in practice require. The header is stored as fields of the line, and
+// the message text as the line.
+
+const (
+	maxSyslogMessage = 256 * 1024 // Longer TCP messages are rejected, like lines on stdin
+	maxSyslogLength  = 10         // Digits of an octet counting length
+	syslogDefaultPri = 13         // user.notice, for messages without a priority (RFC 3164 4.3.3)
+)
+
+// syslogFacilities names the syslog facilities by number
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// syslogSeverities names the syslog severities by number
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// syslogMessage is a parsed syslog message. Header fields the message didn't
+// have are empty.
+type syslogMessage struct {
+	Priority       int
+	Timestamp      string
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+// fields returns the header of the message as line fields
+func (m *syslogMessage) fields() map[string]any {
+	fields := map[string]any{
+		"priority": m.Priority,
+		"facility": syslogFacilities[m.Priority/8],
+		"severity": syslogSeverities[m.Priority%8],
+	}
+	for name, value := range map[string]string{
+		"timestamp": m.Timestamp,
+		"hostname":  m.Hostname,
+		"app_name":  m.AppName,
+		"proc_id":   m.ProcID,
+		"msg_id":    m.MsgID,
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	if len(m.StructuredData) > 0 {
+		fields["structured_data"] = m.StructuredData
+	}
+	return map[string]any{"syslog": fields}
+}
+
+// line returns the message as a tagged line for the buffer
+func (m *syslogMessage) line() []byte {
+	text := strings.TrimRight(m.Message, "\r\n")
+	return tagLine(fieldsPrefix(m.fields()), []byte(text+"\n"))
+}
+
+// parseSyslog parses a syslog message. A message without a valid priority is
+// kept whole as the text of a user.notice message.
+func parseSyslog(data []byte) *syslogMessage {
+	msg := &syslogMessage{Priority: syslogDefaultPri}
+	rest, ok := parsePriority(string(data), &msg.Priority)
+	if !ok {
+		msg.Message = string(data)
+		return msg
+	}
+
+	// RFC 5424 messages have a version, "1", after the priority
+	if strings.HasPrefix(rest, "1 ") && parseRFC5424(rest[2:], msg) {
+		return msg
+	}
+	parseRFC3164(rest, msg)
+	return msg
+}
+
+// parsePriority parses the "<PRI>" at the start of s
+func parsePriority(s string, pri *int) (string, bool) {
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return s, false
+	}
+	n, err := strconv.Atoi(s[1:end])
+	if err != nil || n < 0 || n >= len(syslogFacilities)*8 {
+		return s, false
+	}
+	*pri = n
+	return s[end+1:], true
+}
+
+// parseRFC5424 parses the header after the version of an RFC 5424 message:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(s string, msg *syslogMessage) bool {
+	var header [5]string
+	for i := range header {
+		end := strings.IndexByte(s, ' ')
+		if end <= 0 {
+			return false
+		}
+		if s[:end] != "-" {
+			header[i] = s[:end]
+		}
+		s = s[end+1:]
+	}
+
+	sd, rest, ok := parseStructuredData(s)
+	if !ok {
+		return false
+	}
+	msg.Timestamp, msg.Hostname, msg.AppName, msg.ProcID, msg.MsgID = header[0], header[1], header[2], header[3], header[4]
+	msg.StructuredData = sd
+	msg.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return true
+}
+
+// parseStructuredData parses the STRUCTURED-DATA of an RFC 5424 message,
+// "-" or one or more [SD-ID PARAM="VALUE" ...] elements, returning the rest
+func parseStructuredData(s string) (map[string]map[string]string, string, bool) {
+	if strings.HasPrefix(s, "-") {
+		return nil, s[1:], true
+	}
+
+	sd := make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end <= 0 {
+			return nil, s, false
+		}
+		params := make(map[string]string)
+		sd[s[:end]] = params
+		s = s[end:]
+
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			eq := strings.Index(s, `="`)
+			if eq <= 0 {
+				return nil, s, false
+			}
+			name := s[:eq]
+			value, rest, ok := parseParamValue(s[eq+2:])
+			if !ok {
+				return nil, s, false
+			}
+			params[name] = value
+			s = rest
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, s, false
+		}
+		s = s[1:]
+	}
+	return sd, s, len(sd) > 0
+}
+
+// parseParamValue parses a structured data parameter value up to its closing
+// quote, in which '"', '\' and ']' are escaped with a backslash
+func parseParamValue(s string) (string, string, bool) {
+	var value strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return value.String(), s[i+1:], true
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0:
+			i++
+			value.WriteByte(s[i])
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", s, false
+}
+
+// rfc3164Timestamp is the timestamp format of RFC 3164 messages
+const rfc3164Timestamp = time.Stamp
+
+// parseRFC3164 parses the header after the priority of an RFC 3164 message:
+// TIMESTAMP HOSTNAME TAG[PID]: MSG. Senders commonly leave out the hostname,
+// or use an RFC 3339 timestamp.
+func parseRFC3164(s string, msg *syslogMessage) {
+	if len(s) >= len(rfc3164Timestamp) {
+		if _, err := time.Parse(rfc3164Timestamp, s[:len(rfc3164Timestamp)]); err == nil {
+			msg.Timestamp, s = s[:len(rfc3164Timestamp)], s[len(rfc3164Timestamp):]
+		}
+	}
+	if msg.Timestamp == "" {
+		if end := strings.IndexByte(s, ' '); end > 0 {
+			if _, err := time.Parse(time.RFC3339Nano, s[:end]); err == nil {
+				msg.Timestamp, s = s[:end], s[end:]
+			}
+		}
+	}
+	s = strings.TrimPrefix(s, " ")
+
+	// A hostname is followed by the tag, which ends with a colon
+	if end := strings.IndexByte(s, ' '); msg.Timestamp != "" && end > 0 && !isSyslogTag(s[:end]) {
+		msg.Hostname, s = s[:end], s[end+1:]
+	}
+	if end := strings.IndexByte(s, ' '); end > 0 && isSyslogTag(s[:end]) {
+		tag := strings.TrimSuffix(s[:end], ":")
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			msg.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		msg.AppName, s = tag, s[end+1:]
+	}
+	msg.Message = s
+}
+
+// isSyslogTag reports whether a word is an RFC 3164 tag, "app:" or "app[pid]:"
+func isSyslogTag(word string) bool {
+	return len(word) > 1 && strings.HasSuffix(word, ":")
+}
+
+// readSyslogFrame reads the next message of a TCP stream, framed by octet
+// counting if it starts with a digit, or else terminated by a newline
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		header, err := r.ReadSlice(' ')
+		if err != nil || len(header) > maxSyslogLength+1 {
+			return nil, errors.New("invalid octet counting frame")
+		}
+		n, err := strconv.Atoi(string(header[:len(header)-1]))
+		if err != nil || n > maxSyslogMessage {
+			return nil, fmt.Errorf("invalid octet counting length %q", header[:len(header)-1])
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	var frame []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		frame = append(frame, chunk...)
+		if len(frame) > maxSyslogMessage {
+			return nil, errors.New("message too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(frame) > 0 {
+			// The last message may not be terminated
+			return frame, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(frame, "\r\n"), nil
+	}
+}
+
+// SyslogServer receives syslog messages over UDP and TCP
+type SyslogServer struct {
+	udp    net.PacketConn
+	tcp    net.Listener
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{} // Open TCP connections
+	closed bool                  // Set by close, after which new connections are refused
+}
+
+// ListenSyslog listens for syslog messages on the given UDP and TCP
+// addresses, either of which can be empty
+func ListenSyslog(udpAddr, tcpAddr string) (*SyslogServer, error) {
+	s := &SyslogServer{conns: make(map[net.Conn]struct{})}
+	if udpAddr != "" {
+		conn, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for syslog on UDP %s: %w", udpAddr, err)
+		}
+		s.udp = conn
+	}
+	if tcpAddr != "" {
+		listener, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return nil, fmt.Errorf("failed to listen for syslog on TCP %s: %w", tcpAddr, err)
+		}
+		s.tcp = listener
+	}
+	return s, nil
+}
+
+// Serve writes the messages received to the buffer until ctx is done
+func (s *SyslogServer) Serve(ctx context.Context, buffer BufferInterface, programName string, signal chan struct{}, cfg *Config) {
+	buffer = bufferForSource(buffer, logSource{Program: programName})
+	serveLines(ctx, buffer, signal, cfg, func(lines chan<- []byte) {
+		var wg sync.WaitGroup
+		if s.udp != nil {
+			fmt.Fprintf(os.Stderr, "Listening for syslog on UDP %s\n", s.udp.LocalAddr())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveUDP(lines)
+			}()
+		}
+		if s.tcp != nil {
+			fmt.Fprintf(os.Stderr, "Listening for syslog on TCP %s\n", s.tcp.Addr())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveTCP(lines, &wg)
+			}()
+		}
+		wg.Wait()
+	}, s.close)
+}
+
+// close stops listening and closes the open connections
+func (s *SyslogServer) close() {
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serveUDP receives messages, one per datagram, until the socket is closed
+func (s *SyslogServer) serveUDP(lines chan<- []byte) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error receiving syslog message: %v\n", err)
+			continue
+		}
+		if data := bytes.TrimRight(buf[:n], "\r\n\x00"); len(data) > 0 {
+			lines <- parseSyslog(data).line()
+		}
+	}
+}
+
+// serveTCP accepts connections until the listener is closed, serving each
+// of them in a goroutine tracked by wg
+func (s *SyslogServer) serveTCP(lines chan<- []byte, wg *sync.WaitGroup) {
+	for {
+		conn, err := s.tcp.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error accepting syslog connection: %v\n", err)
+			time.Sleep(blockedWriteInterval)
+			continue
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			// Accepted just before the listener was closed
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(conn, lines)
+		}()
+	}
+}
+
+// serveConn receives messages from a TCP connection until it is closed
+func (s *SyslogServer) serveConn(conn net.Conn, lines chan<- []byte) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	debugf("Syslog connection from %s", conn.RemoteAddr())
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readSyslogFrame(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "Closing syslog connection from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(frame) > 0 {
+			lines <- parseSyslog(frame).line()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want syslogMessage
+	}{
+		{
+			name: "rfc5424",
+			in:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high \"x\\ y\]"] ` + "\ufeff" + `An application event log entry...`,
+			want: syslogMessage{
+				Priority:  165,
+				Timestamp: "2003-10-11T22:14:15.003Z",
+				Hostname:  "mymachine.example.com",
+				AppName:   "evntslog",
+				MsgID:     "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473":     {"iut": "3", "eventSource": "Application", "eventID": "1011"},
+					"examplePriority@32473": {"class": `high "x\ y]`},
+				},
+				Message: "An application event log entry...",
+			},
+		},
+		{
+			name: "rfc5424 without structured data",
+			in:   `<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su 123 - - 'su root' failed for lonvick on /dev/pts/8`,
+			want: syslogMessage{
+				Priority:  34,
+				Timestamp: "2003-10-11T22:14:15.003Z",
+				Hostname:  "mymachine.example.com",
+				AppName:   "su",
+				ProcID:    "123",
+				Message:   "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "rfc3164",
+			in:   `<34>Oct 11 22:14:15 mymachine su[42]: 'su root' failed for lonvick on /dev/pts/8`,
+			want: syslogMessage{
+				Priority:  34,
+				Timestamp: "Oct 11 22:14:15",
+				Hostname:  "mymachine",
+				AppName:   "su",
+				ProcID:    "42",
+				Message:   "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "rfc3164 without hostname",
+			in:   `<13>Feb  5 17:32:18 cron: job done`,
+			want: syslogMessage{Priority: 13, Timestamp: "Feb  5 17:32:18", AppName: "cron", Message: "job done"},
+		},
+		{
+			name: "rfc3164 with rfc3339 timestamp",
+			in:   `<11>2024-05-01T10:00:00+02:00 web-1 nginx: upstream timed out`,
+			want: syslogMessage{Priority: 11, Timestamp: "2024-05-01T10:00:00+02:00", Hostname: "web-1", AppName: "nginx", Message: "upstream timed out"},
+		},
+		{
+			name: "priority only",
+			in:   `<14>just a message`,
+			want: syslogMessage{Priority: 14, Message: "just a message"},
+		},
+		{
+			name: "no priority",
+			in:   `plain text`,
+			want: syslogMessage{Priority: syslogDefaultPri, Message: "plain text"},
+		},
+		{
+			name: "invalid priority",
+			in:   `<999>1 message`,
+			want: syslogMessage{Priority: syslogDefaultPri, Message: "<999>1 message"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseSyslog([]byte(tc.in))
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("parseSyslog(%q) =\n%+v, want\n%+v", tc.in, *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSyslogMessageFields(t *testing.T) {
+	line := parseSyslog([]byte(`<27>Oct 11 22:14:15 db-1 postgres[7]: out of memory`)).line()
+	fields, text := untagLine(string(line))
+	if text != "out of memory\n" {
+		t.Errorf("Line text is %q", text)
+	}
+
+	syslog := fields["syslog"].(map[string]any)
+	want := map[string]any{
+		"priority":  json.Number("27"),
+		"facility":  "daemon",
+		"severity":  "err",
+		"timestamp": "Oct 11 22:14:15",
+		"hostname":  "db-1",
+		"app_name":  "postgres",
+		"proc_id":   "7",
+	}
+	if !reflect.DeepEqual(syslog, want) {
+		t.Errorf("Fields are %v, want %v", syslog, want)
+	}
+
+	// Priority lanes see the severity
+	if level := detectLevel(line); level != LevelError {
+		t.Errorf("detectLevel = %d, want %d", level, LevelError)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	counted := "<13>octet counted\nwith a newline"
+	stream := "<13>newline framed\r\n" +
+		strconv.Itoa(len(counted)) + " " + counted +
+		"<13>unterminated"
+	r := bufio.NewReader(strings.NewReader(stream))
+
+	want := []string{"<13>newline framed", counted, "<13>unterminated"}
+	for _, w := range want {
+		frame, err := readSyslogFrame(r)
+		if err != nil || string(frame) != w {
+			t.Fatalf("readSyslogFrame = %q, %v, want %q", frame, err, w)
+		}
+	}
+	if _, err := readSyslogFrame(r); err == nil {
+		t.Error("readSyslogFrame read past the end of the stream")
+	}
+
+	// Oversized octet counts are rejected rather than allocated
+	r = bufio.NewReader(strings.NewReader("999999999 <13>x"))
+	if _, err := readSyslogFrame(r); err == nil {
+		t.Error("readSyslogFrame accepted an oversized frame")
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	server, err := ListenSyslog("127.0.0.1:0", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenSyslog failed: %v", err)
+	}
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+	defer buffer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx, buffer, "test-program", make(chan struct{}, 1), &Config{})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	udp, err := net.Dial("udp", server.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial UDP failed: %v", err)
+	}
+	defer udp.Close()
+	if _, err := udp.Write([]byte("<14>Oct 11 22:14:15 host app: over udp\n")); err != nil {
+		t.Fatalf("UDP write failed: %v", err)
+	}
+	waitForLines(t, buffer, "over udp\n")
+
+	tcp, err := net.Dial("tcp", server.tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial TCP failed: %v", err)
+	}
+	defer tcp.Close()
+	msg := "<14>1 2024-05-01T10:00:00Z host app - - - over tcp"
+	if _, err := tcp.Write([]byte("<14>Oct 11 22:14:15 host app: first\n" + strconv.Itoa(len(msg)) + " " + msg)); err != nil {
+		t.Fatalf("TCP write failed: %v", err)
+	}
+	lines := waitForLines(t, buffer, "first\n", "over tcp\n")
+	for _, line := range lines {
+		fields, _ := untagLine(line)
+		if app := fields["syslog"].(map[string]any)["app_name"]; app != "app" {
+			t.Errorf("Line %q has app name %v", line, app)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where -file starts reading a file that already exists when log_fwd starts
+// and has no checkpointed offset. Files that appear later, such as the new
+// file after a rotation, are always read from the beginning.
+const (
+	FileStartEnd       = "end"
+	FileStartBeginning = "beginning"
+)
+
+const (
+	tailReadSize = 64 * 1024  // Bytes read from a file at once
+	maxTailLine  = 256 * 1024 // Longer lines are split, like lines on stdin
+)
+
+// tailPollInterval is how often a file at its end is checked for new data and
+// rotation, and the -file patterns for new files; a variable so that tests
+// can speed it up
+var tailPollInterval = 250 * time.Millisecond
+
+// tailRemovedTimeout is how long a file that was removed from its path is
+// still followed, for an application that keeps writing to it until it
+// reopens its log
+var tailRemovedTimeout = 30 * time.Second
+
+// fileFlags collects repeated -file flags
+type fileFlags []string
+
+// String implements flag.Value
+func (f *fileFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value
+func (f *fileFlags) Set(pattern string) error {
+	if pattern == "" {
+		return errors.New("file path can't be empty")
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+	}
+	*f = append(*f, pattern)
+	return nil
+}
+
+// isGlob reports whether a -file pattern is a glob rather than a path
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// fileTailer follows one log file, identified by its inode (os.SameFile),
+// until it is rotated:
+//
+//   - rename and create: the path now names another file. The old file is
+//     read to its end, and the new one is found by the next scan.
+//   - copy and truncate: the file is now shorter than the read offset, so
+//     reading starts again from the beginning.
+type fileTailer struct {
+	path       string // Where the file was found
+	source     string // Path its lines are tagged and checkpointed with
+	file       *os.File
+	info       os.FileInfo // Identity of the file
+	offset     int64       // Read offset in the file
+	partial    []byte      // Start of a line whose end wasn't written yet
+	buf        []byte
+	drain      bool // Stop at the end of the file, which is no longer written to
+	checkpoint *checkpoint
+}
+
+// newFileTailer creates a tailer for an open file, reading from offset
+func newFileTailer(path, source string, file *os.File, info os.FileInfo, offset int64, c *checkpoint) *fileTailer {
+	debugf("Tailing %s from offset %d", path, offset)
+	return &fileTailer{
+		path:       path,
+		source:     source,
+		file:       file,
+		info:       info,
+		offset:     offset,
+		buf:        make([]byte, tailReadSize),
+		checkpoint: c,
+	}
+}
+
+// commit saves the offset of the end of the last complete line, up to which
+// lines were written to the buffer
+func (t *fileTailer) commit() {
+	if err := t.checkpoint.update(t.source, t.info, t.offset-int64(len(t.partial))); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving checkpoint: %v\n", err)
+	}
+}
+
+// read returns the complete lines written to the file since the last read,
+// up to a batch of them, and whether it reached the end of the file
+func (t *fileTailer) read() ([][]byte, bool, error) {
+	var lines [][]byte
+	for len(lines) < maxWriteBatchLines {
+		n, err := t.file.ReadAt(t.buf, t.offset)
+		t.offset += int64(n)
+		lines = t.split(lines, t.buf[:n])
+		if err == io.EOF {
+			return lines, true, nil
+		}
+		if err != nil {
+			return lines, false, err
+		}
+	}
+	return lines, false, nil
+}
+
+// split appends the lines completed by data to lines, keeping the rest of
+// data as the start of the next line
+func (t *fileTailer) split(lines [][]byte, data []byte) [][]byte {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			t.partial = append(t.partial, data...)
+			if len(t.partial) >= maxTailLine {
+				lines = append(lines, t.line(nil))
+			}
+			return lines
+		}
+		lines = append(lines, t.line(data[:i]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// line completes the partial line with rest, returning it newline terminated
+// as stored in the buffer. A carriage return before the newline is dropped,
+// as for lines on stdin.
+func (t *fileTailer) line(rest []byte) []byte {
+	line := make([]byte, 0, len(t.partial)+len(rest)+1)
+	line = append(append(line, t.partial...), rest...)
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	t.partial = t.partial[:0]
+	return append(line, '\n')
+}
+
+// rotated checks the file, at its end, for rotation. A truncated file is read
+// again from the beginning. It reports whether the path now names another
+// file, or was removed and the file hasn't been written to for idle.
+func (t *fileTailer) rotated(idle time.Duration) bool {
+	if info, err := t.file.Stat(); err == nil && info.Size() < t.offset {
+		fmt.Fprintf(os.Stderr, "%s was truncated, reading it from the beginning\n", t.path)
+		t.offset, t.partial = 0, t.partial[:0]
+		t.commit()
+		return false
+	}
+
+	info, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Until the application reopens its log, it may still write to the file
+		return idle >= tailRemovedTimeout
+	}
+	return err == nil && !os.SameFile(info, t.info)
+}
+
+// run follows the file until ctx is done or the file was rotated, passing
+// batches of lines to emit
+func (t *fileTailer) run(ctx context.Context, emit func(lines [][]byte)) {
+	defer t.file.Close()
+	t.commit()
+
+	lastRead := time.Now()
+	for {
+		offset := t.offset
+		lines, eof, err := t.read()
+		if t.offset != offset {
+			lastRead = time.Now()
+		}
+		if len(lines) > 0 {
+			emit(lines)
+			t.commit()
+		}
+		if err != nil {
+			// Try again from the same offset
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", t.path, err)
+			if !sleepContext(ctx, tailPollInterval) {
+				return
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !eof {
+			continue
+		}
+
+		if t.drain || t.rotated(time.Since(lastRead)) {
+			// Read what was written to the file before it was rotated
+			for eof = t.drain; !eof && err == nil; {
+				lines, eof, err = t.read()
+				if len(lines) > 0 {
+					emit(lines)
+				}
+			}
+			if len(t.partial) > 0 {
+				emit([][]byte{t.line(nil)})
+			}
+			t.commit()
+			debugf("Done tailing %s", t.path)
+			return
+		}
+
+		if !sleepContext(ctx, tailPollInterval) {
+			return
+		}
+	}
+}
+
+// fileWatcher scans the -file patterns for files and follows each of them
+// with a fileTailer. A path is only followed by one tailer at a time, so the
+// file that replaces a rotated one is read once the rotated one is done, even
+// if it was rotated while log_fwd was stopped, and
+// a file is only followed at one path, so a rotated file that still matches
+// a pattern isn't read twice.
+type fileWatcher struct {
+	patterns   []string
+	checkpoint *checkpoint
+	atEnd      bool // Read new files found by the first scan from their end
+	mutex      sync.Mutex
+	tailers    map[string]*fileTailer // By source path
+	waiting    map[string]bool        // Paths reported as missing
+}
+
+// newFileWatcher creates a watcher for the -file patterns
+func newFileWatcher(patterns []string, c *checkpoint, atEnd bool) *fileWatcher {
+	return &fileWatcher{
+		patterns:   patterns,
+		checkpoint: c,
+		atEnd:      atEnd,
+		tailers:    make(map[string]*fileTailer),
+		waiting:    make(map[string]bool),
+	}
+}
+
+// following reports whether a tailer follows the path or the file
+func (w *fileWatcher) following(path string, info os.FileInfo) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.tailers[path] != nil {
+		return true
+	}
+	for _, t := range w.tailers {
+		if os.SameFile(t.info, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether a path matches one of the patterns
+func (w *fileWatcher) matches(path string) bool {
+	for _, pattern := range w.patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scan returns tailers for the matching files that aren't followed yet, and
+// the checkpoint keys of all matching files
+func (w *fileWatcher) scan(first bool) ([]*fileTailer, map[string]bool) {
+	var found []*fileTailer
+	keys := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, pattern := range w.patterns {
+		// Patterns were validated, so globbing can't fail
+		paths, _ := filepath.Glob(pattern)
+		if len(paths) == 0 && !isGlob(pattern) && !w.waiting[pattern] {
+			fmt.Fprintf(os.Stderr, "Waiting for %s to be created\n", pattern)
+			w.waiting[pattern] = true
+		}
+
+		for _, path := range paths {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			delete(w.waiting, path)
+
+			file, err := os.Open(path)
+			if err != nil {
+				debugf("Can't open %s: %v", path, err)
+				continue
+			}
+			info, err := file.Stat()
+			if err != nil || !info.Mode().IsRegular() {
+				file.Close()
+				continue
+			}
+			keys[fileKey(path, info)] = true
+			if w.following(path, info) {
+				file.Close()
+				continue
+			}
+
+			offset, ok := w.checkpoint.lookup(path, info)
+			if !ok && first && w.atEnd && !w.checkpoint.followed(path) {
+				offset = info.Size()
+			}
+			found = append(found, newFileTailer(path, path, file, info, offset, w.checkpoint))
+		}
+	}
+	return found, keys
+}
+
+// recover finds the checkpointed files that were rotated away from their
+// path while log_fwd was stopped, to read what was written to them since.
+// keys are those of the files found by the first scan.
+func (w *fileWatcher) recover(keys map[string]bool) []*fileTailer {
+	var found []*fileTailer
+	for _, entry := range w.checkpoint.list() {
+		id, ok := entry.id()
+		if !ok || keys[checkpointKey(entry.Path, id, ok)] || !w.matches(entry.Path) {
+			continue
+		}
+		path, ok := findFile(filepath.Dir(entry.Path), id)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Can't find the file that was at %s, lines written to it after offset %d may be missing\n",
+				entry.Path, entry.Offset)
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening %s, rotated from %s: %v\n", path, entry.Path, err)
+			continue
+		}
+		info, err := file.Stat()
+		if found, ok := fileIDOf(info); err != nil || !ok || found != id || info.Size() < entry.Offset {
+			file.Close()
+			continue
+		}
+		debugf("%s was rotated to %s", entry.Path, path)
+		t := newFileTailer(path, entry.Path, file, info, entry.Offset, w.checkpoint)
+		t.drain = true
+		found = append(found, t)
+	}
+	return found
+}
+
+// run follows the matching files until ctx is done, passing their lines to
+// the emit function returned by newEmit for their source path
+func (w *fileWatcher) run(ctx context.Context, newEmit func(source string) func(lines [][]byte)) {
+	var wg sync.WaitGroup
+	defer func() {
+		// Save the offsets the tailers reached before they stopped
+		wg.Wait()
+		if err := w.checkpoint.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving checkpoint: %v\n", err)
+		}
+	}()
+
+	follow := func(tailers []*fileTailer) {
+		for _, t := range tailers {
+			w.mutex.Lock()
+			if w.tailers[t.source] != nil {
+				// Found by the first scan, but the rotated file comes first
+				w.mutex.Unlock()
+				t.file.Close()
+				continue
+			}
+			w.tailers[t.source] = t
+			w.mutex.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.run(ctx, newEmit(t.source))
+
+				w.mutex.Lock()
+				delete(w.tailers, t.source)
+				w.mutex.Unlock()
+			}()
+		}
+	}
+
+	tailers, keys := w.scan(true)
+	follow(w.recover(keys))
+	for {
+		follow(tailers)
+
+		// Forget the files that are neither followed nor found anymore
+		w.mutex.Lock()
+		for _, t := range w.tailers {
+			keys[fileKey(t.source, t.info)] = true
+		}
+		w.mutex.Unlock()
+		if err := w.checkpoint.retain(keys); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving checkpoint: %v\n", err)
+		}
+
+		if !sleepContext(ctx, tailPollInterval) {
+			return
+		}
+		tailers, keys = w.scan(false)
+	}
+}
+
+// sleepContext waits for d, returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// TailFiles follows the files matching the -file patterns and writes their
+// lines to the buffer, tagged with the file's path, until ctx is done
+func TailFiles(ctx context.Context, buffer BufferInterface, programName string, signal chan struct{}, cfg *Config) {
+	c := loadCheckpoint(cfg.checkpointPath(), buffer, cfg.SyncPolicy == SyncAlways)
+	w := newFileWatcher(cfg.Files, c, cfg.FileStart != FileStartBeginning)
+	w.run(ctx, func(source string) func(lines [][]byte) {
+		out := bufferForSource(buffer, logSource{Program: programName, Path: source})
+		prefix := fieldsPrefix(map[string]any{"file": map[string]any{"path": source}})
+		return func(lines [][]byte) {
+			for i, line := range lines {
+				lines[i] = tagLine(prefix, line)
+			}
+			writeBatchToBuffer(ctx, out, lines, signal, cfg)
+
+			// Signal new logs (non-blocking)
+			select {
+			case signal <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTailing follows path into a memory buffer until the test ends
+func startTailing(t *testing.T, path, start string) *MemoryBuffer {
+	t.Helper()
+	buffer, _ := tailFiles(t, &Config{Files: fileFlags{path}, FileStart: start})
+	return buffer
+}
+
+// tailFiles follows the files of cfg into a memory buffer until the test ends
+// or the returned function is called
+func tailFiles(t *testing.T, cfg *Config) (*MemoryBuffer, func()) {
+	t.Helper()
+	oldInterval := tailPollInterval
+	tailPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { tailPollInterval = oldInterval })
+
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		TailFiles(ctx, buffer, "test-program", make(chan struct{}, 1), cfg)
+		close(done)
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(func() {
+		stop()
+		buffer.Close()
+	})
+	return buffer, stop
+}
+
+// appendFile appends data to the file at path
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// waitForLines reads lines from the buffer until it got want, comparing them
+// without their fields, and returns the tagged lines
+func waitForLines(t *testing.T, buffer BufferInterface, want ...string) []string {
+	t.Helper()
+	var tagged, got []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(got) < len(want) && time.Now().Before(deadline) {
+		for _, line := range readAllRecords(t, buffer) {
+			_, text := untagLine(line)
+			tagged, got = append(tagged, line), append(got, text)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if strings.Join(got, "") != strings.Join(want, "") {
+		t.Fatalf("Tailed %q, want %q", got, want)
+	}
+	return tagged
+}
+
+func TestTailFileStart(t *testing.T) {
+	dir := t.TempDir()
+	for _, start := range []string{FileStartEnd, FileStartBeginning} {
+		t.Run(start, func(t *testing.T) {
+			path := filepath.Join(dir, start+".log")
+			appendFile(t, path, "old line\n")
+
+			buffer := startTailing(t, path, start)
+			time.Sleep(50 * time.Millisecond)
+			appendFile(t, path, "new line\r\n")
+
+			if start == FileStartBeginning {
+				waitForLines(t, buffer, "old line\n", "new line\n")
+			} else {
+				waitForLines(t, buffer, "new line\n")
+			}
+		})
+	}
+}
+
+func TestTailFilePartialLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "")
+	buffer := startTailing(t, path, FileStartEnd)
+	time.Sleep(50 * time.Millisecond)
+
+	// A line is only buffered once its newline is written
+	appendFile(t, path, "first half")
+	time.Sleep(50 * time.Millisecond)
+	if buffer.HasData() {
+		t.Fatal("Buffered an incomplete line")
+	}
+	appendFile(t, path, ", second half\nnext\n")
+	waitForLines(t, buffer, "first half, second half\n", "next\n")
+}
+
+func TestTailFileRenameRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "")
+	buffer := startTailing(t, path, FileStartEnd)
+	time.Sleep(50 * time.Millisecond)
+
+	appendFile(t, path, "before rotation\n")
+	waitForLines(t, buffer, "before rotation\n")
+
+	// The application keeps writing to the renamed file until it reopens the path
+	rotated := filepath.Join(dir, "app.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	appendFile(t, rotated, "after rename\n")
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, rotated, "last old line")
+	appendFile(t, path, "in the new file\n")
+
+	waitForLines(t, buffer, "after rename\n", "last old line\n", "in the new file\n")
+}
+
+func TestTailFileCopyTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "")
+	buffer := startTailing(t, path, FileStartEnd)
+	time.Sleep(50 * time.Millisecond)
+
+	appendFile(t, path, "a rather long line before the copy\n")
+	waitForLines(t, buffer, "a rather long line before the copy\n")
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "after truncation\n")
+	waitForLines(t, buffer, "after truncation\n")
+}
+
+func TestTailFileCreatedLater(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	buffer := startTailing(t, path, FileStartEnd)
+	time.Sleep(50 * time.Millisecond)
+
+	// A file that didn't exist at startup is read from the beginning
+	appendFile(t, path, "first line\n")
+	waitForLines(t, buffer, "first line\n")
+}
+
+// taggedPaths returns the file paths that tagged lines were read from
+func taggedPaths(t *testing.T, lines []string) []string {
+	t.Helper()
+	var paths []string
+	for _, line := range lines {
+		fields, _ := untagLine(line)
+		file, ok := fields["file"].(map[string]any)
+		if !ok {
+			t.Fatalf("Line %q isn't tagged with its file", line)
+		}
+		paths = append(paths, file["path"].(string))
+	}
+	return paths
+}
+
+func TestTailGlob(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old.log")
+	appendFile(t, old, "existing line\n")
+	appendFile(t, filepath.Join(dir, "other.txt"), "")
+	buffer := startTailing(t, filepath.Join(dir, "*.log"), FileStartEnd)
+	time.Sleep(50 * time.Millisecond)
+
+	// Files created later are read from the beginning, and non-matching ones ignored
+	created := filepath.Join(dir, "created.log")
+	appendFile(t, created, "in created\n")
+	appendFile(t, filepath.Join(dir, "other.txt"), "ignored\n")
+	lines := waitForLines(t, buffer, "in created\n")
+	appendFile(t, old, "in old\n")
+	lines = append(lines, waitForLines(t, buffer, "in old\n")...)
+
+	paths := taggedPaths(t, lines)
+	if paths[0] != created || paths[1] != old {
+		t.Errorf("Lines were tagged with %q, want %q and %q", paths, created, old)
+	}
+}
+
+func TestTailGlobRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "")
+	buffer := startTailing(t, filepath.Join(dir, "app.log*"), FileStartEnd)
+	time.Sleep(50 * time.Millisecond)
+
+	// The rotated file still matches, but isn't read again
+	appendFile(t, path, "before rotation\n")
+	waitForLines(t, buffer, "before rotation\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	appendFile(t, path+".1", "after rename\n")
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "in the new file\n")
+	waitForLines(t, buffer, "after rename\n", "in the new file\n")
+
+	time.Sleep(50 * time.Millisecond)
+	if lines := readAllRecords(t, buffer); len(lines) != 0 {
+		t.Errorf("Read %q again", lines)
+	}
+}
+
+func TestTailCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	cfg := &Config{Files: fileFlags{path}, FileStart: FileStartEnd, Checkpoint: filepath.Join(dir, "checkpoint")}
+	appendFile(t, path, "before the first start\n")
+
+	buffer, stop := tailFiles(t, cfg)
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "first run\n")
+	waitForLines(t, buffer, "first run\n")
+	stop()
+
+	// Restarting resumes after the last complete line, not at the end
+	appendFile(t, path, "while stopped\npartial")
+	buffer, _ = tailFiles(t, cfg)
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, " line\n")
+	waitForLines(t, buffer, "while stopped\n", "partial line\n")
+}
+
+func TestTailCheckpointRotatedWhileStopped(t *testing.T) {
+	if _, ok := fileIDOf(statFile(t, t.TempDir())); !ok {
+		t.Skip("Files have no persistent identity on this platform")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	cfg := &Config{Files: fileFlags{path}, FileStart: FileStartEnd, Checkpoint: filepath.Join(dir, "checkpoint")}
+	appendFile(t, path, "")
+
+	buffer, stop := tailFiles(t, cfg)
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "first run\n")
+	waitForLines(t, buffer, "first run\n")
+	stop()
+
+	// The rotated file is read to its end, and the new one from its beginning
+	appendFile(t, path, "before rotation\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	appendFile(t, path, "after rotation\n")
+	buffer, _ = tailFiles(t, cfg)
+
+	lines := waitForLines(t, buffer, "before rotation\n", "after rotation\n")
+	if paths := taggedPaths(t, lines); paths[0] != path || paths[1] != path {
+		t.Errorf("Lines were tagged with %q, want %q", paths, path)
+	}
+}
+
+// statFile returns the file info of path
+func statFile(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	return info
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Unix socket input
+//
+// Local applications can write their logs to a Unix stream socket, one
+// newline-terminated line after another, or send them to a Unix datagram
+// socket, one or more lines per datagram. On Linux every line is tagged with
+// the PID, UID and GID of the process that sent it, as vouched for by the
+// kernel: SO_PEERCRED for streams, SCM_CREDENTIALS for datagrams.
+
+// DefaultSocketMode are the default permissions of the Unix sockets
+const DefaultSocketMode = 0o660
+
+// socketMode is the permissions of the Unix sockets, in octal
+type socketMode os.FileMode
+
+// String implements flag.Value
+func (m *socketMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+// Set implements flag.Value
+func (m *socketMode) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("invalid socket permissions %q, want octal like 0660", s)
+	}
+	*m = socketMode(n)
+	return nil
+}
+
+// peerCred is the identity of the process that sent a line
+type peerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// prefix returns the prefix that tags lines with the credentials
+func (c *peerCred) prefix() []byte {
+	if c == nil {
+		return nil
+	}
+	return fieldsPrefix(map[string]any{"peer": map[string]any{"pid": c.PID, "uid": c.UID, "gid": c.GID}})
+}
+
+// socketLine returns a line received on a socket, newline terminated and
+// tagged with prefix, if there is one
+func socketLine(prefix, text []byte) []byte {
+	if prefix == nil {
+		text = untaggedLine(text)
+	}
+	line := make([]byte, 0, len(prefix)+len(text)+1)
+	return append(append(append(line, prefix...), text...), '\n')
+}
+
+// removeStaleSocket removes a socket file left behind by a process that
+// didn't exit cleanly, refusing to take over a socket that is in use
+func removeStaleSocket(path, network string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout(network, path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// UnixServer receives log lines on Unix stream and datagram sockets
+type UnixServer struct {
+	stream       *net.UnixListener
+	datagram     *net.UnixConn
+	datagramPath string
+	mutex        sync.Mutex
+	conns        map[net.Conn]struct{} // Open stream connections
+	closed       bool                  // Set by close, after which new connections are refused
+}
+
+// ListenUnix listens on a Unix stream socket and a Unix datagram socket at
+// the given paths, either of which can be empty, with the given permissions
+func ListenUnix(streamPath, datagramPath string, mode os.FileMode) (*UnixServer, error) {
+	s := &UnixServer{datagramPath: datagramPath, conns: make(map[net.Conn]struct{})}
+	if streamPath != "" {
+		if err := removeStaleSocket(streamPath, "unix"); err != nil {
+			return nil, err
+		}
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: streamPath, Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", streamPath, err)
+		}
+		s.stream = listener
+		if err := os.Chmod(streamPath, mode); err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to set permissions of %s: %w", streamPath, err)
+		}
+	}
+
+	if datagramPath != "" {
+		err := removeStaleSocket(datagramPath, "unixgram")
+		if err == nil {
+			s.datagram, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: datagramPath, Net: "unixgram"})
+		}
+		if err == nil {
+			err = os.Chmod(datagramPath, mode)
+		}
+		if err == nil {
+			err = enableCredentials(s.datagram)
+		}
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to listen on %s: %w", datagramPath, err)
+		}
+	}
+	return s, nil
+}
+
+// Serve writes the lines received to the buffer until ctx is done
+func (s *UnixServer) Serve(ctx context.Context, buffer BufferInterface, programName string, signal chan struct{}, cfg *Config) {
+	buffer = bufferForSource(buffer, logSource{Program: programName})
+	serveLines(ctx, buffer, signal, cfg, func(lines chan<- []byte) {
+		var wg sync.WaitGroup
+		if s.stream != nil {
+			fmt.Fprintf(os.Stderr, "Listening for logs on %s\n", s.stream.Addr())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveStream(lines, &wg)
+			}()
+		}
+		if s.datagram != nil {
+			fmt.Fprintf(os.Stderr, "Listening for logs on %s\n", s.datagramPath)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveDatagrams(lines)
+			}()
+		}
+		wg.Wait()
+	}, s.close)
+}
+
+// close stops listening, closes the open connections and removes the socket
+// files
+func (s *UnixServer) close() {
+	if s.stream != nil {
+		// Closing the listener removes its socket file
+		s.stream.Close()
+	}
+	if s.datagram != nil {
+		s.datagram.Close()
+		os.Remove(s.datagramPath)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serveStream accepts connections until the listener is closed, serving
+// each of them in a goroutine tracked by wg
+func (s *UnixServer) serveStream(lines chan<- []byte, wg *sync.WaitGroup) {
+	for {
+		conn, err := s.stream.AcceptUnix()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error accepting connection: %v\n", err)
+			time.Sleep(blockedWriteInterval)
+			continue
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			// Accepted just before the listener was closed
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(conn, lines)
+		}()
+	}
+}
+
+// serveConn receives lines from a stream connection until it is closed
+func (s *UnixServer) serveConn(conn *net.UnixConn, lines chan<- []byte) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	cred, err := peerCredentials(conn)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		debugf("Can't get peer credentials: %v", err)
+	}
+	if cred != nil {
+		debugf("Connection from PID %d (UID %d)", cred.PID, cred.UID)
+	}
+	prefix := cred.prefix()
+
+	r := bufio.NewReaderSize(conn, maxTailLine)
+	for {
+		// Longer lines are split, like lines of followed files
+		line, err := r.ReadSlice('\n')
+		if text := bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")); len(text) > 0 {
+			lines <- socketLine(prefix, text)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "Error reading from %s: %v\n", s.stream.Addr(), err)
+			}
+			return
+		}
+	}
+}
+
+// serveDatagrams receives datagrams until the socket is closed
+func (s *UnixServer) serveDatagrams(lines chan<- []byte) {
+	buf := make([]byte, maxTailLine)
+	oob := make([]byte, credentialsOOBSize)
+
+	// Senders usually send many datagrams in a row
+	var last peerCred
+	var prefix []byte
+	for {
+		n, oobn, _, _, err := s.datagram.ReadMsgUnix(buf, oob)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error receiving from %s: %v\n", s.datagramPath, err)
+			continue
+		}
+
+		cred := datagramCredentials(oob[:oobn])
+		switch {
+		case cred == nil:
+			prefix = nil
+		case prefix == nil || *cred != last:
+			last, prefix = *cred, cred.prefix()
+		}
+
+		for _, text := range bytes.Split(buf[:n], []byte("\n")) {
+			if text = bytes.TrimSuffix(text, []byte("\r")); len(text) > 0 {
+				lines <- socketLine(prefix, text)
+			}
+		}
+	}
+}
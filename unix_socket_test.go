@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSocketMode(t *testing.T) {
+	var mode socketMode
+	if err := mode.Set("0640"); err != nil || mode != 0o640 {
+		t.Errorf("Set(0640) = %v, %o", err, mode)
+	}
+	if mode.String() != "0640" {
+		t.Errorf("String() = %q", mode.String())
+	}
+	for _, invalid := range []string{"", "rw", "0999", "1777"} {
+		if err := mode.Set(invalid); err == nil {
+			t.Errorf("Set(%q) succeeded", invalid)
+		}
+	}
+}
+
+// startUnixServer serves Unix sockets into a memory buffer until the test ends
+func startUnixServer(t *testing.T, streamPath, datagramPath string) *MemoryBuffer {
+	t.Helper()
+	server, err := ListenUnix(streamPath, datagramPath, 0o600)
+	if err != nil {
+		t.Fatalf("ListenUnix failed: %v", err)
+	}
+	buffer, err := NewMemoryBuffer(1<<20, BufferOptions{})
+	if err != nil {
+		t.Fatalf("NewMemoryBuffer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.Serve(ctx, buffer, "test-program", make(chan struct{}, 1), &Config{})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		buffer.Close()
+
+		// The socket files are removed on exit
+		for _, path := range []string{streamPath, datagramPath} {
+			if _, err := os.Lstat(path); path != "" && err == nil {
+				t.Errorf("%s was left behind", path)
+			}
+		}
+	})
+	return buffer
+}
+
+// checkPeer checks that lines are tagged with this process as their peer
+func checkPeer(t *testing.T, lines []string) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		return
+	}
+	for _, line := range lines {
+		fields, _ := untagLine(line)
+		peer, ok := fields["peer"].(map[string]any)
+		if !ok {
+			t.Fatalf("Line %q isn't tagged with its peer", line)
+		}
+		got := fmt.Sprintf("%v/%v/%v", peer["pid"], peer["uid"], peer["gid"])
+		if got != fmt.Sprintf("%d/%d/%d", os.Getpid(), os.Getuid(), os.Getgid()) {
+			t.Errorf("Line %q has peer %v, want PID %d, UID %d, GID %d", line, peer, os.Getpid(), os.Getuid(), os.Getgid())
+		}
+	}
+}
+
+func TestUnixStreamSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	buffer := startUnixServer(t, path, "")
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Socket has mode %v, %v, want 0600", info.Mode(), err)
+	}
+
+	// Clients write concurrently, in pieces that don't end at line ends
+	var wg sync.WaitGroup
+	for client := 0; client < 3; client++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Errorf("Dial failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "client %d line 1\nclient %d", client, client)
+			fmt.Fprintf(conn, " line 2\r\n\nclient %d line 3", client)
+		}()
+	}
+	wg.Wait()
+
+	var want []string
+	for client := 0; client < 3; client++ {
+		for line := 1; line <= 3; line++ {
+			want = append(want, fmt.Sprintf("client %d line %d\n", client, line))
+		}
+	}
+	lines := waitForSortedLines(t, buffer, want)
+	checkPeer(t, lines)
+}
+
+func TestUnixDatagramSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.dgram")
+	buffer := startUnixServer(t, "", path)
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	for _, datagram := range []string{"first\n", "second\nthird", "fourth\n"} {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	lines := waitForLines(t, buffer, "first\n", "second\n", "third\n", "fourth\n")
+	checkPeer(t, lines)
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket nobody listens on anymore is removed
+	stale := filepath.Join(dir, "stale.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+	if err := removeStaleSocket(stale, "unix"); err != nil {
+		t.Errorf("removeStaleSocket failed on a stale socket: %v", err)
+	}
+
+	// Sockets in use and other files are left alone
+	inUse := filepath.Join(dir, "in-use.sock")
+	if listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: inUse, Net: "unix"}); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	if _, err := ListenUnix(inUse, "", 0o600); err == nil {
+		t.Error("ListenUnix took over a socket in use")
+	}
+	regular := filepath.Join(dir, "file")
+	appendFile(t, regular, "")
+	if _, err := ListenUnix(regular, "", 0o600); err == nil {
+		t.Error("ListenUnix replaced a regular file")
+	}
+}
+
+// waitForSortedLines is waitForLines for lines that can arrive in any order
+func waitForSortedLines(t *testing.T, buffer BufferInterface, want []string) []string {
+	t.Helper()
+	var tagged, got []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(got) < len(want) && time.Now().Before(deadline) {
+		for _, line := range readAllRecords(t, buffer) {
+			_, text := untagLine(line)
+			tagged, got = append(tagged, line), append(got, text)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Received %q, want %q", got, want)
+	}
+	return tagged
+}
@@ -17,8 +17,9 @@ import (
 
 // LogEntry represents a JSON log entry for the HTTP API
 type LogEntry struct {
-	Timestamp string `json:"dt"`
-	Message   string `json:"message"`
+	Timestamp string         `json:"dt"`
+	Message   string         `json:"message"`
+	Fields    map[string]any `json:"-"` // Fields of a tagged line, sent next to the message
 }
 
 // LogBatch represents a batch of log entries